@@ -16,6 +16,8 @@
 package app
 
 import (
+	"time"
+
 	"k8s.io/client-go/informers"
 	clientset "k8s.io/client-go/kubernetes"
 	restclient "k8s.io/client-go/rest"
@@ -64,7 +66,32 @@ type Config struct {
 	PolarStackDaemonPodLabels  string // polar stack daemon 的 labels 用于准确查找出 polarstack-daemon 的 Pod 以便调用相关 API
 	CoreVersionConfigMapLabel  string // core version configMap 的相关 labels
 	MpdControllerConfigMapName string // mpd controller configMap Name (polardb4mpd-controller)
+	PortRangeConfigMapName     string // 端口扫描区间配置 configMap Name，不存在时使用 mpd controller configMap 的 annotation
+	PortScanContainerNetns     bool   // 端口扫描是否包含 pod 的 hostPort、iptables DNAT 规则及容器网络命名空间中的 socket
+	ContainerRuntime           string // 检测镜像使用的容器运行时 auto/docker/containerd/crio
+	ContainerRuntimeEndpoint   string // 容器运行时的 socket，为空时使用该运行时的默认 socket
+	PrefetchPullPolicy         string // 预拉取请求未指定 pullPolicy 时使用的策略 IfNotPresent/Always
+	SecurePort                 int32  // https 端口，证书与私钥文件存在时开启，节点间通知使用该端口
+	TLSCertFile                string // https 证书文件
+	TLSPrivateKeyFile          string // https 私钥文件
+	PeerCAFile                 string // 校验其它节点证书的 CA 文件，开启 https 时必须指定
+	PeerTLSServerName          string // 校验其它节点证书时使用的名称，证书中须包含该名称
+	AllowInsecurePeerNotify    bool   // 未开启双向 TLS 时是否以 http 通知其它节点，并在 http 端口提供内部通知接口
 	ServiceOwnerDbCluster      string // service Owner db cluster
+
+	// 内核镜像回收
+	ImageGCEnabled            bool          // 是否开启内核镜像回收
+	ImageGCRetentionCount     int32         // 保留的最新版本数，<= 0 时保留全部版本，仅回收不再发布的镜像
+	ImageGCMinFreeDiskPercent int32         // 镜像所在磁盘剩余空间低于该百分比时回收，<= 0 时每次检查都回收
+	ImageGCDiskPath           string        // 检查剩余空间的目录，为空时为运行时在主机上的镜像数据目录
+	ImageGCInterval           time.Duration // 检查剩余空间的间隔
+
+	// 数据库日志清理
+	LogCleanupDryRun      bool          // 只记录并发布将被删除的日志，不删除
+	LogDiskHighWatermark  int32         // 日志目录所在磁盘使用率达到该百分比时清理，<= 0（默认）时不清理
+	LogDiskLowWatermark   int32         // 清理到使用率低于该百分比为止
+	LogRetentionKeepFiles int32         // 每个实例至少保留的最新日志数，不少于 1
+	LogDiskCheckInterval  time.Duration // 检查日志目录磁盘使用率的间隔
 }
 
 type completedConfig struct {
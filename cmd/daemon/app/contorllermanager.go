@@ -98,6 +98,12 @@ func Run(completedConfig *config.CompletedConfig, stopCh <-chan struct{}) error
 	go usage.StartPrintPort(client.(*clientset.Clientset), stopCh)
 	klog.Info("start StartCheckCoreVersion")
 	go core_version.StartCheckCoreVersion(client.(*clientset.Clientset))
+	klog.Info("start StartWatchCoreVersion")
+	go core_version.StartWatchCoreVersion(client.(*clientset.Clientset), stopCh)
+	klog.Info("start StartWatchImageEvents")
+	go core_version.StartWatchImageEvents(client.(*clientset.Clientset), stopCh)
+	klog.Info("start StartImageGC")
+	go core_version.StartImageGC(client.(*clientset.Clientset), stopCh)
 
 	port := config.Conf.Port
 	klog.Infof("webserver port:%d", port)
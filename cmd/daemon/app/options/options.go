@@ -16,8 +16,10 @@
 package options
 
 import (
+	"fmt"
 	config "github.com/ApsaraDB/PolarDB-Stack-Daemon/cmd/daemon/app/config"
 	"os"
+	"time"
 
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -60,7 +62,32 @@ type PolarStackControllerManagerOptions struct {
 	PolarStackDaemonPodLabels  string // polar stack daemon 的 labels 用于准确查找出 polarstack-daemon 的 Pod 以便调用相关 API
 	CoreVersionConfigMapLabel  string // core version configMap 的相关 labels
 	MpdControllerConfigMapName string // mpd controller configMap Name (polardb4mpd-controller)
+	PortRangeConfigMapName     string // 端口扫描区间配置 configMap Name，不存在时使用 mpd controller configMap 的 annotation
+	PortScanContainerNetns     bool   // 端口扫描是否包含 pod 的 hostPort、iptables DNAT 规则及容器网络命名空间中的 socket
+	ContainerRuntime           string // 检测镜像使用的容器运行时 auto/docker/containerd/crio
+	ContainerRuntimeEndpoint   string // 容器运行时的 socket，为空时使用该运行时的默认 socket
+	PrefetchPullPolicy         string // 预拉取请求未指定 pullPolicy 时使用的策略 IfNotPresent/Always
+	SecurePort                 int32  // https 端口，证书与私钥文件存在时开启，节点间通知使用该端口
+	TLSCertFile                string // https 证书文件
+	TLSPrivateKeyFile          string // https 私钥文件
+	PeerCAFile                 string // 校验其它节点证书的 CA 文件，开启 https 时必须指定
+	PeerTLSServerName          string // 校验其它节点证书时使用的名称，证书中须包含该名称
+	AllowInsecurePeerNotify    bool   // 未开启双向 TLS 时是否以 http 通知其它节点，并在 http 端口提供内部通知接口
 	ServiceOwnerDbCluster      string // service owner db cluster
+
+	// 内核镜像回收
+	ImageGCEnabled            bool            // 是否开启内核镜像回收
+	ImageGCRetentionCount     int32           // 保留的最新版本数，<= 0 时保留全部版本，仅回收不再发布的镜像
+	ImageGCMinFreeDiskPercent int32           // 镜像所在磁盘剩余空间低于该百分比时回收，<= 0 时每次检查都回收
+	ImageGCDiskPath           string          // 检查剩余空间的目录，为空时为运行时在主机上的镜像数据目录
+	ImageGCInterval           metav1.Duration // 检查剩余空间的间隔
+
+	// 数据库日志清理
+	LogCleanupDryRun      bool            // 只记录并发布将被删除的日志，不删除
+	LogDiskHighWatermark  int32           // 日志目录所在磁盘使用率达到该百分比时清理，<= 0（默认）时不清理
+	LogDiskLowWatermark   int32           // 清理到使用率低于该百分比为止
+	LogRetentionKeepFiles int32           // 每个实例至少保留的最新日志数，不少于 1
+	LogDiskCheckInterval  metav1.Duration // 检查日志目录磁盘使用率的间隔
 }
 
 func NewPolarStackControllerManagerOptions() (*PolarStackControllerManagerOptions, error) {
@@ -101,7 +128,28 @@ func (o *PolarStackControllerManagerOptions) Flags() cliflag.NamedFlagSets {
 	fs.StringVar(&o.PolarStackDaemonPodLabels, "polarstack-daemon-pod-labels", "app=polarstack-daemon", "polar stack daemon pod labels")
 	fs.StringVar(&o.CoreVersionConfigMapLabel, "core-version-cm-labels", "configtype=minor_version_info,dbClusterMode=WriteReadMore", "core version configMap labels")
 	fs.StringVar(&o.MpdControllerConfigMapName, "mpd-controller-cm-name", "polardb4mpd-controller", "mpd controller configMap name ")
+	fs.StringVar(&o.PortRangeConfigMapName, "port-range-cm-name", "polarstack-daemon-port-ranges", "port range configMap name")
+	fs.BoolVar(&o.PortScanContainerNetns, "port-scan-container-netns", false, "port scan include pod host ports and iptables dnat rules, sockets in container network namespaces are listed as owners only")
+	fs.StringVar(&o.ContainerRuntime, "container-runtime", "auto", "container runtime used to check images: auto, docker, containerd or crio")
+	fs.StringVar(&o.ContainerRuntimeEndpoint, "container-runtime-endpoint", "", "container runtime socket, empty means the default socket of the runtime")
+	fs.StringVar(&o.PrefetchPullPolicy, "prefetch-pull-policy", "IfNotPresent", "default pull policy of core version prefetch requests: IfNotPresent or Always")
+	fs.Int32Var(&o.SecurePort, "secure-port", 8901, "https server port, enabled when tls cert and key files exist")
+	fs.StringVar(&o.TLSCertFile, "tls-cert-file", "", "https server certificate file")
+	fs.StringVar(&o.TLSPrivateKeyFile, "tls-private-key-file", "", "https server private key file")
+	fs.StringVar(&o.PeerCAFile, "peer-ca-file", "", "ca file to verify certificates of other polarstack-daemon nodes, required for https")
+	fs.StringVar(&o.PeerTLSServerName, "peer-tls-server-name", "polarstack-daemon", "server name to verify certificates of other polarstack-daemon nodes")
+	fs.BoolVar(&o.AllowInsecurePeerNotify, "allow-insecure-peer-notify", false, "notify other polarstack-daemon nodes over plain http when mutual tls is not configured")
 	fs.StringVar(&o.ServiceOwnerDbCluster, "service-owner-db-cluster", "mpdcluster", "service owner db cluster")
+	fs.BoolVar(&o.ImageGCEnabled, "image-gc-enabled", false, "remove images of unpublished or old core versions when disk space is low")
+	fs.Int32Var(&o.ImageGCRetentionCount, "image-gc-retention-count", 3, "number of newest core versions whose images are kept, <= 0 keeps all versions")
+	fs.Int32Var(&o.ImageGCMinFreeDiskPercent, "image-gc-min-free-disk-percent", 20, "image gc runs when free percent of the image disk is below it, <= 0 runs every interval")
+	fs.StringVar(&o.ImageGCDiskPath, "image-gc-disk-path", "", "path to check free disk space, empty means the image data dir of the runtime mounted under /host")
+	fs.DurationVar(&o.ImageGCInterval.Duration, "image-gc-interval", 10*time.Minute, "interval to check free disk space for image gc")
+	fs.Int32Var(&o.LogDiskHighWatermark, "log-disk-high-watermark", 0, "delete oldest database logs when disk usage percent of dbcluster-log-dir reaches it, <= 0 disables")
+	fs.Int32Var(&o.LogDiskLowWatermark, "log-disk-low-watermark", 75, "delete database logs until disk usage percent of dbcluster-log-dir is below it")
+	fs.Int32Var(&o.LogRetentionKeepFiles, "log-retention-keep-files", 5, "number of newest postgresql logs always kept for each instance, at least 1")
+	fs.DurationVar(&o.LogDiskCheckInterval.Duration, "log-disk-check-interval", time.Minute, "interval to check disk usage of dbcluster-log-dir")
+	fs.BoolVar(&o.LogCleanupDryRun, "log-cleanup-dry-run", false, "only log and publish the database logs to be deleted, do not delete them")
 	return fss
 }
 
@@ -109,6 +157,10 @@ func (o *PolarStackControllerManagerOptions) Flags() cliflag.NamedFlagSets {
 func (o *PolarStackControllerManagerOptions) ApplyTo(c *config.Config, userAgent string) error {
 	var err error
 
+	if o.PrefetchPullPolicy != "IfNotPresent" && o.PrefetchPullPolicy != "Always" {
+		return fmt.Errorf("invalid --prefetch-pull-policy %q, it should be IfNotPresent or Always", o.PrefetchPullPolicy)
+	}
+
 	c.Kubeconfig, err = clientcmd.BuildConfigFromFlags(o.Master, o.Kubeconfig)
 	if err != nil {
 		return err
@@ -136,7 +188,28 @@ func (o *PolarStackControllerManagerOptions) ApplyTo(c *config.Config, userAgent
 	c.PolarStackDaemonPodLabels = o.PolarStackDaemonPodLabels
 	c.CoreVersionConfigMapLabel = o.CoreVersionConfigMapLabel
 	c.MpdControllerConfigMapName = o.MpdControllerConfigMapName
+	c.PortRangeConfigMapName = o.PortRangeConfigMapName
+	c.PortScanContainerNetns = o.PortScanContainerNetns
+	c.ContainerRuntime = o.ContainerRuntime
+	c.ContainerRuntimeEndpoint = o.ContainerRuntimeEndpoint
+	c.PrefetchPullPolicy = o.PrefetchPullPolicy
+	c.SecurePort = o.SecurePort
+	c.TLSCertFile = o.TLSCertFile
+	c.TLSPrivateKeyFile = o.TLSPrivateKeyFile
+	c.PeerCAFile = o.PeerCAFile
+	c.PeerTLSServerName = o.PeerTLSServerName
+	c.AllowInsecurePeerNotify = o.AllowInsecurePeerNotify
 	c.ServiceOwnerDbCluster = o.ServiceOwnerDbCluster
+	c.ImageGCEnabled = o.ImageGCEnabled
+	c.ImageGCRetentionCount = o.ImageGCRetentionCount
+	c.ImageGCMinFreeDiskPercent = o.ImageGCMinFreeDiskPercent
+	c.ImageGCDiskPath = o.ImageGCDiskPath
+	c.ImageGCInterval = o.ImageGCInterval.Duration
+	c.LogCleanupDryRun = o.LogCleanupDryRun
+	c.LogDiskHighWatermark = o.LogDiskHighWatermark
+	c.LogDiskLowWatermark = o.LogDiskLowWatermark
+	c.LogRetentionKeepFiles = o.LogRetentionKeepFiles
+	c.LogDiskCheckInterval = o.LogDiskCheckInterval.Duration
 	return nil
 }
 
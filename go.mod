@@ -11,15 +11,18 @@ require (
 	github.com/sirupsen/logrus v1.2.0
 	github.com/spf13/cobra v0.0.3
 	golang.org/x/crypto v0.0.0-20191112222119-e1110fd1c708
+	google.golang.org/grpc v1.13.0
 	gopkg.in/go-playground/assert.v1 v1.2.1 // indirect
 	gopkg.in/go-playground/validator.v9 v9.31.0
 	k8s.io/api v0.0.0
 	k8s.io/apimachinery v0.0.0
 	k8s.io/client-go v11.0.1-0.20190409021438-1a26190bd76a+incompatible
 	k8s.io/component-base v0.0.0
+	k8s.io/cri-api v0.0.0
 	k8s.io/klog v1.0.0
 	k8s.io/kubernetes v1.15.3
 	sigs.k8s.io/controller-runtime v0.2.2
+	sigs.k8s.io/yaml v1.1.0
 )
 
 replace (
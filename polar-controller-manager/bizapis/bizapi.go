@@ -16,46 +16,106 @@
 package bizapis
 
 import (
+	"crypto/tls"
 	"fmt"
 	config "github.com/ApsaraDB/PolarDB-Stack-Daemon/cmd/daemon/app/config"
 	"github.com/ApsaraDB/PolarDB-Stack-Daemon/polar-controller-manager/bizapis/controller"
 	"github.com/ApsaraDB/PolarDB-Stack-Daemon/polar-controller-manager/bizapis/service"
 	"github.com/ApsaraDB/PolarDB-Stack-Daemon/polar-controller-manager/core_version"
+	"github.com/ApsaraDB/PolarDB-Stack-Daemon/polar-controller-manager/db_log_monitor"
+	usage "github.com/ApsaraDB/PolarDB-Stack-Daemon/polar-controller-manager/port_usage"
 	"github.com/ApsaraDB/PolarDB-Stack-Daemon/polar-controller-manager/util"
 	"github.com/gin-gonic/gin"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/klog"
+	"net"
+	"net/http"
 )
 
 const (
 	PathHealthz                 = "/healthz"
-	PathInnerCheckCoreVersion   = "InnerCheckCoreVersion"
+	PathInnerCheckCoreVersion   = core_version.PathInnerCheckCoreVersion
 	PathRequestCheckCoreVersion = "RequestCheckCoreVersion"
+	PathPrefetchCoreVersion     = "PrefetchCoreVersion"
+	PathCoreVersionMatrix       = "CoreVersionMatrix"
+	PathImageGCReport           = "ImageGCReport"
+	PathLogCleanupPlan          = "LogCleanupPlan"
 	PathGetStandByIp            = "GetStandByIp"
 	PathTestConn                = "TestConn"
+	PathReservePorts            = "ReservePorts"
+	PathReleasePorts            = "ReleasePorts"
+	PathGetPortReservations     = "GetPortReservations"
+	PathFindFreePortsOnNodes    = "FindFreePortsOnNodes"
+	PathScanPorts               = "ScanPorts"
+	PathPortUsageHistory        = "PortUsageHistory"
 )
 
+// StartHttpServer
+/**
+ * @Title: 启动 http 与 https 服务
+ * @Description:
+ *
+ *	开启 https（证书与私钥文件存在）时，https 端口要求客户端证书，并只以 --peer-ca-file 校验，
+ *	节点间通知的 InnerCheckCoreVersion 只在 https 端口上提供；
+ *	未开启 https 时只有 --allow-insecure-peer-notify 才在 http 端口上提供该接口，否则不提供
+ **/
 func StartHttpServer(cfg *config.CompletedConfig, client kubernetes.Interface) {
 	port := cfg.Port
 	klog.Infof("webserver port:%d", port)
-	router := gin.Default()
+	gin.SetMode(gin.ReleaseMode)
 	componentService := service.NewService(client, cfg)
-	initRoute(router, componentService)
 
-	go func() {
-		gin.SetMode(gin.ReleaseMode)
+	var secureRouter *gin.Engine
+	var tlsConfig *tls.Config
+	if util.TLSFilesExist(cfg.TLSCertFile, cfg.TLSPrivateKeyFile) {
+		var err error
+		if tlsConfig, err = util.NewMutualTLSServerConfig(cfg.PeerCAFile); err != nil {
+			klog.Errorf("failed to load peer ca file %q, https webserver is disabled, err:%v", cfg.PeerCAFile, err)
+		} else {
+			secureRouter = gin.Default()
+			initRoute(secureRouter, componentService, true)
+		}
+	} else {
+		klog.Warningf("tls cert file %q or key file %q not found, https webserver is disabled", cfg.TLSCertFile, cfg.TLSPrivateKeyFile)
+	}
 
-		addr := fmt.Sprintf(":%d", port)
-		err := router.Run(addr)
-		if err != nil {
-			klog.Warningf("failed to start webserver, err:%v", err)
+	insecureInner := secureRouter == nil && cfg.AllowInsecurePeerNotify
+	if secureRouter == nil && !insecureInner {
+		klog.Warningf("mutual tls is not enabled and --allow-insecure-peer-notify is false, %s is disabled", PathInnerCheckCoreVersion)
+	}
+	router := gin.Default()
+	initRoute(router, componentService, insecureInner)
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		klog.Warningf("failed to start webserver, err:%v", err)
+	} else {
+		klog.Infof("start webserver on port:%d done", port)
+		go func() {
+			if err := http.Serve(listener, router); err != nil {
+				klog.Warningf("webserver on port:%d stopped, err:%v", port, err)
+			}
+		}()
+	}
+
+	if secureRouter == nil {
+		return
+	}
+	secureListener, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.SecurePort))
+	if err != nil {
+		klog.Warningf("failed to start https webserver, err:%v", err)
+		return
+	}
+	klog.Infof("start https webserver on port:%d done", cfg.SecurePort)
+	go func() {
+		server := &http.Server{Handler: secureRouter, TLSConfig: tlsConfig}
+		if err := server.ServeTLS(secureListener, cfg.TLSCertFile, cfg.TLSPrivateKeyFile); err != nil {
+			klog.Warningf("https webserver on port:%d stopped, err:%v", cfg.SecurePort, err)
 		}
 	}()
-
-	klog.Infof("start webserver on port:%d done", port)
 }
 
-func initRoute(router *gin.Engine, service *service.Service) {
+// initRoute 注册接口，withInner 为 false 时不注册节点间通知使用的接口
+func initRoute(router *gin.Engine, service *service.Service, withInner bool) {
 	router.GET(PathHealthz, health)
 
 	v1Group := router.Group(util.PathPrefix)
@@ -65,5 +125,17 @@ func initRoute(router *gin.Engine, service *service.Service) {
 	GET(v1Group, PathTestConn, testConn, PublicAPI, "test conn")
 	GET(v1Group, PathGetStandByIp, systemCtl.GetPodStandByIp, PublicAPI, "get standby ip")
 	POST(v1Group, PathRequestCheckCoreVersion, core_version.RequestCheckCoreVersion, PublicAPI, "request to check core version")
-	POST(v1Group, PathInnerCheckCoreVersion, core_version.InnerCheckCoreVersion, PublicAPI, "inner request to check core version")
+	if withInner {
+		POST(v1Group, PathInnerCheckCoreVersion, core_version.InnerCheckCoreVersion, PublicAPI, "inner request to check core version")
+	}
+	POST(v1Group, PathPrefetchCoreVersion, core_version.PrefetchCoreVersion, PublicAPI, "pull images of a core version on current node")
+	GET(v1Group, PathCoreVersionMatrix, core_version.GetCoreVersionMatrix, PublicAPI, "get core version availability of all nodes")
+	GET(v1Group, PathImageGCReport, core_version.GetImageGCReport, PublicAPI, "dry run image gc on current node")
+	GET(v1Group, PathLogCleanupPlan, db_log_monitor.GetLogCleanupPlan, PublicAPI, "get database logs to be deleted on current node")
+	POST(v1Group, PathReservePorts, usage.ReservePorts, PublicAPI, "reserve free ports in a named range")
+	POST(v1Group, PathReleasePorts, usage.ReleasePorts, PublicAPI, "release reserved ports")
+	GET(v1Group, PathGetPortReservations, usage.GetPortReservations, PublicAPI, "get port reservations")
+	POST(v1Group, PathFindFreePortsOnNodes, usage.FindFreePortsOnNodes, PublicAPI, "find ports free on all given nodes")
+	POST(v1Group, PathScanPorts, usage.ScanPorts, PublicAPI, "scan ports now and return used ports")
+	GET(v1Group, PathPortUsageHistory, usage.GetPortUsageHistory, PublicAPI, "get port usage change history")
 }
@@ -52,6 +52,8 @@ var coreVersionConfigMapLabel = "configtype=minor_version_info,dbClusterMode=Wri
 const (
 	// core version configMap 的 data 中 Key 如果包含 Image 则为镜像
 	coreVersionImageKeyKeyWord = "Image"
+	// core version configMap 的 data 中镜像 Key 加上该后缀为该镜像期望的 digest（可选），如 pfsdImageDigest
+	coreVersionImageDigestKeySuffix = "Digest"
 	// core version configMap 的 data 中 Key 如果是 name 则为版本号
 	coreVersionNameKey = "name"
 	// 主机记录 core version 的 config name 格式，需采用 hostName 替换
@@ -62,21 +64,11 @@ const (
 	logInfoTarget = "[core_version]"
 )
 
-// CheckCoreVersionOperatorType 外部请求检查 core version
-var CheckCoreVersionOperatorType OperatorType = "CheckCoreVersionOperatorType"
-
-// SingleCheckCoreVersionOperatorType 来自内部的检查通知
+// SingleCheckCoreVersionOperatorType 检查当前节点，外部请求、内部通知及版本、镜像变化均使用该类型
 var SingleCheckCoreVersionOperatorType OperatorType = "SingleCheckCoreVersionOperatorType"
 
 func (opt OperatorType) ToString() string {
-	switch opt {
-	case CheckCoreVersionOperatorType:
-		return "CheckCoreVersionOperatorType"
-	case SingleCheckCoreVersionOperatorType:
-		return "SingleCheckCoreVersionOperatorType"
-	default:
-		return "CheckCoreVersionOperatorType"
-	}
+	return string(opt)
 }
 
 /**
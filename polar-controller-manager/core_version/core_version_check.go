@@ -16,6 +16,7 @@
 package core_version
 
 import (
+	"encoding/json"
 	"fmt"
 	config "github.com/ApsaraDB/PolarDB-Stack-Daemon/cmd/daemon/app/config"
 	"github.com/ApsaraDB/PolarDB-Stack-Daemon/polar-controller-manager/util"
@@ -23,7 +24,9 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	clientset "k8s.io/client-go/kubernetes"
 	"k8s.io/klog"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -35,6 +38,7 @@ import (
 func StartCheckCoreVersion(client *clientset.Clientset) {
 	polarStackDaemonLabels = config.Conf.PolarStackDaemonPodLabels
 	coreVersionConfigMapLabel = config.Conf.CoreVersionConfigMapLabel
+	setContainerRuntime(client)
 
 	for {
 		klog.Infof("%s StartCheckCoreVersion ", logInfoTarget)
@@ -43,57 +47,59 @@ func StartCheckCoreVersion(client *clientset.Clientset) {
 		klog.Infof("%s coreVersionConfigMapLabel = %s ", logInfoTarget, coreVersionConfigMapLabel)
 		go startCheckCoreVersion(client)
 
+		// 队列中的请求均只检查当前节点，通知其它节点由 RequestCheckCoreVersion 完成
 		request := <-CheckRequestQueue
-		// 请求仅为检测当前节点，再广播通知其它 polarstack-daemon 节点
-		if request == SingleCheckCoreVersionOperatorType {
-			continue
-		}
-
-		startNotifyOtherNode(client)
-
-		klog.Infof("%s StartCheckCoreVersion current host name:%s requestType:%s", logInfoTarget, hostName, request)
+		klog.Infof("%s StartCheckCoreVersion current host name:%s requestType:%s", logInfoTarget, hostName, request.ToString())
 	}
 }
 
-// startNotifyOtherNode
+// setContainerRuntime
 /**
- * @Title:  startNotifyOtherNode
- * @Description: 开始通知其它节占主机
+ * @Title:  setContainerRuntime
+ * @Description:
+ *
+ *	设置检测镜像使用的容器运行时，--container-runtime=auto 且未指定 socket 时，
+ *	优先使用节点上报的运行时（node.status.nodeInfo.containerRuntimeVersion），获取不到时按 socket 探测
+ *	检查与镜像事件监听均需先设置运行时，仅执行一次
  **/
-func startNotifyOtherNode(client *clientset.Clientset) {
-	defer func() {
-		if err := recover(); err != nil {
-			klog.Errorf("%s failed to startNotifyOtherNode err:%v", logInfoTarget, err)
-		}
-	}()
-	var httpClient = &util.HttpClient{Timeout: 3 * time.Second}
-
-	// 获取 polarstack-daemon 节点的 ip
-	ips := getPolarStackDaemonNodeIps(client)
-	if nil == ips {
-		klog.Infof("%s StartCheckCoreVersion failed get daemon ips = nil", logInfoTarget)
-		return
-	}
-	for _, ip := range ips {
-		klog.Infof("%s hostName:[%s] get daemon ips", logInfoTarget, hostName)
-		header := make(map[string]string)
-		type source struct {
-			HostName string
-		}
-
-		url := "/innerCheckCoreVersion"
-		httpClient.Host = fmt.Sprintf("https://%s:%d", ip, config.Conf.Port)
+func setContainerRuntime(client *clientset.Clientset) {
+	containerRuntimeOnce.Do(func() {
+		doSetContainerRuntime(client)
+	})
+}
 
-		resp, err := httpClient.HttpsPost(url, header, &source{
-			HostName: hostName,
-		})
+var containerRuntimeOnce sync.Once
 
+func doSetContainerRuntime(client *clientset.Clientset) {
+	runtime := config.Conf.ContainerRuntime
+	if (runtime == "" || runtime == util.ContainerRuntimeAuto) && config.Conf.ContainerRuntimeEndpoint == "" && config.Conf.CurrentNodeName != "" {
+		node, err := client.CoreV1().Nodes().Get(config.Conf.CurrentNodeName, metav1.GetOptions{})
 		if err != nil {
-			klog.Errorf("%s failed to post ip:%s, url:%s, err:%s", logInfoTarget, ip, url, err.Error())
-			continue
+			klog.Warningf("%s get node %s failed, detect container runtime by socket. err:%v", logInfoTarget, config.Conf.CurrentNodeName, err)
+		} else {
+			runtime = getNodeContainerRuntime(node)
 		}
+	}
+	if err := util.SetContainerRuntime(runtime, config.Conf.ContainerRuntimeEndpoint); err != nil {
+		klog.Errorf("%s invalid container runtime, detect container runtime by socket. err:%v", logInfoTarget, err)
+		_ = util.SetContainerRuntime(util.ContainerRuntimeAuto, "")
+		return
+	}
+	klog.Infof("%s container runtime: %s, endpoint: %s", logInfoTarget, runtime, config.Conf.ContainerRuntimeEndpoint)
+}
 
-		klog.Infof("%s success! ip:%s url:%s, httpStatusCode:[%d]", logInfoTarget, ip, url, resp.StatusCode)
+// getNodeContainerRuntime 由 containerRuntimeVersion（如 docker://19.3.5、containerd://1.4.3）得到运行时，未知时返回 auto
+func getNodeContainerRuntime(node *v1.Node) string {
+	version := node.Status.NodeInfo.ContainerRuntimeVersion
+	switch {
+	case strings.HasPrefix(version, "docker://"):
+		return util.ContainerRuntimeDocker
+	case strings.HasPrefix(version, "containerd://"):
+		return util.ContainerRuntimeContainerd
+	case strings.HasPrefix(version, "cri-o://"):
+		return util.ContainerRuntimeCrio
+	default:
+		return util.ContainerRuntimeAuto
 	}
 }
 
@@ -113,12 +119,14 @@ func startCheckCoreVersion(client *clientset.Clientset) {
 	coreVersions, err := getAllCoreVersionConfigMapByLabels(client, coreVersionConfigMapLabel)
 	if err != nil {
 		klog.Errorf("%s getAllCoreVersionConfigMapByLabels failed. err:%v", logInfoTarget, err)
+		setLastCheckError(client, err)
 		return
 	}
 
 	klog.Infof("%s success get [%d] core version config, ready to check now.", logInfoTarget, len(coreVersions.Items))
 
-	existingVersions := getExistingVersions(coreVersions)
+	versions, versionStatus := getExistingVersions(coreVersions)
+	existingVersions := formatExistingVersions(versions)
 
 	klog.Infof("%s check done. now will update the host core version configMap. %s", logInfoTarget, existingVersions)
 	versionConfigMap, err := getHostCoreVersionConfigMap(client)
@@ -126,15 +134,14 @@ func startCheckCoreVersion(client *clientset.Clientset) {
 		klog.Errorf("%s failed to get core version configMap. err:%s", logInfoTarget, err.Error())
 		return
 	}
-	// 将末尾,号去除
-	if len(existingVersions) > 0 {
-		existingVersions = strings.TrimRight(existingVersions, ",")
-	} else {
+	if len(existingVersions) == 0 {
 		klog.Warningf("%s existingVersions is empty.", logInfoTarget)
 	}
 
 	versionConfigMap.Data["existingVersions"] = existingVersions
+	setVersionStatus(versionConfigMap, versionStatus)
 	versionConfigMap.Data["checkTime"] = time.Now().Format(timeFormat)
+	delete(versionConfigMap.Data, lastCheckErrorKey)
 
 	_, err = updateHostCoreVersionConfigMap(client, versionConfigMap)
 	if err != nil {
@@ -144,12 +151,136 @@ func startCheckCoreVersion(client *clientset.Clientset) {
 	klog.Infof("%s Success! already update [%s].Data to versions:%s", logInfoTarget, versionConfigMap.Name, existingVersions)
 }
 
+// 主机 configMap 中记录最近一次检查失败原因的 key，检查成功后删除
+const lastCheckErrorKey = "lastCheckError"
+
+// setLastCheckError 检查未能完成时记录失败原因，各版本的状态保持上次的结果
+func setLastCheckError(client *clientset.Clientset, checkErr error) {
+	versionConfigMap, err := getHostCoreVersionConfigMap(client)
+	if err != nil {
+		klog.Errorf("%s failed to get core version configMap. err:%s", logInfoTarget, err.Error())
+		return
+	}
+	versionConfigMap.Data[lastCheckErrorKey] = fmt.Sprintf("%s %v", time.Now().Format(timeFormat), checkErr)
+	if _, err = updateHostCoreVersionConfigMap(client, versionConfigMap); err != nil {
+		klog.Errorf("%s failed to update host core version configMap. err:%s", logInfoTarget, err.Error())
+	}
+}
+
+// 版本在本机的可用状态
+const (
+	versionStatusAvailable     = "available"
+	versionStatusMissing       = "missing"
+	versionStatusWrongDigest   = "present but wrong digest"
+	versionStatusWrongPlatform = "present but wrong platform"
+)
+
+// 本机的平台，版本的镜像须能在该平台上运行
+var hostPlatform = util.HostPlatform()
+
+// wrongPlatformImage 本机镜像的平台与主机不一致，无法运行
+type wrongPlatformImage struct {
+	Image        string `json:"image"`
+	Platform     string `json:"platform"`
+	HostPlatform string `json:"hostPlatform"`
+	Reason       string `json:"reason"`
+}
+
+// wrongDigestImage 本机镜像与期望的 digest 不一致
+type wrongDigestImage struct {
+	Image          string   `json:"image"`
+	ExpectedDigest string   `json:"expectedDigest"`
+	ImageID        string   `json:"imageId"`
+	RepoDigests    []string `json:"repoDigests"`
+}
+
+// imageRecord 版本中单个镜像在本机的检查结果，Error 为检查失败（如无法连接容器运行时）的原因
+type imageRecord struct {
+	Image    string `json:"image"`
+	Present  bool   `json:"present"`
+	ImageID  string `json:"imageId,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	Created  string `json:"created,omitempty"`
+	Platform string `json:"platform,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// coreVersionStatus
+/**
+ * @Title: 单个版本的检查结果
+ * @Description:
+ *
+ *	记录在主机 configMap 的 versionStatus 中，key 为版本号
+ *	Images 为各镜像的检查结果，Error 为本次检查中出现的错误，无错误时为空
+ **/
+type coreVersionStatus struct {
+	Status              string               `json:"status"`
+	CheckTime           string               `json:"checkTime,omitempty"`
+	Images              []imageRecord        `json:"images,omitempty"`
+	MissingImages       []string             `json:"missingImages,omitempty"`
+	WrongDigestImages   []wrongDigestImage   `json:"wrongDigestImages,omitempty"`
+	WrongPlatformImages []wrongPlatformImage `json:"wrongPlatformImages,omitempty"`
+	Error               string               `json:"error,omitempty"`
+}
+
+// setVersionStatus
+/**
+ * @Title:  setVersionStatus
+ * @Description: 将各版本的检查结果写入主机 configMap
+ * wrongDigestVersions 为镜像存在但 digest 不一致的版本，wrongPlatformVersions 为镜像存在但无法在本机平台运行的版本
+ * versionStatus 为各版本状态的 json
+ **/
+func setVersionStatus(cm *v1.ConfigMap, versionStatus map[string]*coreVersionStatus) {
+	var wrongDigestVersions, wrongPlatformVersions []string
+	for versionName, status := range versionStatus {
+		switch status.Status {
+		case versionStatusWrongDigest:
+			wrongDigestVersions = append(wrongDigestVersions, versionName)
+		case versionStatusWrongPlatform:
+			wrongPlatformVersions = append(wrongPlatformVersions, versionName)
+		}
+	}
+	sort.Strings(wrongDigestVersions)
+	sort.Strings(wrongPlatformVersions)
+	cm.Data["wrongDigestVersions"] = strings.Join(wrongDigestVersions, ",")
+	cm.Data["wrongPlatformVersions"] = strings.Join(wrongPlatformVersions, ",")
+
+	statusJson, err := json.Marshal(versionStatus)
+	if err != nil {
+		klog.Errorf("%s failed to marshal version status. err:%v", logInfoTarget, err)
+		return
+	}
+	cm.Data["versionStatus"] = string(statusJson)
+}
+
+// formatExistingVersions
+/**
+ * @Title:  formatExistingVersions
+ * @Description: 主机 configMap 中 existingVersions 的值，去重、排序后以逗号分隔，全量检查与部份检查均使用
+ **/
+func formatExistingVersions(versions []string) string {
+	set := make(map[string]bool)
+	var names []string
+	for _, name := range versions {
+		if name != "" && !set[name] {
+			set[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
 // getExistingVersions
 /**
  * @Title:  getExistingVersions
  * @Description: 获取本主机上存在的 core version
+ * 版本配置了镜像期望的 digest 时，本机镜像的 RepoDigests 或 ID 须与之一致，否则记为 present but wrong digest，不计入可用版本
+ * 镜像的 os、architecture、variant 须能在本机运行，否则记为 present but wrong platform，不计入可用版本
+ * versionStatus 的 key 为版本号
  **/
-func getExistingVersions(coreVersions *v1.ConfigMapList) (existingVersions string) {
+func getExistingVersions(coreVersions *v1.ConfigMapList) (existingVersions []string, versionStatus map[string]*coreVersionStatus) {
+	versionStatus = make(map[string]*coreVersionStatus)
 	util.ClearImagesCache()
 	for _, coreVersion := range coreVersions.Items {
 		images, err := getAllImagesByVersionConfigMap(&coreVersion)
@@ -163,26 +294,28 @@ func getExistingVersions(coreVersions *v1.ConfigMapList) (existingVersions strin
 			continue
 		}
 
-		coreVersionIsExists := true
-		for _, image := range images {
-			if !util.ImageIsExists(image, logInfoTarget) {
-				klog.Infof("%s image[%s] does not exist on current host, configMap:%s", logInfoTarget, image, coreVersion.Name)
-				coreVersionIsExists = false
-				break
-			}
+		// get core version
+		versionName, _ := getCoreVersionNameByVersionConfigMap(&coreVersion)
+		if len(versionName) == 0 {
+			klog.Errorf("%s why this version name is empty? configMap.Name is: %s", logInfoTarget, coreVersion.Name)
+			continue
 		}
 
-		// 所有镜像存在时，汇总后更新到主机的 configMap 中
-		if coreVersionIsExists {
-			// get core version
-			versionName, _ := getCoreVersionNameByVersionConfigMap(&coreVersion)
-			if len(versionName) == 0 {
-				klog.Errorf("%s why this version name is empty? configMap.Name is: %s", logInfoTarget, coreVersion.Name)
-				continue
-			}
-			existingVersions += versionName + ","
+		status := checkCoreVersionImages(&coreVersion, images)
+		versionStatus[versionName] = status
+
+		// 所有镜像存在且 digest、平台一致时，汇总后更新到主机的 configMap 中
+		switch status.Status {
+		case versionStatusAvailable:
+			existingVersions = append(existingVersions, versionName)
 			klog.Infof("%s The version name %s exists on current host", logInfoTarget, versionName)
-		} else {
+		case versionStatusWrongDigest:
+			klog.Warningf("%s the version %s is present but wrong digest on current host, configMap.Name:%s, images:%+v",
+				logInfoTarget, versionName, coreVersion.Name, status.WrongDigestImages)
+		case versionStatusWrongPlatform:
+			klog.Warningf("%s the version %s is present but wrong platform on current host, configMap.Name:%s, images:%+v",
+				logInfoTarget, versionName, coreVersion.Name, status.WrongPlatformImages)
+		default:
 			klog.Infof("%s this version does not exist on current host, configMap.Name:%s", logInfoTarget, coreVersion.Name)
 		}
 	}
@@ -190,23 +323,67 @@ func getExistingVersions(coreVersions *v1.ConfigMapList) (existingVersions strin
 	return
 }
 
-// GetDaemonNodeIps
+// checkCoreVersionImages
 /**
- * @Title:  GetDaemonNodeIps
- * @Description: 获取 polarstack-daemon 布属的节点 ip 列表
+ * @Title:  checkCoreVersionImages
+ * @Description: 检查版本的所有镜像，任一镜像不存在时为 missing，均存在但有镜像无法在本机平台运行时为 present but wrong platform，
+ * 平台均一致但有镜像 digest 不一致时为 present but wrong digest
+ * MissingImages 记录所有不存在的镜像，检查失败的镜像按不存在处理，并记录错误
  **/
-func getPolarStackDaemonNodeIps(client *clientset.Clientset) (ips []string) {
-	polarStacks, err := client.CoreV1().Pods(NameSpace).List(metav1.ListOptions{LabelSelector: polarStackDaemonLabels})
-	if nil != err {
-		klog.Errorf("%s getPolarStackDaemonNodeIps failed err: %s", logInfoTarget, err)
-		return
-	}
-	for _, daemon := range polarStacks.Items {
-		if strings.ToLower(hostName) != strings.ToLower(daemon.Spec.NodeName) {
-			ips = append(ips, daemon.Status.PodIP)
-		} else {
-			klog.Infof("current host：[%s] not need to notify", daemon.Spec.NodeName)
+func checkCoreVersionImages(coreVersion *v1.ConfigMap, images []string) *coreVersionStatus {
+	digests := getImageDigestsByVersionConfigMap(coreVersion)
+	status := &coreVersionStatus{Status: versionStatusAvailable, CheckTime: time.Now().Format(timeFormat)}
+	var errs []string
+	sort.Strings(images)
+	for _, image := range images {
+		info, err := util.InspectImage(image, logInfoTarget)
+		record := imageRecord{Image: image}
+		if err != nil {
+			record.Error = err.Error()
+			errs = append(errs, fmt.Sprintf("%s: %v", image, err))
+		}
+		if info == nil {
+			klog.Infof("%s image[%s] does not exist on current host, configMap:%s", logInfoTarget, image, coreVersion.Name)
+			status.Images = append(status.Images, record)
+			status.MissingImages = append(status.MissingImages, image)
+			continue
+		}
+		record.Present = true
+		record.ImageID = info.ID
+		record.Size = info.Size
+		record.Created = info.Created
+		if !info.Platform.IsUnknown() {
+			record.Platform = info.Platform.String()
+		}
+		status.Images = append(status.Images, record)
+		rememberImageID(image, info.ID)
+		if err := util.CheckPlatform(info.Platform, hostPlatform); err != nil {
+			klog.Warningf("%s image[%s] platform %s can not run on host %s: %v, configMap:%s",
+				logInfoTarget, image, info.Platform, hostPlatform, err, coreVersion.Name)
+			status.WrongPlatformImages = append(status.WrongPlatformImages, wrongPlatformImage{
+				Image:        image,
+				Platform:     info.Platform.String(),
+				HostPlatform: hostPlatform.String(),
+				Reason:       err.Error(),
+			})
+		}
+		if digest, ok := digests[image]; ok && !info.MatchDigest(digest) {
+			klog.Warningf("%s image[%s] id:%s repoDigests:%v does not match expected digest %s, configMap:%s",
+				logInfoTarget, image, info.ID, info.RepoDigests, digest, coreVersion.Name)
+			status.Status = versionStatusWrongDigest
+			status.WrongDigestImages = append(status.WrongDigestImages, wrongDigestImage{
+				Image:          image,
+				ExpectedDigest: digest,
+				ImageID:        info.ID,
+				RepoDigests:    info.RepoDigests,
+			})
 		}
 	}
-	return
+	if len(status.MissingImages) > 0 {
+		status.Status = versionStatusMissing
+	} else if len(status.WrongPlatformImages) > 0 {
+		status.Status = versionStatusWrongPlatform
+	}
+	status.Error = strings.Join(errs, "; ")
+	return status
 }
@@ -41,7 +41,7 @@ func getAllCoreVersionConfigMapByLabels(client *clientset.Clientset, labels stri
  * @Title:  getAllImagesByVersionConfigMap
  * @Description: 从 core version 的 configMap 中获取所有镜像的信息
  * 此类 configMap 中的 Data 中 key 中包括 Image 关键字，以此为依据
- * 并剔除 image 为空的对象
+ * 并剔除 image 为空的对象及以 Digest 结尾的期望 digest
  **/
 func getAllImagesByVersionConfigMap(version *v1.ConfigMap) (images []string, err error) {
 	if nil == version {
@@ -53,13 +53,37 @@ func getAllImagesByVersionConfigMap(version *v1.ConfigMap) (images []string, err
 		return
 	}
 	for key, image := range version.Data {
-		if strings.Index(key, coreVersionImageKeyKeyWord) > 0 && len(image) > 0 {
+		if strings.Index(key, coreVersionImageKeyKeyWord) > 0 && len(image) > 0 &&
+			!strings.HasSuffix(key, coreVersionImageDigestKeySuffix) {
 			images = append(images, image)
 		}
 	}
 	return
 }
 
+// getImageDigestsByVersionConfigMap
+/**
+ * @Title:  getImageDigestsByVersionConfigMap
+ * @Description: 从 core version 的 configMap 中获取镜像期望的 digest，key 为镜像
+ * 镜像 Key 为 xxxImage 时，期望的 digest 记录在 xxxImageDigest 中，未配置的镜像不校验 digest
+ **/
+func getImageDigestsByVersionConfigMap(version *v1.ConfigMap) map[string]string {
+	digests := make(map[string]string)
+	if nil == version {
+		return digests
+	}
+	for key, image := range version.Data {
+		if strings.Index(key, coreVersionImageKeyKeyWord) <= 0 || len(image) == 0 ||
+			strings.HasSuffix(key, coreVersionImageDigestKeySuffix) {
+			continue
+		}
+		if digest := strings.TrimSpace(version.Data[key+coreVersionImageDigestKeySuffix]); len(digest) > 0 {
+			digests[image] = digest
+		}
+	}
+	return digests
+}
+
 // getCoreVersionNameByVersionConfigMap
 /**
  * @Title:  getCoreVersionNameByVersionConfigMap
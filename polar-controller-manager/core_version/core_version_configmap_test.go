@@ -0,0 +1,54 @@
+/*
+*Copyright (c) 2019-2021, Alibaba Group Holding Limited;
+*Licensed under the Apache License, Version 2.0 (the "License");
+*you may not use this file except in compliance with the License.
+*You may obtain a copy of the License at
+
+*   http://www.apache.org/licenses/LICENSE-2.0
+
+*Unless required by applicable law or agreed to in writing, software
+*distributed under the License is distributed on an "AS IS" BASIS,
+*WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*See the License for the specific language governing permissions and
+*limitations under the License.
+ */
+
+package core_version
+
+import (
+	"sort"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestGetImageDigestsByVersionConfigMap(t *testing.T) {
+	version := &v1.ConfigMap{Data: map[string]string{
+		"name":                "pg-1.1.1",
+		"engineImage":         "reg.local/polar/engine:1.1.1",
+		"engineImageDigest":   "sha256:1111",
+		"pfsdImage":           "reg.local/polar/pfsd:1.1.1",
+		"pfsdToolImage":       "reg.local/polar/pfsd-tool:1.1.1",
+		"pfsdToolImageDigest": " ",
+	}}
+
+	images, err := getAllImagesByVersionConfigMap(version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(images)
+	expected := []string{"reg.local/polar/engine:1.1.1", "reg.local/polar/pfsd-tool:1.1.1", "reg.local/polar/pfsd:1.1.1"}
+	if len(images) != len(expected) {
+		t.Fatalf("images got %v, expected %v", images, expected)
+	}
+	for i := range images {
+		if images[i] != expected[i] {
+			t.Errorf("images got %v, expected %v", images, expected)
+		}
+	}
+
+	digests := getImageDigestsByVersionConfigMap(version)
+	if len(digests) != 1 || digests["reg.local/polar/engine:1.1.1"] != "sha256:1111" {
+		t.Errorf("digests got %v, expected only engine image", digests)
+	}
+}
@@ -16,17 +16,24 @@
 package core_version
 
 import (
+	config "github.com/ApsaraDB/PolarDB-Stack-Daemon/cmd/daemon/app/config"
 	"github.com/ApsaraDB/PolarDB-Stack-Daemon/polar-controller-manager/bizapis/context"
+	"github.com/ApsaraDB/PolarDB-Stack-Daemon/polar-controller-manager/errors"
+	clientset "k8s.io/client-go/kubernetes"
 )
 
 // RequestCheckCoreVersion
 /**
  * @Title:  RequestCheckCoreVersion
- * @Description: 外部调用，通知 polar stack daemon 检查 core version，收到通知后将会通知其它 polarstack-daemon 节点
+ * @Description: 外部调用，通知 polar stack daemon 检查 core version，并并行通知其它 polarstack-daemon 节点，返回各节点的通知结果
  **/
 func RequestCheckCoreVersion(ctx *context.Context) {
-	CheckRequestQueue <- CheckCoreVersionOperatorType
-	ctx.ResSucData("done")
+	CheckRequestQueue <- SingleCheckCoreVersionOperatorType
+	var client *clientset.Clientset
+	if config.Conf != nil {
+		client = config.Conf.Client
+	}
+	ctx.ResSucData(notifyPeers(client))
 }
 
 // InnerCheckCoreVersion
@@ -40,3 +47,54 @@ func InnerCheckCoreVersion(ctx *context.Context) {
 	CheckRequestQueue <- SingleCheckCoreVersionOperatorType
 	ctx.ResSucData("OK")
 }
+
+// PrefetchCoreVersion
+/**
+ * @Title:  PrefetchCoreVersion
+ * @Description: 通过容器运行时在当前节点拉取指定版本的镜像，后台执行，进度及结果见主机 configMap 的 prefetch
+ **/
+func PrefetchCoreVersion(ctx *context.Context) {
+	var req PrefetchCoreVersionRequest
+	if err := ctx.GetContext().ShouldBindJSON(&req); err != nil {
+		ctx.ResErr(errors.NewValidatorError(err))
+		return
+	}
+	status, err := startPrefetchCoreVersion(config.Conf.Client, &req)
+	if err != nil {
+		ctx.Log.Errorf("%s failed to prefetch version %s, err:%v", logInfoTarget, req.Version, err)
+		ctx.ResErr(err)
+		return
+	}
+	ctx.ResSucData(status)
+}
+
+// GetCoreVersionMatrix
+/**
+ * @Title:  GetCoreVersionMatrix
+ * @Description: 查询所有节点的 core version 可用情况，version 可选，指定时只返回可用该版本的节点
+ **/
+func GetCoreVersionMatrix(ctx *context.Context) {
+	version := ctx.GetContext().Query("version")
+	matrix, err := getCoreVersionMatrix(config.Conf.Client, version)
+	if err != nil {
+		ctx.Log.Errorf("%s failed to get core version matrix, err:%v", logInfoTarget, err)
+		ctx.ResErr(err)
+		return
+	}
+	ctx.ResSucData(matrix)
+}
+
+// GetImageGCReport
+/**
+ * @Title:  GetImageGCReport
+ * @Description: 试运行本机的镜像回收，返回可回收及跳过的镜像，不删除镜像，未开启 --image-gc-enabled 时也可调用
+ **/
+func GetImageGCReport(ctx *context.Context) {
+	report, err := runImageGC(config.Conf.Client, true)
+	if err != nil {
+		ctx.Log.Errorf("%s failed to plan image gc, err:%v", logInfoTarget, err)
+		ctx.ResErr(err)
+		return
+	}
+	ctx.ResSucData(report)
+}
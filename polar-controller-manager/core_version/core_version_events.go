@@ -0,0 +1,234 @@
+/*
+*Copyright (c) 2019-2021, Alibaba Group Holding Limited;
+*Licensed under the Apache License, Version 2.0 (the "License");
+*you may not use this file except in compliance with the License.
+*You may obtain a copy of the License at
+
+*   http://www.apache.org/licenses/LICENSE-2.0
+
+*Unless required by applicable law or agreed to in writing, software
+*distributed under the License is distributed on an "AS IS" BASIS,
+*WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*See the License for the specific language governing permissions and
+*limitations under the License.
+ */
+
+package core_version
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ApsaraDB/PolarDB-Stack-Daemon/polar-controller-manager/util"
+	v1 "k8s.io/api/core/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+)
+
+// 镜像事件合并后再检查的等待时间，一次 pull 通常会产生多个事件
+const (
+	imageEventCheckDelay   = 2 * time.Second
+	imageEventCheckMaxWait = 10 * time.Second
+)
+
+// 监听镜像事件失败后的重试间隔
+const (
+	imageEventRetryMinInterval = 5 * time.Second
+	imageEventRetryMaxInterval = time.Minute
+)
+
+// 各版本镜像最近一次检查时的镜像 ID，用于将只带镜像 ID 的事件（如 docker rmi）对应到版本
+var (
+	knownImageIDsLock sync.RWMutex
+	knownImageIDs     = make(map[string]string)
+)
+
+func rememberImageID(image, id string) {
+	knownImageIDsLock.Lock()
+	defer knownImageIDsLock.Unlock()
+	knownImageIDs[image] = id
+}
+
+// imageEventWatcher 收集镜像事件涉及的镜像，合并后重新检查引用这些镜像的版本
+type imageEventWatcher struct {
+	client    *clientset.Clientset
+	mu        sync.Mutex
+	refs      map[string]bool
+	debouncer *checkDebouncer
+}
+
+// StartWatchImageEvents
+/**
+ * @Title:  StartWatchImageEvents
+ * @Description:
+ *
+ *	订阅本机容器运行时的镜像事件（docker 的 image 事件，containerd、CRI-O 定期比较镜像列表），
+ *	仅重新检查引用了变化镜像的版本，并更新主机 configMap 中这些版本的状态
+ **/
+func StartWatchImageEvents(client *clientset.Clientset, stopCh <-chan struct{}) {
+	setContainerRuntime(client)
+	w := &imageEventWatcher{client: client, refs: make(map[string]bool)}
+	w.debouncer = newCheckDebouncer(imageEventCheckDelay, imageEventCheckMaxWait, w.recheck)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stopCh
+		cancel()
+	}()
+
+	interval := imageEventRetryMinInterval
+	for {
+		start := time.Now()
+		err := w.watch(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		klog.Warningf("%s watch image events stopped, retry in %v. err:%v", logInfoTarget, interval, err)
+		// 监听中断期间可能错过镜像变化，检查所有版本
+		if time.Since(start) > imageEventRetryMinInterval {
+			requestLocalCheck()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+		if time.Since(start) > imageEventRetryMaxInterval {
+			interval = imageEventRetryMinInterval
+		} else if interval *= 2; interval > imageEventRetryMaxInterval {
+			interval = imageEventRetryMaxInterval
+		}
+	}
+}
+
+func (w *imageEventWatcher) watch(ctx context.Context) error {
+	store, err := util.NewImageStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	klog.Infof("%s start to watch image events of %s", logInfoTarget, store.Runtime())
+	return store.WatchImages(ctx, w.handle)
+}
+
+func (w *imageEventWatcher) handle(event util.ImageEvent) {
+	klog.Infof("%s image event %s %v", logInfoTarget, event.Action, event.Refs)
+	w.mu.Lock()
+	for _, ref := range event.Refs {
+		if ref != "" {
+			w.refs[util.NormalizeImageRef(ref)] = true
+		}
+	}
+	w.mu.Unlock()
+	w.debouncer.trigger()
+}
+
+func (w *imageEventWatcher) recheck() {
+	w.mu.Lock()
+	refs := w.refs
+	w.refs = make(map[string]bool)
+	w.mu.Unlock()
+	recheckVersionsByImages(w.client, refs)
+}
+
+// recheckVersionsByImages
+/**
+ * @Title:  recheckVersionsByImages
+ * @Description: 重新检查引用了 refs 中镜像的版本，refs 为规范化后的镜像名或镜像 ID
+ **/
+func recheckVersionsByImages(client *clientset.Clientset, refs map[string]bool) {
+	defer func() {
+		if err := recover(); err != nil {
+			klog.Errorf("%s recheckVersionsByImages failed: err:%v", logInfoTarget, err)
+		}
+	}()
+
+	coreVersions, err := getAllCoreVersionConfigMapByLabels(client, coreVersionConfigMapLabel)
+	if err != nil {
+		klog.Errorf("%s getAllCoreVersionConfigMapByLabels failed. err:%v", logInfoTarget, err)
+		return
+	}
+	affected := &v1.ConfigMapList{}
+	for _, coreVersion := range coreVersions.Items {
+		if versionReferencesImages(&coreVersion, refs) {
+			affected.Items = append(affected.Items, coreVersion)
+		}
+	}
+	if len(affected.Items) == 0 {
+		klog.Infof("%s no core version references the changed images", logInfoTarget)
+		return
+	}
+
+	_, versionStatus := getExistingVersions(affected)
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := getHostCoreVersionConfigMap(client)
+		if err != nil {
+			return err
+		}
+		mergeVersionStatus(cm, versionStatus)
+		_, err = updateHostCoreVersionConfigMap(client, cm)
+		return err
+	})
+	if err != nil {
+		klog.Errorf("%s failed to update host core version configMap after image events. err:%v", logInfoTarget, err)
+		return
+	}
+	klog.Infof("%s Success! rechecked %d versions after image events", logInfoTarget, len(versionStatus))
+}
+
+// versionReferencesImages 版本中的镜像名或其最近检查到的镜像 ID 是否在 refs 中
+func versionReferencesImages(coreVersion *v1.ConfigMap, refs map[string]bool) bool {
+	images, err := getAllImagesByVersionConfigMap(coreVersion)
+	if err != nil {
+		return false
+	}
+	knownImageIDsLock.RLock()
+	defer knownImageIDsLock.RUnlock()
+	for _, image := range images {
+		if refs[util.NormalizeImageRef(image)] {
+			return true
+		}
+		if id, ok := knownImageIDs[image]; ok && refs[id] {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeVersionStatus
+/**
+ * @Title:  mergeVersionStatus
+ * @Description: 将部份版本的检查结果合并到主机 configMap，其余版本保持不变
+ **/
+func mergeVersionStatus(cm *v1.ConfigMap, versionStatus map[string]*coreVersionStatus) {
+	var existing []string
+	for _, versionName := range strings.Split(cm.Data["existingVersions"], ",") {
+		if _, ok := versionStatus[versionName]; !ok && versionName != "" {
+			existing = append(existing, versionName)
+		}
+	}
+	for versionName, status := range versionStatus {
+		if status.Status == versionStatusAvailable {
+			existing = append(existing, versionName)
+		}
+	}
+	cm.Data["existingVersions"] = formatExistingVersions(existing)
+
+	merged := make(map[string]*coreVersionStatus)
+	if data := cm.Data["versionStatus"]; data != "" {
+		if err := json.Unmarshal([]byte(data), &merged); err != nil {
+			klog.Warningf("%s failed to parse versionStatus of %s, overwrite it. err:%v", logInfoTarget, cm.Name, err)
+			merged = make(map[string]*coreVersionStatus)
+		}
+	}
+	for versionName, status := range versionStatus {
+		merged[versionName] = status
+	}
+	setVersionStatus(cm, merged)
+	cm.Data["checkTime"] = time.Now().Format(timeFormat)
+}
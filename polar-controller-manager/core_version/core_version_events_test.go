@@ -0,0 +1,93 @@
+/*
+*Copyright (c) 2019-2021, Alibaba Group Holding Limited;
+*Licensed under the Apache License, Version 2.0 (the "License");
+*you may not use this file except in compliance with the License.
+*You may obtain a copy of the License at
+
+*   http://www.apache.org/licenses/LICENSE-2.0
+
+*Unless required by applicable law or agreed to in writing, software
+*distributed under the License is distributed on an "AS IS" BASIS,
+*WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*See the License for the specific language governing permissions and
+*limitations under the License.
+ */
+
+package core_version
+
+import (
+	"encoding/json"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestVersionReferencesImages(t *testing.T) {
+	version := &v1.ConfigMap{Data: map[string]string{
+		"name":        "pg-1.1.1",
+		"engineImage": "docker.io/polar/engine:1.1.1",
+		"pfsdImage":   "reg.local/polar/pfsd:1.1.1",
+	}}
+	rememberImageID("reg.local/polar/pfsd:1.1.1", "sha256:2222")
+
+	cases := []struct {
+		refs       []string
+		references bool
+	}{
+		{[]string{"polar/engine:1.1.1"}, true},
+		{[]string{"sha256:2222"}, true},
+		{[]string{"reg.local/polar/pfsd:1.1.2", "sha256:3333"}, false},
+	}
+	for _, c := range cases {
+		refs := make(map[string]bool)
+		for _, ref := range c.refs {
+			refs[ref] = true
+		}
+		if got := versionReferencesImages(version, refs); got != c.references {
+			t.Errorf("version references %v got %v, expected %v", c.refs, got, c.references)
+		}
+	}
+}
+
+func TestMergeVersionStatus(t *testing.T) {
+	cm := &v1.ConfigMap{Data: map[string]string{
+		"existingVersions": "pg-1.1.1,pg-1.1.2",
+		"versionStatus":    `{"pg-1.1.1":{"status":"available"},"pg-1.1.2":{"status":"available"},"pg-1.1.3":{"status":"missing"}}`,
+	}}
+	mergeVersionStatus(cm, map[string]*coreVersionStatus{
+		"pg-1.1.2": {Status: versionStatusMissing},
+		"pg-1.1.3": {Status: versionStatusAvailable},
+		"pg-1.1.4": {Status: versionStatusWrongPlatform},
+	})
+
+	if cm.Data["existingVersions"] != "pg-1.1.1,pg-1.1.3" {
+		t.Errorf("existingVersions got %q, expected pg-1.1.1,pg-1.1.3", cm.Data["existingVersions"])
+	}
+	status := make(map[string]*coreVersionStatus)
+	if err := json.Unmarshal([]byte(cm.Data["versionStatus"]), &status); err != nil {
+		t.Fatal(err)
+	}
+	if cm.Data["wrongPlatformVersions"] != "pg-1.1.4" {
+		t.Errorf("wrongPlatformVersions got %q, expected pg-1.1.4", cm.Data["wrongPlatformVersions"])
+	}
+	expected := map[string]string{"pg-1.1.1": versionStatusAvailable, "pg-1.1.2": versionStatusMissing, "pg-1.1.3": versionStatusAvailable,
+		"pg-1.1.4": versionStatusWrongPlatform}
+	for versionName, s := range expected {
+		if status[versionName] == nil || status[versionName].Status != s {
+			t.Errorf("version %s status got %+v, expected %s", versionName, status[versionName], s)
+		}
+	}
+	if cm.Data["checkTime"] == "" {
+		t.Errorf("checkTime is not updated")
+	}
+}
+
+func TestFormatExistingVersions(t *testing.T) {
+	// 全量检查与部份检查的结果格式一致：排序、去重，不带末尾的逗号
+	if got := formatExistingVersions([]string{"pg-1.1.3", "", "pg-1.1.1", "pg-1.1.3"}); got != "pg-1.1.1,pg-1.1.3" {
+		t.Errorf("formatExistingVersions got %q, expected pg-1.1.1,pg-1.1.3", got)
+	}
+	if got := formatExistingVersions(nil); got != "" {
+		t.Errorf("formatExistingVersions of nothing got %q", got)
+	}
+}
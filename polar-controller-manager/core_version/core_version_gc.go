@@ -0,0 +1,394 @@
+/*
+*Copyright (c) 2019-2021, Alibaba Group Holding Limited;
+*Licensed under the Apache License, Version 2.0 (the "License");
+*you may not use this file except in compliance with the License.
+*You may obtain a copy of the License at
+
+*   http://www.apache.org/licenses/LICENSE-2.0
+
+*Unless required by applicable law or agreed to in writing, software
+*distributed under the License is distributed on an "AS IS" BASIS,
+*WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*See the License for the specific language governing permissions and
+*limitations under the License.
+ */
+
+package core_version
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+
+	config "github.com/ApsaraDB/PolarDB-Stack-Daemon/cmd/daemon/app/config"
+	"github.com/ApsaraDB/PolarDB-Stack-Daemon/polar-controller-manager/util"
+	v1 "k8s.io/api/core/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+)
+
+// 镜像回收的原因及跳过的原因
+const (
+	imageGCReasonUnpublished     = "unpublished"      // 镜像仓库属于某个版本，但当前没有版本引用该镜像
+	imageGCReasonBeyondRetention = "beyond retention" // 仅被超出保留数量的旧版本引用
+
+	imageGCSkipRunning   = "used by running container"
+	imageGCSkipRetained  = "shared with retained version"   // 同一镜像 ID 还被保留的版本以其它名称引用
+	imageGCSkipUnmanaged = "tagged by unmanaged repository" // CRI 删除镜像时会一并删除其它仓库的名称
+)
+
+// 主机 configMap 中记录最近一次镜像回收结果的 key
+const imageGCStatusKey = "imageGC"
+
+// 单次回收的超时时间
+const imageGCTimeout = 10 * time.Minute
+
+// 各容器运行时的镜像数据目录，未指定 --image-gc-disk-path 时检查其所在文件系统的剩余空间
+var imageGCRuntimeDataDirs = map[string]string{
+	util.ContainerRuntimeDocker:     "/var/lib/docker",
+	util.ContainerRuntimeContainerd: "/var/lib/containerd",
+	util.ContainerRuntimeCrio:       "/var/lib/containers",
+}
+
+// 主机 /var/lib 在 daemon 中的挂载位置
+const imageGCHostRoot = "/host"
+
+// ImageGCCandidate 可回收的镜像，Refs 为将被删除的镜像名
+type ImageGCCandidate struct {
+	ImageID  string   `json:"imageId"`
+	Refs     []string `json:"refs"`
+	Size     int64    `json:"size"`
+	Reason   string   `json:"reason"`
+	Versions []string `json:"versions,omitempty"`
+}
+
+// ImageGCSkipped 属于版本但不回收的镜像
+type ImageGCSkipped struct {
+	ImageID string   `json:"imageId"`
+	Refs    []string `json:"refs"`
+	Reason  string   `json:"reason"`
+}
+
+// ImageGCReport
+/**
+ * @Title: 镜像回收的计划及结果
+ * @Description:
+ *
+ *	DryRun 时只列出可回收的镜像，不删除；Triggered 表示剩余空间低于阈值，非 DryRun 时才会删除
+ *	FreePercent 为 -1 表示未能获取剩余空间
+ **/
+type ImageGCReport struct {
+	Enabled          bool               `json:"enabled"`
+	DryRun           bool               `json:"dryRun"`
+	Runtime          string             `json:"runtime,omitempty"`
+	DiskPath         string             `json:"diskPath,omitempty"`
+	FreePercent      float64            `json:"freePercent"`
+	MinFreePercent   int32              `json:"minFreePercent"`
+	Triggered        bool               `json:"triggered"`
+	RetentionCount   int32              `json:"retentionCount"`
+	RetainedVersions []string           `json:"retainedVersions"`
+	Candidates       []ImageGCCandidate `json:"candidates"`
+	Skipped          []ImageGCSkipped   `json:"skipped,omitempty"`
+	ReclaimableBytes int64              `json:"reclaimableBytes"`
+	Removed          []string           `json:"removed,omitempty"`
+	Errors           []string           `json:"errors,omitempty"`
+	Time             string             `json:"time"`
+}
+
+// imageGCVersion 参与回收计算的版本及其镜像，Created 为版本 configMap 的创建时间
+type imageGCVersion struct {
+	Name    string
+	Created time.Time
+	Images  []string
+}
+
+// StartImageGC
+/**
+ * @Title:  StartImageGC
+ * @Description:
+ *
+ *	--image-gc-enabled 时按 --image-gc-interval 定期检查镜像所在磁盘的剩余空间，
+ *	低于 --image-gc-min-free-disk-percent 时删除已不再发布的版本及超出保留数量的旧版本的镜像，
+ *	运行中的容器使用的镜像不会被删除，结果记录在主机 configMap 的 imageGC 中
+ **/
+func StartImageGC(client *clientset.Clientset, stopCh <-chan struct{}) {
+	if !config.Conf.ImageGCEnabled {
+		klog.Infof("%s image gc is disabled", logInfoTarget)
+		return
+	}
+	setContainerRuntime(client)
+	interval := config.Conf.ImageGCInterval
+	if interval <= 0 {
+		interval = 10 * time.Minute
+	}
+	klog.Infof("%s image gc enabled, interval:%v retention:%d minFreeDiskPercent:%d", logInfoTarget,
+		interval, config.Conf.ImageGCRetentionCount, config.Conf.ImageGCMinFreeDiskPercent)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+		report, err := runImageGC(client, false)
+		if err != nil {
+			klog.Errorf("%s image gc failed. err:%v", logInfoTarget, err)
+			continue
+		}
+		if !report.Triggered {
+			continue
+		}
+		if err := updateImageGCStatus(client, report); err != nil {
+			klog.Errorf("%s failed to update image gc status. err:%v", logInfoTarget, err)
+		}
+		// 删除镜像后版本的可用性可能变化
+		if len(report.Removed) > 0 {
+			requestLocalCheck()
+		}
+	}
+}
+
+// runImageGC
+/**
+ * @Title:  runImageGC
+ * @Description:
+ *
+ *	计算本机可回收的镜像，dryRun 为 false 且剩余空间低于阈值时依次删除，单个镜像删除失败时继续删除其余镜像
+ **/
+func runImageGC(client *clientset.Clientset, dryRun bool) (report *ImageGCReport, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			report, err = nil, fmt.Errorf("%v", e)
+		}
+	}()
+
+	coreVersions, err := getAllCoreVersionConfigMapByLabels(client, coreVersionConfigMapLabel)
+	if err != nil {
+		return nil, err
+	}
+	setContainerRuntime(client)
+	store, err := util.NewImageStore()
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), imageGCTimeout)
+	defer cancel()
+	images, err := store.ListImages(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list images on %s: %v", store.Runtime(), err)
+	}
+	running, err := store.RunningContainerImages(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list running containers on %s: %v", store.Runtime(), err)
+	}
+
+	report = planImageGC(getImageGCVersions(coreVersions.Items), images, running, config.Conf.ImageGCRetentionCount,
+		store.Runtime() != util.ContainerRuntimeDocker)
+	report.Enabled = config.Conf.ImageGCEnabled
+	report.DryRun = dryRun
+	report.Runtime = store.Runtime()
+	report.MinFreePercent = config.Conf.ImageGCMinFreeDiskPercent
+	report.DiskPath = getImageGCDiskPath(store.Runtime())
+	report.FreePercent = -1
+	if usage, err := util.GetDiskUsage(report.DiskPath); err != nil {
+		report.Errors = append(report.Errors, err.Error())
+	} else {
+		report.FreePercent = usage.FreePercent()
+		report.Triggered = report.MinFreePercent <= 0 || report.FreePercent < float64(report.MinFreePercent)
+	}
+	if dryRun || !report.Triggered || len(report.Candidates) == 0 {
+		return report, nil
+	}
+
+	klog.Infof("%s disk %s free %.1f%% is below %d%%, remove %d images", logInfoTarget,
+		report.DiskPath, report.FreePercent, report.MinFreePercent, len(report.Candidates))
+	for _, candidate := range report.Candidates {
+		for _, ref := range candidate.Refs {
+			if err := store.RemoveImage(ctx, ref); err != nil {
+				klog.Errorf("%s failed to remove image %s (%s). err:%v", logInfoTarget, ref, candidate.Reason, err)
+				report.Errors = append(report.Errors, fmt.Sprintf("remove %s: %v", ref, err))
+				continue
+			}
+			klog.Infof("%s removed image %s (%s)", logInfoTarget, ref, candidate.Reason)
+			report.Removed = append(report.Removed, ref)
+		}
+	}
+	util.ClearImagesCache()
+	return report, nil
+}
+
+// getImageGCVersions 由版本 configMap 得到版本名、创建时间及镜像，没有版本名的 configMap 被忽略
+func getImageGCVersions(coreVersions []v1.ConfigMap) []imageGCVersion {
+	var versions []imageGCVersion
+	for i := range coreVersions {
+		name, _ := getCoreVersionNameByVersionConfigMap(&coreVersions[i])
+		if name == "" {
+			continue
+		}
+		images, _ := getAllImagesByVersionConfigMap(&coreVersions[i])
+		versions = append(versions, imageGCVersion{
+			Name:    name,
+			Created: coreVersions[i].CreationTimestamp.Time,
+			Images:  images,
+		})
+	}
+	return versions
+}
+
+// planImageGC
+/**
+ * @Title:  planImageGC
+ * @Description:
+ *
+ *	按版本 configMap 的创建时间保留最新的 retention 个版本（retention <= 0 时保留全部），其余版本的镜像可回收；
+ *	与版本镜像同一仓库、但没有版本引用的镜像视为已不再发布，也可回收；其它仓库的镜像不处理
+ *	运行中的容器使用的镜像，以及镜像 ID 与保留版本的镜像相同的镜像，不回收
+ *	removeAllTags 为 true（CRI 运行时删除镜像时会删除全部名称）时，还带有其它仓库名称的镜像也不回收
+ **/
+func planImageGC(versions []imageGCVersion, images []util.ImageInfo, running []string, retention int32,
+	removeAllTags bool) *ImageGCReport {
+	report := &ImageGCReport{
+		RetentionCount:   retention,
+		RetainedVersions: []string{},
+		Candidates:       []ImageGCCandidate{},
+		Time:             time.Now().Format(timeFormat),
+	}
+
+	sorted := append([]imageGCVersion(nil), versions...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if !sorted[i].Created.Equal(sorted[j].Created) {
+			return sorted[i].Created.After(sorted[j].Created)
+		}
+		return sorted[i].Name > sorted[j].Name
+	})
+
+	retained := make(map[string]bool)
+	refVersions := make(map[string][]string)
+	repositories := make(map[string]bool)
+	for i, version := range sorted {
+		keep := retention <= 0 || int32(i) < retention
+		if keep {
+			report.RetainedVersions = append(report.RetainedVersions, version.Name)
+		}
+		for _, image := range version.Images {
+			ref := util.NormalizeImageRef(image)
+			repositories[util.ImageRepository(ref)] = true
+			if keep {
+				retained[ref] = true
+			} else {
+				refVersions[ref] = append(refVersions[ref], version.Name)
+			}
+		}
+	}
+
+	inUse := make(map[string]bool)
+	for _, ref := range running {
+		if ref != "" {
+			inUse[util.NormalizeImageRef(ref)] = true
+		}
+	}
+
+	for _, image := range images {
+		candidate := ImageGCCandidate{ImageID: image.ID, Size: image.Size}
+		versionSet := make(map[string]bool)
+		managed, shared, unmanaged := false, false, false
+		for _, tag := range image.RepoTags {
+			ref := util.NormalizeImageRef(tag)
+			if !repositories[util.ImageRepository(ref)] {
+				unmanaged = true
+				continue
+			}
+			managed = true
+			if retained[ref] {
+				shared = true
+				continue
+			}
+			candidate.Refs = append(candidate.Refs, tag)
+			if names, ok := refVersions[ref]; ok {
+				for _, name := range names {
+					versionSet[name] = true
+				}
+			}
+		}
+		if !managed || len(candidate.Refs) == 0 {
+			continue
+		}
+
+		if imageInUse(image, inUse) {
+			report.Skipped = append(report.Skipped, ImageGCSkipped{ImageID: image.ID, Refs: candidate.Refs, Reason: imageGCSkipRunning})
+			continue
+		}
+		if shared {
+			report.Skipped = append(report.Skipped, ImageGCSkipped{ImageID: image.ID, Refs: candidate.Refs, Reason: imageGCSkipRetained})
+			continue
+		}
+		if unmanaged && removeAllTags {
+			report.Skipped = append(report.Skipped, ImageGCSkipped{ImageID: image.ID, Refs: candidate.Refs, Reason: imageGCSkipUnmanaged})
+			continue
+		}
+
+		candidate.Reason = imageGCReasonUnpublished
+		if len(versionSet) > 0 {
+			candidate.Reason = imageGCReasonBeyondRetention
+			for name := range versionSet {
+				candidate.Versions = append(candidate.Versions, name)
+			}
+			sort.Strings(candidate.Versions)
+		}
+		sort.Strings(candidate.Refs)
+		report.Candidates = append(report.Candidates, candidate)
+		report.ReclaimableBytes += candidate.Size
+	}
+	sort.Slice(report.Candidates, func(i, j int) bool {
+		return report.Candidates[i].Refs[0] < report.Candidates[j].Refs[0]
+	})
+	return report
+}
+
+// imageInUse 镜像 ID、任一镜像名或 digest 被运行中的容器使用
+func imageInUse(image util.ImageInfo, inUse map[string]bool) bool {
+	if inUse[image.ID] {
+		return true
+	}
+	for _, refs := range [][]string{image.RepoTags, image.RepoDigests} {
+		for _, ref := range refs {
+			if inUse[util.NormalizeImageRef(ref)] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// getImageGCDiskPath 检查剩余空间的目录，未指定时为运行时在主机上的镜像数据目录
+func getImageGCDiskPath(runtime string) string {
+	if config.Conf.ImageGCDiskPath != "" {
+		return config.Conf.ImageGCDiskPath
+	}
+	return filepath.Join(imageGCHostRoot, imageGCRuntimeDataDirs[runtime])
+}
+
+// updateImageGCStatus 将回收结果写入主机 configMap，仅修改 imageGC 一项
+func updateImageGCStatus(client *clientset.Clientset, report *ImageGCReport) error {
+	reportJson, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := getHostCoreVersionConfigMap(client)
+		if err != nil {
+			return err
+		}
+		cm.Data[imageGCStatusKey] = string(reportJson)
+		_, err = updateHostCoreVersionConfigMap(client, cm)
+		return err
+	})
+}
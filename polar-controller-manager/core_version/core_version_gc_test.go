@@ -0,0 +1,92 @@
+/*
+*Copyright (c) 2019-2021, Alibaba Group Holding Limited;
+*Licensed under the Apache License, Version 2.0 (the "License");
+*you may not use this file except in compliance with the License.
+*You may obtain a copy of the License at
+
+*   http://www.apache.org/licenses/LICENSE-2.0
+
+*Unless required by applicable law or agreed to in writing, software
+*distributed under the License is distributed on an "AS IS" BASIS,
+*WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*See the License for the specific language governing permissions and
+*limitations under the License.
+ */
+
+package core_version
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ApsaraDB/PolarDB-Stack-Daemon/polar-controller-manager/util"
+)
+
+func TestPlanImageGC(t *testing.T) {
+	now := time.Now()
+	versions := []imageGCVersion{
+		{Name: "pg-1.1.1", Created: now.Add(-3 * time.Hour), Images: []string{"reg.local/polar/engine:1.1.1", "reg.local/polar/pfsd:1.0"}},
+		{Name: "pg-1.1.2", Created: now.Add(-2 * time.Hour), Images: []string{"reg.local/polar/engine:1.1.2", "reg.local/polar/pfsd:1.0"}},
+		{Name: "pg-1.1.3", Created: now.Add(-time.Hour), Images: []string{"reg.local/polar/engine:1.1.3", "reg.local/polar/pfsd:1.1"}},
+	}
+	images := []util.ImageInfo{
+		{ID: "sha256:e1", RepoTags: []string{"reg.local/polar/engine:1.1.1"}, Size: 100},
+		{ID: "sha256:e2", RepoTags: []string{"reg.local/polar/engine:1.1.2"}, Size: 200},
+		{ID: "sha256:e3", RepoTags: []string{"reg.local/polar/engine:1.1.3"}, Size: 300},
+		// 已不再发布的版本
+		{ID: "sha256:e0", RepoTags: []string{"reg.local/polar/engine:1.1.0"}, Size: 50},
+		// 运行中的容器使用
+		{ID: "sha256:e9", RepoTags: []string{"reg.local/polar/engine:0.9"}, Size: 90},
+		// 与保留版本的镜像为同一镜像
+		{ID: "sha256:p1", RepoTags: []string{"reg.local/polar/pfsd:1.1", "reg.local/polar/pfsd:1.0-old"}, Size: 10},
+		{ID: "sha256:p0", RepoTags: []string{"reg.local/polar/pfsd:1.0"}, Size: 20},
+		// 其它仓库的镜像不处理
+		{ID: "sha256:n1", RepoTags: []string{"nginx:latest"}, Size: 1000},
+		// 同时带有其它仓库的名称
+		{ID: "sha256:m1", RepoTags: []string{"reg.local/polar/engine:1.0.9", "reg.local/backup/engine:1.0.9"}, Size: 40},
+	}
+	running := []string{"sha256:e9"}
+
+	report := planImageGC(versions, images, running, 2, false)
+	if !reflect.DeepEqual(report.RetainedVersions, []string{"pg-1.1.3", "pg-1.1.2"}) {
+		t.Errorf("retained versions got %v", report.RetainedVersions)
+	}
+	expected := []ImageGCCandidate{
+		{ImageID: "sha256:m1", Refs: []string{"reg.local/polar/engine:1.0.9"}, Size: 40, Reason: imageGCReasonUnpublished},
+		{ImageID: "sha256:e0", Refs: []string{"reg.local/polar/engine:1.1.0"}, Size: 50, Reason: imageGCReasonUnpublished},
+		{ImageID: "sha256:e1", Refs: []string{"reg.local/polar/engine:1.1.1"}, Size: 100, Reason: imageGCReasonBeyondRetention, Versions: []string{"pg-1.1.1"}},
+	}
+	if !reflect.DeepEqual(report.Candidates, expected) {
+		t.Errorf("candidates got %+v, expected %+v", report.Candidates, expected)
+	}
+	if report.ReclaimableBytes != 190 {
+		t.Errorf("reclaimable bytes got %d", report.ReclaimableBytes)
+	}
+	skipped := map[string]string{}
+	for _, s := range report.Skipped {
+		skipped[s.ImageID] = s.Reason
+	}
+	if !reflect.DeepEqual(skipped, map[string]string{"sha256:e9": imageGCSkipRunning, "sha256:p1": imageGCSkipRetained}) {
+		t.Errorf("skipped got %+v", report.Skipped)
+	}
+
+	// CRI 删除镜像会删除全部名称，带有其它仓库名称的镜像不回收
+	report = planImageGC(versions, images, running, 2, true)
+	if len(report.Candidates) != 2 || report.ReclaimableBytes != 150 {
+		t.Errorf("candidates with cri runtime got %+v", report.Candidates)
+	}
+	skipped = map[string]string{}
+	for _, s := range report.Skipped {
+		skipped[s.ImageID] = s.Reason
+	}
+	if skipped["sha256:m1"] != imageGCSkipUnmanaged {
+		t.Errorf("skipped with cri runtime got %+v", report.Skipped)
+	}
+
+	// retention <= 0 时只回收不再发布的镜像
+	report = planImageGC(versions, images[:len(images)-1], running, 0, false)
+	if len(report.Candidates) != 1 || report.Candidates[0].ImageID != "sha256:e0" {
+		t.Errorf("candidates with retention 0 got %+v", report.Candidates)
+	}
+}
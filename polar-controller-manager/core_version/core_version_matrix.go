@@ -0,0 +1,155 @@
+/*
+*Copyright (c) 2019-2021, Alibaba Group Holding Limited;
+*Licensed under the Apache License, Version 2.0 (the "License");
+*you may not use this file except in compliance with the License.
+*You may obtain a copy of the License at
+
+*   http://www.apache.org/licenses/LICENSE-2.0
+
+*Unless required by applicable law or agreed to in writing, software
+*distributed under the License is distributed on an "AS IS" BASIS,
+*WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*See the License for the specific language governing permissions and
+*limitations under the License.
+ */
+
+package core_version
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+// 主机 configMap 中未记录的版本，如版本发布后节点尚未检查
+const versionStatusUnknown = "unknown"
+
+// CoreVersionMatrix
+/**
+ * @Title: 版本 × 节点的可用情况
+ * @Description:
+ *
+ *	Versions 为所有已发布的版本及各节点记录中出现过的版本
+ *	Nodes 按节点名排列，Versions 的 key 为版本号，节点未记录的版本状态为 unknown
+ **/
+type CoreVersionMatrix struct {
+	Versions []string            `json:"versions"`
+	Nodes    []coreVersionNode   `json:"nodes"`
+	Matrix   map[string][]string `json:"matrix"` // 版本 -> 可用该版本的节点
+}
+
+type coreVersionNode struct {
+	Node      string                        `json:"node"`
+	CheckTime string                        `json:"checkTime"`
+	Versions  map[string]*coreVersionStatus `json:"versions"`
+}
+
+// getCoreVersionMatrix
+/**
+ * @Title:  getCoreVersionMatrix
+ * @Description: 读取所有节点的 availability configMap 生成版本矩阵，version 不为空时只返回可用该版本的节点
+ **/
+func getCoreVersionMatrix(client *clientset.Clientset, version string) (*CoreVersionMatrix, error) {
+	coreVersions, err := getAllCoreVersionConfigMapByLabels(client, coreVersionConfigMapLabel)
+	if err != nil {
+		return nil, err
+	}
+	var versionNames []string
+	for i := range coreVersions.Items {
+		if name, _ := getCoreVersionNameByVersionConfigMap(&coreVersions.Items[i]); name != "" {
+			versionNames = append(versionNames, name)
+		}
+	}
+
+	cms, err := client.CoreV1().ConfigMaps(NameSpace).List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var availability []v1.ConfigMap
+	for _, cm := range cms.Items {
+		if strings.HasPrefix(cm.Name, coreVersionAvailabilityConfigPrefix()) {
+			availability = append(availability, cm)
+		}
+	}
+	return buildCoreVersionMatrix(versionNames, availability, version), nil
+}
+
+// coreVersionAvailabilityConfigPrefix 主机 configMap 名称中节点名之前的部份
+func coreVersionAvailabilityConfigPrefix() string {
+	return strings.TrimSuffix(coreVersionAvailabilityConfigName, "%s")
+}
+
+// buildCoreVersionMatrix
+/**
+ * @Title:  buildCoreVersionMatrix
+ * @Description:
+ *
+ *	优先使用主机 configMap 中的 versionStatus，没有时（旧版本 daemon 写入）根据 existingVersions 得到可用版本
+ **/
+func buildCoreVersionMatrix(versionNames []string, availability []v1.ConfigMap, version string) *CoreVersionMatrix {
+	versionSet := make(map[string]bool)
+	for _, name := range versionNames {
+		versionSet[name] = true
+	}
+
+	var allNodes []coreVersionNode
+	for _, cm := range availability {
+		node := coreVersionNode{
+			Node:      strings.TrimPrefix(cm.Name, coreVersionAvailabilityConfigPrefix()),
+			CheckTime: cm.Data["checkTime"],
+			Versions:  make(map[string]*coreVersionStatus),
+		}
+		if data := cm.Data["versionStatus"]; data != "" {
+			if err := json.Unmarshal([]byte(data), &node.Versions); err != nil {
+				klog.Warningf("%s failed to parse versionStatus of %s. err:%v", logInfoTarget, cm.Name, err)
+			}
+		}
+		for _, name := range strings.Split(cm.Data["existingVersions"], ",") {
+			if _, ok := node.Versions[name]; !ok && name != "" {
+				node.Versions[name] = &coreVersionStatus{Status: versionStatusAvailable}
+			}
+		}
+		for name := range node.Versions {
+			versionSet[name] = true
+		}
+		allNodes = append(allNodes, node)
+	}
+
+	matrix := &CoreVersionMatrix{Versions: []string{}, Nodes: []coreVersionNode{}, Matrix: make(map[string][]string)}
+
+	for name := range versionSet {
+		if version == "" || name == version {
+			matrix.Versions = append(matrix.Versions, name)
+		}
+	}
+	sort.Strings(matrix.Versions)
+
+	for _, node := range allNodes {
+		for _, name := range matrix.Versions {
+			if _, ok := node.Versions[name]; !ok {
+				node.Versions[name] = &coreVersionStatus{Status: versionStatusUnknown}
+			}
+			if node.Versions[name].Status == versionStatusAvailable {
+				matrix.Matrix[name] = append(matrix.Matrix[name], node.Node)
+			}
+		}
+		if version != "" {
+			status := node.Versions[version]
+			if status == nil || status.Status != versionStatusAvailable {
+				continue
+			}
+			node.Versions = map[string]*coreVersionStatus{version: status}
+		}
+		matrix.Nodes = append(matrix.Nodes, node)
+	}
+	sort.Slice(matrix.Nodes, func(i, j int) bool { return matrix.Nodes[i].Node < matrix.Nodes[j].Node })
+	for name := range matrix.Matrix {
+		sort.Strings(matrix.Matrix[name])
+	}
+	return matrix
+}
@@ -0,0 +1,68 @@
+/*
+*Copyright (c) 2019-2021, Alibaba Group Holding Limited;
+*Licensed under the Apache License, Version 2.0 (the "License");
+*you may not use this file except in compliance with the License.
+*You may obtain a copy of the License at
+
+*   http://www.apache.org/licenses/LICENSE-2.0
+
+*Unless required by applicable law or agreed to in writing, software
+*distributed under the License is distributed on an "AS IS" BASIS,
+*WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*See the License for the specific language governing permissions and
+*limitations under the License.
+ */
+
+package core_version
+
+import (
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestBuildCoreVersionMatrix(t *testing.T) {
+	availability := []v1.ConfigMap{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "polarstack-daemon-version-availability-node2"},
+			Data: map[string]string{
+				"existingVersions": "pg-1.1.1",
+				"checkTime":        "2021-09-01T08:00:00Z",
+				"versionStatus":    `{"pg-1.1.1":{"status":"available"},"pg-1.1.2":{"status":"missing","images":[{"image":"reg.local/polar/engine:1.1.2","present":false,"error":"timeout"}],"missingImages":["reg.local/polar/engine:1.1.2"]}}`,
+			},
+		},
+		{
+			// 旧版本 daemon 只记录 existingVersions
+			ObjectMeta: metav1.ObjectMeta{Name: "polarstack-daemon-version-availability-node1"},
+			Data:       map[string]string{"existingVersions": "pg-1.1.1,pg-1.1.2", "checkTime": "2021-09-01T08:00:01Z"},
+		},
+	}
+
+	matrix := buildCoreVersionMatrix([]string{"pg-1.1.3", "pg-1.1.1"}, availability, "")
+	if !reflect.DeepEqual(matrix.Versions, []string{"pg-1.1.1", "pg-1.1.2", "pg-1.1.3"}) {
+		t.Errorf("versions got %v", matrix.Versions)
+	}
+	if len(matrix.Nodes) != 2 || matrix.Nodes[0].Node != "node1" || matrix.Nodes[1].Node != "node2" {
+		t.Fatalf("nodes got %+v", matrix.Nodes)
+	}
+	node2 := matrix.Nodes[1]
+	if node2.CheckTime != "2021-09-01T08:00:00Z" ||
+		node2.Versions["pg-1.1.2"].Status != versionStatusMissing ||
+		!reflect.DeepEqual(node2.Versions["pg-1.1.2"].MissingImages, []string{"reg.local/polar/engine:1.1.2"}) ||
+		len(node2.Versions["pg-1.1.2"].Images) != 1 || node2.Versions["pg-1.1.2"].Images[0].Error != "timeout" ||
+		node2.Versions["pg-1.1.3"].Status != versionStatusUnknown {
+		t.Errorf("node2 got %+v", node2)
+	}
+	expected := map[string][]string{"pg-1.1.1": {"node1", "node2"}, "pg-1.1.2": {"node1"}}
+	if !reflect.DeepEqual(matrix.Matrix, expected) {
+		t.Errorf("matrix got %v, expected %v", matrix.Matrix, expected)
+	}
+
+	matrix = buildCoreVersionMatrix([]string{"pg-1.1.3", "pg-1.1.1"}, availability, "pg-1.1.2")
+	if !reflect.DeepEqual(matrix.Versions, []string{"pg-1.1.2"}) || len(matrix.Nodes) != 1 ||
+		matrix.Nodes[0].Node != "node1" || len(matrix.Nodes[0].Versions) != 1 {
+		t.Errorf("filtered matrix got %+v", matrix)
+	}
+}
@@ -0,0 +1,226 @@
+/*
+*Copyright (c) 2019-2021, Alibaba Group Holding Limited;
+*Licensed under the Apache License, Version 2.0 (the "License");
+*you may not use this file except in compliance with the License.
+*You may obtain a copy of the License at
+
+*   http://www.apache.org/licenses/LICENSE-2.0
+
+*Unless required by applicable law or agreed to in writing, software
+*distributed under the License is distributed on an "AS IS" BASIS,
+*WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*See the License for the specific language governing permissions and
+*limitations under the License.
+ */
+
+package core_version
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	config "github.com/ApsaraDB/PolarDB-Stack-Daemon/cmd/daemon/app/config"
+	"github.com/ApsaraDB/PolarDB-Stack-Daemon/polar-controller-manager/util"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+// PathInnerCheckCoreVersion 内部检查通知的路由，位于 util.PathPrefix 下
+const PathInnerCheckCoreVersion = "InnerCheckCoreVersion"
+
+// 通知其它节点的超时与重试
+const (
+	notifyPeerTimeout     = 3 * time.Second
+	notifyPeerAttempts    = 3
+	notifyPeerMinInterval = 500 * time.Millisecond
+)
+
+// peerNotifyResult 通知单个节点的结果
+type peerNotifyResult struct {
+	Node       string `json:"node"`
+	IP         string `json:"ip"`
+	Success    bool   `json:"success"`
+	StatusCode int    `json:"statusCode,omitempty"`
+	Attempts   int    `json:"attempts"`
+	Error      string `json:"error,omitempty"`
+}
+
+// RequestCheckCoreVersionResult RequestCheckCoreVersion 的返回，Peers 按节点名排列
+type RequestCheckCoreVersionResult struct {
+	Node      string             `json:"node"`
+	Peers     []peerNotifyResult `json:"peers"`
+	Succeeded int                `json:"succeeded"`
+	Failed    int                `json:"failed"`
+}
+
+// peerNotifier 通知其它节点使用的地址及 http client
+type peerNotifier struct {
+	scheme string
+	port   int32
+	client *util.HttpClient
+}
+
+// newPeerNotifier
+/**
+ * @Title:  newPeerNotifier
+ * @Description:
+ *
+ *	本节点开启了双向 TLS（证书、私钥及 --peer-ca-file 均已配置）时，以 https 访问其它节点的 --secure-port，
+ *	以 --peer-ca-file 校验对方证书，同时以本节点的证书作为客户端证书；同一 daemonset 的各节点配置一致
+ *	未开启时只有 --allow-insecure-peer-notify 才以 http 访问 --port，否则不通知其它节点
+ **/
+func newPeerNotifier() (*peerNotifier, error) {
+	notifier := &peerNotifier{
+		scheme: "http",
+		port:   config.Conf.Port,
+		client: &util.HttpClient{Timeout: notifyPeerTimeout},
+	}
+	if !PeerTLSConfigured() {
+		if config.Conf.AllowInsecurePeerNotify {
+			return notifier, nil
+		}
+		return nil, fmt.Errorf("mutual tls is not configured (tls cert, key and peer ca files) and --allow-insecure-peer-notify is false")
+	}
+	tlsConfig, err := util.NewTLSClientConfig(config.Conf.PeerCAFile, config.Conf.PeerTLSServerName,
+		config.Conf.TLSCertFile, config.Conf.TLSPrivateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	notifier.scheme = "https"
+	notifier.port = config.Conf.SecurePort
+	notifier.client.TLSConfig = tlsConfig
+	return notifier, nil
+}
+
+// PeerTLSConfigured 节点间通知是否使用双向 TLS：证书、私钥文件存在且指定了 --peer-ca-file
+func PeerTLSConfigured() bool {
+	return util.TLSFilesExist(config.Conf.TLSCertFile, config.Conf.TLSPrivateKeyFile) && config.Conf.PeerCAFile != ""
+}
+
+// notifyPeers
+/**
+ * @Title:  notifyPeers
+ * @Description: 并行通知其它 polarstack-daemon 节点检查 core version，返回各节点的结果
+ **/
+func notifyPeers(client *clientset.Clientset) *RequestCheckCoreVersionResult {
+	result := &RequestCheckCoreVersionResult{Node: hostName, Peers: []peerNotifyResult{}}
+	if client == nil {
+		klog.Warningf("%s kube client is not initialized, skip notifying other nodes", logInfoTarget)
+		return result
+	}
+	peers, err := getPolarStackDaemonPeers(client)
+	if err != nil {
+		klog.Errorf("%s getPolarStackDaemonPeers failed err: %v", logInfoTarget, err)
+		return result
+	}
+	notifier, err := newPeerNotifier()
+	if err != nil {
+		klog.Errorf("%s failed to create peer notifier. err:%v", logInfoTarget, err)
+		for _, peer := range peers {
+			result.Peers = append(result.Peers, peerNotifyResult{Node: peer.Spec.NodeName, IP: peer.Status.PodIP, Error: err.Error()})
+		}
+		result.Failed = len(peers)
+		return result
+	}
+
+	results := make([]peerNotifyResult, len(peers))
+	var wg sync.WaitGroup
+	for i := range peers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = notifier.notify(peers[i].Spec.NodeName, peers[i].Status.PodIP)
+		}(i)
+	}
+	wg.Wait()
+
+	sort.Slice(results, func(i, j int) bool { return results[i].Node < results[j].Node })
+	for _, r := range results {
+		if r.Success {
+			result.Succeeded++
+		} else {
+			result.Failed++
+		}
+	}
+	result.Peers = results
+	return result
+}
+
+// notify 通知单个节点，失败时按 notifyPeerMinInterval 起倍增的间隔重试
+func (n *peerNotifier) notify(node string, ip string) peerNotifyResult {
+	result := peerNotifyResult{Node: node, IP: ip}
+	if ip == "" {
+		result.Error = "pod ip is empty"
+		return result
+	}
+	type source struct {
+		HostName string
+	}
+	path := util.PathPrefix + "/" + PathInnerCheckCoreVersion
+	client := *n.client
+	client.Host = fmt.Sprintf("%s://%s:%d", n.scheme, ip, n.port)
+
+	interval := notifyPeerMinInterval
+	for result.Attempts < notifyPeerAttempts {
+		if result.Attempts > 0 {
+			time.Sleep(interval)
+			interval *= 2
+		}
+		result.Attempts++
+
+		var resp *http.Response
+		var err error
+		if n.scheme == "https" {
+			resp, err = client.HttpsPost(path, map[string]string{}, &source{HostName: hostName})
+		} else {
+			resp, err = client.Post(path, map[string]string{}, &source{HostName: hostName})
+		}
+		if err != nil {
+			result.Error = err.Error()
+			klog.Warningf("%s failed to notify node:%s ip:%s attempt:%d, err:%v", logInfoTarget, node, ip, result.Attempts, err)
+			continue
+		}
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+		result.StatusCode = resp.StatusCode
+		if resp.StatusCode == http.StatusOK {
+			result.Success = true
+			result.Error = ""
+			klog.Infof("%s success! node:%s ip:%s url:%s%s", logInfoTarget, node, ip, client.Host, path)
+			return result
+		}
+		result.Error = fmt.Sprintf("unexpected status code %d", resp.StatusCode)
+		klog.Warningf("%s failed to notify node:%s ip:%s attempt:%d, status code:%d", logInfoTarget, node, ip, result.Attempts, resp.StatusCode)
+	}
+	return result
+}
+
+// getPolarStackDaemonPeers
+/**
+ * @Title:  getPolarStackDaemonPeers
+ * @Description: 获取本节点以外的 polarstack-daemon pod
+ **/
+func getPolarStackDaemonPeers(client *clientset.Clientset) ([]v1.Pod, error) {
+	polarStacks, err := client.CoreV1().Pods(NameSpace).List(metav1.ListOptions{LabelSelector: polarStackDaemonLabels})
+	if err != nil {
+		return nil, err
+	}
+	var peers []v1.Pod
+	for _, daemon := range polarStacks.Items {
+		if strings.ToLower(hostName) == strings.ToLower(daemon.Spec.NodeName) ||
+			(config.Conf.CurrentNodeName != "" && config.Conf.CurrentNodeName == daemon.Spec.NodeName) {
+			klog.Infof("current host：[%s] not need to notify", daemon.Spec.NodeName)
+			continue
+		}
+		peers = append(peers, daemon)
+	}
+	return peers, nil
+}
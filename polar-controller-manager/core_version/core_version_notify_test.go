@@ -0,0 +1,83 @@
+/*
+*Copyright (c) 2019-2021, Alibaba Group Holding Limited;
+*Licensed under the Apache License, Version 2.0 (the "License");
+*you may not use this file except in compliance with the License.
+*You may obtain a copy of the License at
+
+*   http://www.apache.org/licenses/LICENSE-2.0
+
+*Unless required by applicable law or agreed to in writing, software
+*distributed under the License is distributed on an "AS IS" BASIS,
+*WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*See the License for the specific language governing permissions and
+*limitations under the License.
+ */
+
+package core_version
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	config "github.com/ApsaraDB/PolarDB-Stack-Daemon/cmd/daemon/app/config"
+	"github.com/ApsaraDB/PolarDB-Stack-Daemon/polar-controller-manager/util"
+)
+
+func TestPeerNotifierNotify(t *testing.T) {
+	var requests int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/InnerCheckCoreVersion" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		// 第一次请求失败，重试后成功
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	host, portStr, _ := net.SplitHostPort(server.Listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+
+	notifier := &peerNotifier{
+		scheme: "https",
+		port:   int32(port),
+		client: &util.HttpClient{Timeout: notifyPeerTimeout, TLSConfig: &tls.Config{RootCAs: pool, ServerName: "example.com"}},
+	}
+	result := notifier.notify("node1", host)
+	if !result.Success || result.Attempts != 2 || result.StatusCode != http.StatusOK || result.Error != "" {
+		t.Errorf("notify got %+v, expected success after 2 attempts", result)
+	}
+
+	// 证书不受信任时失败
+	notifier.client = &util.HttpClient{Timeout: notifyPeerTimeout, TLSConfig: &tls.Config{ServerName: "example.com"}}
+	result = notifier.notify("node1", host)
+	if result.Success || result.Attempts != notifyPeerAttempts || result.Error == "" {
+		t.Errorf("notify with untrusted certificate got %+v, expected failure", result)
+	}
+}
+
+func TestNewPeerNotifierRequiresTLS(t *testing.T) {
+	defer func(conf *config.CompletedConfig) { config.Conf = conf }(config.Conf)
+	config.Conf = (&config.Config{Port: 8900, SecurePort: 8901, TLSCertFile: "/not/exist.crt", TLSPrivateKeyFile: "/not/exist.key"}).Complete()
+	if _, err := newPeerNotifier(); err == nil {
+		t.Errorf("expected failure without mutual tls and --allow-insecure-peer-notify")
+	}
+
+	config.Conf.AllowInsecurePeerNotify = true
+	notifier, err := newPeerNotifier()
+	if err != nil || notifier.scheme != "http" || notifier.port != 8900 {
+		t.Errorf("expected http notifier with --allow-insecure-peer-notify, got %+v, err:%v", notifier, err)
+	}
+}
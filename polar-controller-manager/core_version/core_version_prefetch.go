@@ -0,0 +1,252 @@
+/*
+*Copyright (c) 2019-2021, Alibaba Group Holding Limited;
+*Licensed under the Apache License, Version 2.0 (the "License");
+*you may not use this file except in compliance with the License.
+*You may obtain a copy of the License at
+
+*   http://www.apache.org/licenses/LICENSE-2.0
+
+*Unless required by applicable law or agreed to in writing, software
+*distributed under the License is distributed on an "AS IS" BASIS,
+*WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*See the License for the specific language governing permissions and
+*limitations under the License.
+ */
+
+package core_version
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	config "github.com/ApsaraDB/PolarDB-Stack-Daemon/cmd/daemon/app/config"
+	"github.com/ApsaraDB/PolarDB-Stack-Daemon/polar-controller-manager/util"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+)
+
+// 预拉取镜像的策略
+const (
+	prefetchPullIfNotPresent = "IfNotPresent" // 仅拉取本机不存在的镜像
+	prefetchPullAlways       = "Always"       // 拉取版本中的所有镜像，用于更新被重新打 tag 的镜像
+)
+
+// 预拉取及单个镜像的状态
+const (
+	prefetchStatusRunning   = "running"
+	prefetchStatusSucceeded = "succeeded"
+	prefetchStatusFailed    = "failed"
+
+	prefetchImagePending = "pending"
+	prefetchImagePulling = "pulling"
+	prefetchImagePresent = "present" // 本机已存在，未拉取
+	prefetchImagePulled  = "pulled"
+	prefetchImageFailed  = "failed"
+)
+
+// 单个镜像拉取的超时时间
+const prefetchPullTimeout = 30 * time.Minute
+
+// 主机 configMap 中记录预拉取进度的 key
+const prefetchStatusKey = "prefetch"
+
+// PrefetchCoreVersionRequest 预拉取请求，PullPolicy 为空时为 --prefetch-pull-policy（默认 IfNotPresent）
+type PrefetchCoreVersionRequest struct {
+	Version    string `json:"version" binding:"required"`
+	PullPolicy string `json:"pullPolicy"`
+}
+
+type prefetchImageStatus struct {
+	Image  string `json:"image"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// prefetchStatus
+/**
+ * @Title: 预拉取的进度及结果
+ * @Description:
+ *
+ *	记录在主机 configMap 的 prefetch 中，每个镜像处理完后更新，Done 为已处理的镜像数
+ **/
+type prefetchStatus struct {
+	Version    string                `json:"version"`
+	PullPolicy string                `json:"pullPolicy"`
+	Status     string                `json:"status"`
+	StartTime  string                `json:"startTime"`
+	EndTime    string                `json:"endTime,omitempty"`
+	Total      int                   `json:"total"`
+	Done       int                   `json:"done"`
+	Images     []prefetchImageStatus `json:"images"`
+	Error      string                `json:"error,omitempty"`
+}
+
+// 同一时刻只进行一个预拉取
+var (
+	prefetchLock    sync.Mutex
+	prefetchRunning bool
+)
+
+// startPrefetchCoreVersion
+/**
+ * @Title:  startPrefetchCoreVersion
+ * @Description:
+ *
+ *	校验请求并在后台拉取版本中的镜像，已有预拉取进行中时返回错误
+ *	拉取完成后触发一次本机的 core version 检查
+ **/
+func startPrefetchCoreVersion(client *clientset.Clientset, req *PrefetchCoreVersionRequest) (*prefetchStatus, error) {
+	if req.PullPolicy == "" && config.Conf != nil {
+		req.PullPolicy = config.Conf.PrefetchPullPolicy
+	}
+	if req.PullPolicy == "" {
+		req.PullPolicy = prefetchPullIfNotPresent
+	}
+	if req.PullPolicy != prefetchPullIfNotPresent && req.PullPolicy != prefetchPullAlways {
+		return nil, fmt.Errorf("invalid pullPolicy %q, it should be %s or %s", req.PullPolicy, prefetchPullIfNotPresent, prefetchPullAlways)
+	}
+
+	images, err := getImagesByVersionName(client, req.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	prefetchLock.Lock()
+	if prefetchRunning {
+		prefetchLock.Unlock()
+		return nil, fmt.Errorf("another prefetch is running, please retry later")
+	}
+	prefetchRunning = true
+	prefetchLock.Unlock()
+
+	status := &prefetchStatus{
+		Version:    req.Version,
+		PullPolicy: req.PullPolicy,
+		Status:     prefetchStatusRunning,
+		StartTime:  time.Now().Format(timeFormat),
+		Total:      len(images),
+	}
+	for _, image := range images {
+		status.Images = append(status.Images, prefetchImageStatus{Image: image, Status: prefetchImagePending})
+	}
+	if err := updatePrefetchStatus(client, status); err != nil {
+		klog.Errorf("%s failed to update prefetch status of version %s. err:%v", logInfoTarget, req.Version, err)
+	}
+
+	result := *status
+	result.Images = append([]prefetchImageStatus(nil), status.Images...)
+	go func() {
+		defer func() {
+			prefetchLock.Lock()
+			prefetchRunning = false
+			prefetchLock.Unlock()
+		}()
+		prefetchCoreVersion(client, status)
+	}()
+	return &result, nil
+}
+
+// prefetchImageExists 不使用检测缓存确认镜像是否存在，缓存中的结果可能已被镜像回收或手工删除镜像所改变
+func prefetchImageExists(image string) bool {
+	info, err := util.InspectImageNoCache(image, logInfoTarget)
+	return err == nil && info != nil
+}
+
+// prefetchCoreVersion 依次拉取镜像，单个镜像失败时继续拉取其余镜像，最终状态为 failed
+func prefetchCoreVersion(client *clientset.Clientset, status *prefetchStatus) {
+	defer func() {
+		if err := recover(); err != nil {
+			klog.Errorf("%s prefetch version %s failed: err:%v", logInfoTarget, status.Version, err)
+			status.Status = prefetchStatusFailed
+			status.Error = fmt.Sprintf("%v", err)
+			status.EndTime = time.Now().Format(timeFormat)
+			_ = updatePrefetchStatus(client, status)
+		}
+	}()
+
+	failed := 0
+	for i := range status.Images {
+		image := &status.Images[i]
+		if status.PullPolicy == prefetchPullIfNotPresent && prefetchImageExists(image.Image) {
+			image.Status = prefetchImagePresent
+		} else {
+			image.Status = prefetchImagePulling
+			if err := updatePrefetchStatus(client, status); err != nil {
+				klog.Warningf("%s failed to update prefetch status of version %s. err:%v", logInfoTarget, status.Version, err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), prefetchPullTimeout)
+			err := util.PullImage(ctx, image.Image, logInfoTarget)
+			cancel()
+			if err != nil {
+				klog.Errorf("%s failed to pull image %s of version %s. err:%v", logInfoTarget, image.Image, status.Version, err)
+				image.Status = prefetchImageFailed
+				image.Error = err.Error()
+				failed++
+			} else {
+				image.Status = prefetchImagePulled
+			}
+		}
+		status.Done++
+		if err := updatePrefetchStatus(client, status); err != nil {
+			klog.Warningf("%s failed to update prefetch status of version %s. err:%v", logInfoTarget, status.Version, err)
+		}
+	}
+
+	status.Status = prefetchStatusSucceeded
+	if failed > 0 {
+		status.Status = prefetchStatusFailed
+		status.Error = fmt.Sprintf("%d of %d images failed to pull", failed, status.Total)
+	}
+	status.EndTime = time.Now().Format(timeFormat)
+	if err := updatePrefetchStatus(client, status); err != nil {
+		klog.Errorf("%s failed to update prefetch status of version %s. err:%v", logInfoTarget, status.Version, err)
+	}
+	klog.Infof("%s prefetch version %s done, status:%s", logInfoTarget, status.Version, status.Status)
+
+	// 拉取后重新检查本机的版本
+	requestLocalCheck()
+}
+
+// getImagesByVersionName 按版本号查找 core version configMap 并返回其中的镜像
+func getImagesByVersionName(client *clientset.Clientset, versionName string) ([]string, error) {
+	coreVersions, err := getAllCoreVersionConfigMapByLabels(client, coreVersionConfigMapLabel)
+	if err != nil {
+		return nil, err
+	}
+	for i := range coreVersions.Items {
+		name, _ := getCoreVersionNameByVersionConfigMap(&coreVersions.Items[i])
+		if name != versionName {
+			continue
+		}
+		images, err := getAllImagesByVersionConfigMap(&coreVersions.Items[i])
+		if err != nil {
+			return nil, err
+		}
+		if len(images) == 0 {
+			return nil, fmt.Errorf("version %s has no image in configMap %s", versionName, coreVersions.Items[i].Name)
+		}
+		return images, nil
+	}
+	return nil, fmt.Errorf("version %s not found in core version configMaps with labels %s", versionName, coreVersionConfigMapLabel)
+}
+
+// updatePrefetchStatus 将预拉取进度写入主机 configMap，仅修改 prefetch 一项
+func updatePrefetchStatus(client *clientset.Clientset, status *prefetchStatus) error {
+	statusJson, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := getHostCoreVersionConfigMap(client)
+		if err != nil {
+			return err
+		}
+		cm.Data[prefetchStatusKey] = string(statusJson)
+		_, err = updateHostCoreVersionConfigMap(client, cm)
+		return err
+	})
+}
@@ -0,0 +1,145 @@
+/*
+*Copyright (c) 2019-2021, Alibaba Group Holding Limited;
+*Licensed under the Apache License, Version 2.0 (the "License");
+*you may not use this file except in compliance with the License.
+*You may obtain a copy of the License at
+
+*   http://www.apache.org/licenses/LICENSE-2.0
+
+*Unless required by applicable law or agreed to in writing, software
+*distributed under the License is distributed on an "AS IS" BASIS,
+*WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*See the License for the specific language governing permissions and
+*limitations under the License.
+ */
+
+package core_version
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	config "github.com/ApsaraDB/PolarDB-Stack-Daemon/cmd/daemon/app/config"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+)
+
+// core version configMap 变化后，等待该时长内无新的变化再检查，连续变化时最长等待 maxWait
+const (
+	coreVersionCheckDelay   = 5 * time.Second
+	coreVersionCheckMaxWait = 30 * time.Second
+)
+
+// checkDebouncer
+/**
+ * @Title: 合并短时间内的多次检查请求
+ * @Description:
+ *
+ *	每次 trigger 后等待 delay，期间再次 trigger 则重新计时，但距首次 trigger 不超过 maxWait，到期后执行一次 fn
+ **/
+type checkDebouncer struct {
+	mu      sync.Mutex
+	delay   time.Duration
+	maxWait time.Duration
+	fn      func()
+	timer   *time.Timer
+	first   time.Time
+}
+
+func newCheckDebouncer(delay, maxWait time.Duration, fn func()) *checkDebouncer {
+	return &checkDebouncer{delay: delay, maxWait: maxWait, fn: fn}
+}
+
+func (d *checkDebouncer) trigger() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	if d.timer == nil {
+		d.first = now
+		d.timer = time.AfterFunc(d.delay, d.fire)
+		return
+	}
+	delay := d.delay
+	if remain := d.first.Add(d.maxWait).Sub(now); remain < delay {
+		delay = remain
+	}
+	// 计时器已到期时 fire 正在等待锁，由其执行，这里无需重新计时
+	if d.timer.Stop() {
+		d.timer.Reset(delay)
+	}
+}
+
+func (d *checkDebouncer) fire() {
+	d.mu.Lock()
+	d.timer = nil
+	d.mu.Unlock()
+	d.fn()
+}
+
+// StartWatchCoreVersion
+/**
+ * @Title:  StartWatchCoreVersion
+ * @Description:
+ *
+ *	监听 core version configMap（CoreVersionConfigMapLabel），新增、修改、删除后合并触发一次本机检查
+ *	启动前已存在的 configMap 由启动时的检查覆盖，不再触发
+ **/
+func StartWatchCoreVersion(client *clientset.Clientset, stopCh <-chan struct{}) {
+	labels := config.Conf.CoreVersionConfigMapLabel
+	// creationTimestamp 精确到秒
+	startTime := metav1.NewTime(time.Now().Truncate(time.Second))
+	debouncer := newCheckDebouncer(coreVersionCheckDelay, coreVersionCheckMaxWait, requestLocalCheck)
+
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 0,
+		informers.WithNamespace(NameSpace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = labels
+		}))
+	informer := factory.Core().V1().ConfigMaps().Informer()
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			cm, ok := obj.(*v1.ConfigMap)
+			if !ok || cm.CreationTimestamp.Before(&startTime) {
+				return
+			}
+			klog.Infof("%s core version configMap %s added, check later", logInfoTarget, cm.Name)
+			debouncer.trigger()
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldCm, ok1 := oldObj.(*v1.ConfigMap)
+			newCm, ok2 := newObj.(*v1.ConfigMap)
+			if !ok1 || !ok2 || reflect.DeepEqual(oldCm.Data, newCm.Data) {
+				return
+			}
+			klog.Infof("%s core version configMap %s updated, check later", logInfoTarget, newCm.Name)
+			debouncer.trigger()
+		},
+		DeleteFunc: func(obj interface{}) {
+			name := ""
+			if cm, ok := obj.(*v1.ConfigMap); ok {
+				name = cm.Name
+			} else if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				name = tombstone.Key
+			}
+			klog.Infof("%s core version configMap %s deleted, check later", logInfoTarget, name)
+			debouncer.trigger()
+		},
+	})
+
+	klog.Infof("%s start to watch core version configMaps with labels %s", logInfoTarget, labels)
+	factory.Start(stopCh)
+}
+
+// requestLocalCheck 请求检查本机，队列已满时已有检查待执行，无需再加入
+func requestLocalCheck() {
+	select {
+	case CheckRequestQueue <- SingleCheckCoreVersionOperatorType:
+	default:
+		klog.Infof("%s check request queue is full, a check is already pending", logInfoTarget)
+	}
+}
@@ -0,0 +1,48 @@
+/*
+*Copyright (c) 2019-2021, Alibaba Group Holding Limited;
+*Licensed under the Apache License, Version 2.0 (the "License");
+*you may not use this file except in compliance with the License.
+*You may obtain a copy of the License at
+
+*   http://www.apache.org/licenses/LICENSE-2.0
+
+*Unless required by applicable law or agreed to in writing, software
+*distributed under the License is distributed on an "AS IS" BASIS,
+*WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*See the License for the specific language governing permissions and
+*limitations under the License.
+ */
+
+package core_version
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCheckDebouncer(t *testing.T) {
+	var count int32
+	d := newCheckDebouncer(50*time.Millisecond, 200*time.Millisecond, func() { atomic.AddInt32(&count, 1) })
+
+	// 一批变化只检查一次
+	for i := 0; i < 5; i++ {
+		d.trigger()
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if c := atomic.LoadInt32(&count); c != 1 {
+		t.Fatalf("burst triggered %d checks, expected 1", c)
+	}
+
+	// 持续变化时不超过 maxWait
+	start := time.Now()
+	for time.Since(start) < 350*time.Millisecond {
+		d.trigger()
+		time.Sleep(20 * time.Millisecond)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if c := atomic.LoadInt32(&count); c < 2 || c > 4 {
+		t.Errorf("continuous triggers got %d checks, expected 2 to 4", c)
+	}
+}
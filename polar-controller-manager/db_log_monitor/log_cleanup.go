@@ -0,0 +1,217 @@
+/*
+*Copyright (c) 2019-2021, Alibaba Group Holding Limited;
+*Licensed under the Apache License, Version 2.0 (the "License");
+*you may not use this file except in compliance with the License.
+*You may obtain a copy of the License at
+
+*   http://www.apache.org/licenses/LICENSE-2.0
+
+*Unless required by applicable law or agreed to in writing, software
+*distributed under the License is distributed on an "AS IS" BASIS,
+*WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*See the License for the specific language governing permissions and
+*limitations under the License.
+ */
+
+package db_log_monitor
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// 日志目录中的文件名规则，与 find -name 相同
+const (
+	logFilePattern        = "*.log"
+	postgresqlLogPattern  = "postgresql*.log"
+	removedInsDataPattern = "rm_data_*"
+)
+
+// cleanupError 单个文件或目录处理失败的原因
+type cleanupError struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// logDirScan
+/**
+ * @Title: 日志目录的扫描结果
+ * @Description:
+ *
+ *	Instances 为根目录下的实例目录，value 表示其中是否有 overdueDays 天内修改过的 *.log
+ *	OverdueLogs 为超过 overdueDays 天未修改的 postgresql*.log，RemovedInsData 为超过 overdueDays 天未修改的 rm_data_* 目录
+ *	Logs 为所有 postgresql*.log，供按磁盘水位清理使用
+ *	Errors 为扫描中无法读取的文件或目录，不影响其余部份的扫描
+ **/
+type logDirScan struct {
+	Root           string
+	Instances      map[string]bool
+	OverdueLogs    []string
+	RemovedInsData []string
+	Logs           []logFile
+	Errors         []cleanupError
+}
+
+// logFile 实例的一个 postgresql*.log
+type logFile struct {
+	Path    string
+	InsId   string
+	Size    int64
+	ModTime time.Time
+}
+
+// resolveLogRoot 返回日志根目录解析符号链接后的绝对路径，拒绝 / 等无法安全删除其下内容的目录
+func resolveLogRoot(dir string) (string, error) {
+	if strings.TrimSpace(dir) == "" {
+		return "", fmt.Errorf("log dir is empty")
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	root, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return "", err
+	}
+	if root == string(filepath.Separator) {
+		return "", fmt.Errorf("log dir %s resolves to /", dir)
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("log dir %s is not a directory", dir)
+	}
+	return root, nil
+}
+
+// modifiedDays 文件修改至今的整天数，与 find -mtime 的计算方式相同
+func modifiedDays(info os.FileInfo, now time.Time) int64 {
+	return int64(now.Sub(info.ModTime()) / (24 * time.Hour))
+}
+
+// scanLogDir
+/**
+ * @Title:  scanLogDir
+ * @Description:
+ *
+ *	遍历日志根目录，不跟随符号链接：根目录下的符号链接按实例目录处理，删除时只删除链接本身，
+ *	其它位置的符号链接被忽略；超期的判断与 find -mtime +overdueDays 相同，未超期与 -mtime -overdueDays 相同
+ **/
+func scanLogDir(root string, overdueDays int32, now time.Time) *logDirScan {
+	scan := &logDirScan{Root: root, Instances: make(map[string]bool)}
+	days := int64(overdueDays)
+	_ = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			scan.Errors = append(scan.Errors, cleanupError{Path: path, Error: err.Error()})
+			if info != nil && info.IsDir() && path != root {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if path == root {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return nil
+		}
+		parts := strings.SplitN(rel, string(filepath.Separator), 2)
+		insId := parts[0]
+		if len(parts) == 1 && (info.IsDir() || info.Mode()&os.ModeSymlink != 0) {
+			if _, ok := scan.Instances[insId]; !ok {
+				scan.Instances[insId] = false
+			}
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+
+		name := info.Name()
+		if info.IsDir() {
+			if matched, _ := filepath.Match(removedInsDataPattern, name); matched && modifiedDays(info, now) > days {
+				scan.RemovedInsData = append(scan.RemovedInsData, path)
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if matched, _ := filepath.Match(logFilePattern, name); matched && modifiedDays(info, now) < days {
+			if _, ok := scan.Instances[insId]; ok {
+				scan.Instances[insId] = true
+			}
+		}
+		if matched, _ := filepath.Match(postgresqlLogPattern, name); matched {
+			scan.Logs = append(scan.Logs, logFile{Path: path, InsId: insId, Size: info.Size(), ModTime: info.ModTime()})
+			if modifiedDays(info, now) > days {
+				scan.OverdueLogs = append(scan.OverdueLogs, path)
+			}
+		}
+		return nil
+	})
+	return scan
+}
+
+// checkUnderRoot 路径及其所在目录（解析符号链接后）须在根目录之下，且不能是根目录本身
+func checkUnderRoot(root, path string) error {
+	clean := filepath.Clean(path)
+	rel, err := filepath.Rel(root, clean)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%s is not under %s", path, root)
+	}
+	parent, err := filepath.EvalSymlinks(filepath.Dir(clean))
+	if err != nil {
+		return err
+	}
+	if parent != root && !strings.HasPrefix(parent, root+string(filepath.Separator)) {
+		return fmt.Errorf("%s resolves to %s which is not under %s", path, parent, root)
+	}
+	return nil
+}
+
+// removeUnderRoot
+/**
+ * @Title:  removeUnderRoot
+ * @Description:
+ *
+ *	删除根目录下的文件或目录，删除前检查路径不会离开根目录；符号链接只删除链接本身，不删除其指向的内容
+ *	已不存在的路径视为删除成功
+ **/
+func removeUnderRoot(root, path string) error {
+	if err := checkUnderRoot(root, path); err != nil {
+		return err
+	}
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		err = os.RemoveAll(path)
+	} else {
+		err = os.Remove(path)
+	}
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// removeAllUnderRoot 依次删除，单个路径失败时继续删除其余路径，返回已删除的路径及失败的原因
+func removeAllUnderRoot(root string, paths []string) (removed []string, errs []cleanupError) {
+	for _, path := range paths {
+		if err := removeUnderRoot(root, path); err != nil {
+			errs = append(errs, cleanupError{Path: path, Error: err.Error()})
+			continue
+		}
+		removed = append(removed, path)
+	}
+	return
+}
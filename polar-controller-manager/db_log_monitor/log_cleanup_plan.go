@@ -0,0 +1,226 @@
+/*
+*Copyright (c) 2019-2021, Alibaba Group Holding Limited;
+*Licensed under the Apache License, Version 2.0 (the "License");
+*you may not use this file except in compliance with the License.
+*You may obtain a copy of the License at
+
+*   http://www.apache.org/licenses/LICENSE-2.0
+
+*Unless required by applicable law or agreed to in writing, software
+*distributed under the License is distributed on an "AS IS" BASIS,
+*WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*See the License for the specific language governing permissions and
+*limitations under the License.
+ */
+
+package db_log_monitor
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	config "github.com/ApsaraDB/PolarDB-Stack-Daemon/cmd/daemon/app/config"
+	"k8s.io/klog"
+)
+
+const timeFormat = "2006-01-02T15:04:05Z07:00"
+
+// LogCleanupItem 将被删除的文件或目录，Size 为其中所有文件的大小，符号链接只计链接本身
+type LogCleanupItem struct {
+	Path    string `json:"path"`
+	InsId   string `json:"insId"`
+	Size    int64  `json:"size"`
+	ModTime string `json:"modTime"`
+}
+
+// LogCleanupPlan
+/**
+ * @Title: 按时间清理数据库日志的计划
+ * @Description:
+ *
+ *	OrphanFolders 为没有对应实例 pod 且 overdueDays 天内没有日志写入的实例目录，
+ *	OverdueLogs、RemovedInsData 为其余实例目录中超期的 postgresql*.log 及 rm_data_* 目录，
+ *	位于 OrphanFolders 中的文件随目录一起删除，不再单独列出；TotalBytes 为所有项的大小之和
+ **/
+type LogCleanupPlan struct {
+	Node           string           `json:"node"`
+	Root           string           `json:"root"`
+	OverdueDays    int32            `json:"overdueDays"`
+	DryRun         bool             `json:"dryRun"`
+	OrphanFolders  []LogCleanupItem `json:"orphanFolders"`
+	OverdueLogs    []LogCleanupItem `json:"overdueLogs"`
+	RemovedInsData []LogCleanupItem `json:"removedInsData"`
+	TotalBytes     int64            `json:"totalBytes"`
+	Errors         []cleanupError   `json:"errors,omitempty"`
+	Time           string           `json:"time"`
+}
+
+// --log-cleanup-dry-run 时最近一次按时间清理生成的计划
+var (
+	lastPlanLock sync.RWMutex
+	lastPlan     *LogCleanupPlan
+)
+
+// planLogCleanup
+/**
+ * @Title:  planLogCleanup
+ * @Description:
+ *
+ *	扫描日志目录，生成下一次按时间清理将删除的内容；获取不到实例 pod 时不清理，返回错误
+ **/
+func planLogCleanup() (*LogCleanupPlan, error) {
+	podInsIdList := getInsIdListFromPod()
+	if podInsIdList == nil {
+		return nil, fmt.Errorf("no instance pod found by label apsara.metric.ins_id, skip log cleanup")
+	}
+	klog.Infof("get insId from pods [%v]", podInsIdList)
+	root, err := resolveLogRoot(config.Conf.DbclusterLogDir)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dbcluster log dir %s, err: %v", config.Conf.DbclusterLogDir, err)
+	}
+	now := time.Now()
+	scan := scanLogDir(root, config.Conf.InsFolderOverdueDays, now)
+	logCleanupErrors("scan", scan.Errors)
+	klog.Infof("get insId from nodes [%v]", scan.Instances)
+
+	plan := buildLogCleanupPlan(scan, podInsIdList)
+	plan.Node = config.Conf.CurrentNodeName
+	plan.OverdueDays = config.Conf.InsFolderOverdueDays
+	plan.DryRun = config.Conf.LogCleanupDryRun
+	plan.Time = now.Format(timeFormat)
+	return plan, nil
+}
+
+// buildLogCleanupPlan 由扫描结果及本机实例 pod 的 insId 生成计划，并计算各项的大小
+func buildLogCleanupPlan(scan *logDirScan, podInsIdList []string) *LogCleanupPlan {
+	plan := &LogCleanupPlan{
+		Root:           scan.Root,
+		OrphanFolders:  []LogCleanupItem{},
+		OverdueLogs:    []LogCleanupItem{},
+		RemovedInsData: []LogCleanupItem{},
+		Errors:         scan.Errors,
+	}
+	podInsIds := make(map[string]bool)
+	for _, insId := range podInsIdList {
+		podInsIds[insId] = true
+	}
+	orphan := make(map[string]bool)
+	for insId, notOverdue := range scan.Instances {
+		if podInsIds[insId] || notOverdue {
+			continue
+		}
+		orphan[insId] = true
+		plan.OrphanFolders = append(plan.OrphanFolders, plan.newItem(filepath.Join(scan.Root, insId), insId))
+	}
+
+	for _, path := range scan.OverdueLogs {
+		if insId := insIdOf(scan.Root, path); !orphan[insId] {
+			plan.OverdueLogs = append(plan.OverdueLogs, plan.newItem(path, insId))
+		}
+	}
+	for _, path := range scan.RemovedInsData {
+		if insId := insIdOf(scan.Root, path); !orphan[insId] {
+			plan.RemovedInsData = append(plan.RemovedInsData, plan.newItem(path, insId))
+		}
+	}
+	for _, items := range [][]LogCleanupItem{plan.OrphanFolders, plan.OverdueLogs, plan.RemovedInsData} {
+		sort.Slice(items, func(i, j int) bool { return items[i].Path < items[j].Path })
+		for _, item := range items {
+			plan.TotalBytes += item.Size
+		}
+	}
+	return plan
+}
+
+func (plan *LogCleanupPlan) newItem(path, insId string) LogCleanupItem {
+	item := LogCleanupItem{Path: path, InsId: insId}
+	info, err := os.Lstat(path)
+	if err != nil {
+		plan.Errors = append(plan.Errors, cleanupError{Path: path, Error: err.Error()})
+		return item
+	}
+	item.ModTime = info.ModTime().Format(timeFormat)
+	item.Size = pathSize(path, info)
+	return item
+}
+
+// insIdOf 路径在根目录下的第一级目录名
+func insIdOf(root, path string) string {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return ""
+	}
+	return strings.SplitN(rel, string(filepath.Separator), 2)[0]
+}
+
+// pathSize 文件或目录中所有文件的大小，不跟随符号链接，无法读取的部份不计入
+func pathSize(path string, info os.FileInfo) int64 {
+	if !info.IsDir() {
+		return info.Size()
+	}
+	var size int64
+	_ = filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// executeLogCleanupPlan 依次删除计划中的实例目录、超期日志及 rm_data_* 目录
+func executeLogCleanupPlan(plan *LogCleanupPlan) {
+	removedFolders := deleteInsFolder(plan.Root, itemInsIds(plan.OrphanFolders))
+	klog.Infof("instance folder %s %v on %s have been deleted", plan.Root, removedFolders, plan.Node)
+	removedLogs := deleteInsLogs(plan.Root, itemPaths(plan.OverdueLogs))
+	removedData := deleteRemovedInsData(plan.Root, itemPaths(plan.RemovedInsData))
+	klog.Infof("overdue logs %v and data %v in %s on %s have been deleted", removedLogs, removedData, plan.Root, plan.Node)
+}
+
+// publishLogCleanupPlan 记录日志并保存计划，供 GET LogCleanupPlan?last=true 查询
+func publishLogCleanupPlan(plan *LogCleanupPlan) {
+	for _, group := range []struct {
+		name  string
+		items []LogCleanupItem
+	}{
+		{"instance folder", plan.OrphanFolders},
+		{"overdue log", plan.OverdueLogs},
+		{"removed instance data", plan.RemovedInsData},
+	} {
+		for _, item := range group.items {
+			klog.Infof("[dry run] would delete %s %s, size: %d", group.name, item.Path, item.Size)
+		}
+	}
+	klog.Infof("[dry run] would delete %d instance folders, %d logs, %d removed instance data, %d bytes in total",
+		len(plan.OrphanFolders), len(plan.OverdueLogs), len(plan.RemovedInsData), plan.TotalBytes)
+	lastPlanLock.Lock()
+	lastPlan = plan
+	lastPlanLock.Unlock()
+}
+
+func getLastLogCleanupPlan() *LogCleanupPlan {
+	lastPlanLock.RLock()
+	defer lastPlanLock.RUnlock()
+	return lastPlan
+}
+
+func itemPaths(items []LogCleanupItem) []string {
+	var paths []string
+	for _, item := range items {
+		paths = append(paths, item.Path)
+	}
+	return paths
+}
+
+func itemInsIds(items []LogCleanupItem) []string {
+	var insIds []string
+	for _, item := range items {
+		insIds = append(insIds, item.InsId)
+	}
+	return insIds
+}
@@ -0,0 +1,73 @@
+/*
+*Copyright (c) 2019-2021, Alibaba Group Holding Limited;
+*Licensed under the Apache License, Version 2.0 (the "License");
+*you may not use this file except in compliance with the License.
+*You may obtain a copy of the License at
+
+*   http://www.apache.org/licenses/LICENSE-2.0
+
+*Unless required by applicable law or agreed to in writing, software
+*distributed under the License is distributed on an "AS IS" BASIS,
+*WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*See the License for the specific language governing permissions and
+*limitations under the License.
+ */
+
+package db_log_monitor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBuildLogCleanupPlan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dbcluster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root, err := resolveLogRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	old := now.Add(-10 * 24 * time.Hour)
+	// ins1 有 pod，ins2 没有 pod 且没有近期日志，ins3 没有 pod 但有近期日志
+	writeLogFile(t, filepath.Join(root, "ins1", "log", "postgresql-1.log"), old)
+	writeLogFile(t, filepath.Join(root, "ins1", "rm_data_1", "base", "1"), old)
+	if err := os.Chtimes(filepath.Join(root, "ins1", "rm_data_1"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	writeLogFile(t, filepath.Join(root, "ins2", "log", "postgresql-1.log"), old)
+	writeLogFile(t, filepath.Join(root, "ins2", "log", "postgresql-2.log"), old)
+	writeLogFile(t, filepath.Join(root, "ins3", "log", "postgresql-1.log"), now)
+
+	plan := buildLogCleanupPlan(scanLogDir(root, 7, now), []string{"ins1"})
+	if len(plan.OrphanFolders) != 1 || plan.OrphanFolders[0].InsId != "ins2" || plan.OrphanFolders[0].Size != 6 {
+		t.Errorf("orphan folders got %+v", plan.OrphanFolders)
+	}
+	// ins2 中的日志随目录删除，不单独列出
+	if len(plan.OverdueLogs) != 1 || plan.OverdueLogs[0].Path != filepath.Join(root, "ins1", "log", "postgresql-1.log") || plan.OverdueLogs[0].Size != 3 {
+		t.Errorf("overdue logs got %+v", plan.OverdueLogs)
+	}
+	if len(plan.RemovedInsData) != 1 || plan.RemovedInsData[0].InsId != "ins1" || plan.RemovedInsData[0].Size != 3 {
+		t.Errorf("removed instance data got %+v", plan.RemovedInsData)
+	}
+	if plan.TotalBytes != 12 {
+		t.Errorf("total bytes got %d", plan.TotalBytes)
+	}
+
+	executeLogCleanupPlan(plan)
+	for _, path := range []string{filepath.Join(root, "ins2"), filepath.Join(root, "ins1", "log", "postgresql-1.log"), filepath.Join(root, "ins1", "rm_data_1")} {
+		if _, err := os.Lstat(path); !os.IsNotExist(err) {
+			t.Errorf("%s should be deleted, err: %v", path, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "ins3", "log", "postgresql-1.log")); err != nil {
+		t.Errorf("recent log should be kept, err: %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+/*
+*Copyright (c) 2019-2021, Alibaba Group Holding Limited;
+*Licensed under the Apache License, Version 2.0 (the "License");
+*you may not use this file except in compliance with the License.
+*You may obtain a copy of the License at
+
+*   http://www.apache.org/licenses/LICENSE-2.0
+
+*Unless required by applicable law or agreed to in writing, software
+*distributed under the License is distributed on an "AS IS" BASIS,
+*WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*See the License for the specific language governing permissions and
+*limitations under the License.
+ */
+
+package db_log_monitor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func writeLogFile(t *testing.T, path string, modTime time.Time) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte("log"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScanLogDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dbcluster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root, err := resolveLogRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outside, err := ioutil.TempDir("", "outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+
+	now := time.Now()
+	old := now.Add(-10 * 24 * time.Hour)
+	writeLogFile(t, filepath.Join(root, "ins1", "log", "postgresql-1.log"), old)
+	writeLogFile(t, filepath.Join(root, "ins1", "log", "postgresql-2.log"), now)
+	writeLogFile(t, filepath.Join(root, "ins2", "log", "postgresql-1.log"), old)
+	writeLogFile(t, filepath.Join(root, "ins2", "rm_data_1", "data.log"), old)
+	if err := os.Chtimes(filepath.Join(root, "ins2", "rm_data_1"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	// 指向根目录之外的符号链接不应被跟随
+	writeLogFile(t, filepath.Join(outside, "postgresql-1.log"), old)
+	if err := os.Symlink(outside, filepath.Join(root, "ins3")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "ins1", "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	scan := scanLogDir(root, 7, now)
+	if !reflect.DeepEqual(scan.Instances, map[string]bool{"ins1": true, "ins2": false, "ins3": false}) {
+		t.Errorf("instances got %v", scan.Instances)
+	}
+	sort.Strings(scan.OverdueLogs)
+	expectedLogs := []string{filepath.Join(root, "ins1", "log", "postgresql-1.log"), filepath.Join(root, "ins2", "log", "postgresql-1.log")}
+	if !reflect.DeepEqual(scan.OverdueLogs, expectedLogs) {
+		t.Errorf("overdue logs got %v, expected %v", scan.OverdueLogs, expectedLogs)
+	}
+	if !reflect.DeepEqual(scan.RemovedInsData, []string{filepath.Join(root, "ins2", "rm_data_1")}) {
+		t.Errorf("removed instance data got %v", scan.RemovedInsData)
+	}
+
+	removed := deleteInsFolder(root, []string{"ins3", "../outside", ".."})
+	if !reflect.DeepEqual(removed, []string{filepath.Join(root, "ins3")}) {
+		t.Errorf("removed folders got %v", removed)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "postgresql-1.log")); err != nil {
+		t.Errorf("file behind symlink should not be removed, err: %v", err)
+	}
+}
+
+func TestRemoveUnderRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dbcluster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root, err := resolveLogRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outside, err := ioutil.TempDir("", "outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	writeLogFile(t, filepath.Join(outside, "postgresql-1.log"), time.Now())
+	if err := os.Symlink(outside, filepath.Join(root, "ins1")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{
+		root,
+		filepath.Join(root, ".."),
+		outside,
+		// 所在目录为指向根目录之外的符号链接
+		filepath.Join(root, "ins1", "postgresql-1.log"),
+	} {
+		if err := removeUnderRoot(root, path); err == nil {
+			t.Errorf("remove %s should fail", path)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(outside, "postgresql-1.log")); err != nil {
+		t.Errorf("file outside root should not be removed, err: %v", err)
+	}
+	if err := removeUnderRoot(root, filepath.Join(root, "not-exist")); err != nil {
+		t.Errorf("remove not existing path got err: %v", err)
+	}
+}
@@ -16,14 +16,12 @@
 package db_log_monitor
 
 import (
-	"fmt"
 	"github.com/ApsaraDB/PolarDB-Stack-Daemon/polar-controller-manager/util"
+	"path/filepath"
 	"strings"
 	"time"
 
 	config "github.com/ApsaraDB/PolarDB-Stack-Daemon/cmd/daemon/app/config"
-	utils "github.com/ApsaraDB/PolarDB-Stack-Daemon/polar-controller-manager"
-	"k8s.io/kubernetes/pkg/util/slice"
 
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
@@ -35,6 +33,11 @@ func StartLogMonitor(stop <-chan struct{}) {
 	klog.Infof("Starting StartLogMonitor")
 	defer klog.Infof("Shutting down StartLogMonitor")
 	go wait.Until(checkInsFolderTask, 6*time.Hour, stop)
+	interval := config.Conf.LogDiskCheckInterval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	go wait.Until(checkLogDiskUsageTask, interval, stop)
 	<-stop
 }
 
@@ -45,63 +48,53 @@ func checkInsFolderTask() {
 		klog.Infof("checkInsFolderTask done, spend: %v s", time.Now().Sub(start).Seconds())
 	}()
 
-	podInsIdList := getInsIdListFromPod()
-	if podInsIdList == nil {
+	cleanupLock.Lock()
+	defer cleanupLock.Unlock()
+	plan, err := planLogCleanup()
+	if err != nil {
+		klog.Errorf("failed to plan log cleanup, err: %v", err)
 		return
 	}
-	klog.Info("get insId from pods [%v]", podInsIdList)
-	nodeInsIdList := getInsIdListFromNode()
-	klog.Info("get insId from nodes [%v]", nodeInsIdList)
-	for _, insId := range podInsIdList {
-		if _, ok := nodeInsIdList[insId]; ok {
-			delete(nodeInsIdList, insId)
-		}
-	}
-	var overdueInsIdList []string
-	var notOverdueInsIdList []string
-	for insId, notOverdue := range nodeInsIdList {
-		if !notOverdue {
-			overdueInsIdList = append(overdueInsIdList, insId)
-		} else {
-			notOverdueInsIdList = append(notOverdueInsIdList, insId)
-		}
+	if plan.DryRun {
+		publishLogCleanupPlan(plan)
+		return
 	}
-	deleteInsFolder(overdueInsIdList)
-	klog.Infof("instance folder %s [%v] on %s have been deleted", config.Conf.DbclusterLogDir, overdueInsIdList, config.Conf.CurrentNodeName)
-	deleteInsLogs()
-	deleteRemovedInsData()
-	klog.Infof("instance folder %s [%v] on %s overdue logs and data have been deleted", config.Conf.DbclusterLogDir, notOverdueInsIdList, config.Conf.CurrentNodeName)
+	executeLogCleanupPlan(plan)
 }
 
-func deleteInsLogs() error {
-	cmd := fmt.Sprintf(`find %s -name "postgresql*.log" -mtime +%d -exec rm -f {} \;`, config.Conf.DbclusterLogDir, config.Conf.InsFolderOverdueDays)
-	return utils.ExecCommand(config.Conf.CurrentNodeName, func(out string, err error) bool {
-		return err == nil
-	}, cmd)
+// deleteInsLogs 删除超期的 postgresql*.log
+func deleteInsLogs(root string, logs []string) []string {
+	removed, errs := removeAllUnderRoot(root, logs)
+	logCleanupErrors("delete overdue log", errs)
+	return removed
 }
 
-func deleteRemovedInsData() error {
-	cmd := fmt.Sprintf(`find %s -name 'rm_data_*' -type d -mtime +%d -exec rm -fr {} \;`, config.Conf.DbclusterLogDir, config.Conf.InsFolderOverdueDays)
-	return utils.ExecCommand(config.Conf.CurrentNodeName, func(out string, err error) bool {
-		return err == nil
-	}, cmd)
+// deleteRemovedInsData 删除超期的 rm_data_* 目录
+func deleteRemovedInsData(root string, dirs []string) []string {
+	removed, errs := removeAllUnderRoot(root, dirs)
+	logCleanupErrors("delete removed instance data", errs)
+	return removed
 }
 
-func deleteInsFolder(insIds []string) error {
-	cmd := fmt.Sprintf("cd %s; rm -fr", config.Conf.DbclusterLogDir)
-	exec := false
+// deleteInsFolder 删除根目录下的实例目录，insId 中含路径分隔符或为 . 、.. 时忽略
+func deleteInsFolder(root string, insIds []string) []string {
+	var paths []string
 	for _, insId := range insIds {
-		if insId != "" {
-			cmd += fmt.Sprintf(" %s", insId)
-			exec = true
+		if insId == "" || insId == "." || insId == ".." || strings.ContainsRune(insId, filepath.Separator) {
+			klog.Warningf("skip invalid instance folder name %q", insId)
+			continue
 		}
+		paths = append(paths, filepath.Join(root, insId))
 	}
-	if !exec {
-		return nil
+	removed, errs := removeAllUnderRoot(root, paths)
+	logCleanupErrors("delete instance folder", errs)
+	return removed
+}
+
+func logCleanupErrors(action string, errs []cleanupError) {
+	for _, e := range errs {
+		klog.Errorf("%s %s failed, err: %s", action, e.Path, e.Error)
 	}
-	return utils.ExecCommand(config.Conf.CurrentNodeName, func(out string, err error) bool {
-		return err == nil
-	}, cmd)
 }
 
 func getInsIdListFromPod() []string {
@@ -119,37 +112,3 @@ func getInsIdListFromPod() []string {
 	}
 	return allPodInsId
 }
-
-func getInsIdListFromNode() map[string]bool {
-	insTimeList := map[string]bool{}
-	var allInsResult string
-	utils.ExecCommand(config.Conf.CurrentNodeName, func(out string, err error) bool {
-		allInsResult = out
-		return err == nil
-	}, []string{
-		"ls " + config.Conf.DbclusterLogDir,
-	}...)
-	allInsList := strings.Split(allInsResult, "\n")
-
-	replacedDir := strings.Replace(config.Conf.DbclusterLogDir, "/", "\\/", -1)
-	cmdList := []string{
-		fmt.Sprintf(`find %s -name "*.log" -mtime -%d|sed 's/%s//g'|awk -F"/" '{print $1}'|uniq`,
-			config.Conf.DbclusterLogDir,
-			config.Conf.InsFolderOverdueDays,
-			replacedDir),
-	}
-	var result string
-	utils.ExecCommand(config.Conf.CurrentNodeName, func(out string, err error) bool {
-		result = out
-		return err == nil
-	}, cmdList...)
-	items := strings.Split(result, "\n")
-
-	for _, item := range allInsList {
-		item = strings.TrimSpace(item)
-		if item != "" {
-			insTimeList[item] = slice.ContainsString(items, item, nil)
-		}
-	}
-	return insTimeList
-}
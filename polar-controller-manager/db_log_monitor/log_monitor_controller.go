@@ -0,0 +1,46 @@
+/*
+*Copyright (c) 2019-2021, Alibaba Group Holding Limited;
+*Licensed under the Apache License, Version 2.0 (the "License");
+*you may not use this file except in compliance with the License.
+*You may obtain a copy of the License at
+
+*   http://www.apache.org/licenses/LICENSE-2.0
+
+*Unless required by applicable law or agreed to in writing, software
+*distributed under the License is distributed on an "AS IS" BASIS,
+*WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*See the License for the specific language governing permissions and
+*limitations under the License.
+ */
+
+package db_log_monitor
+
+import (
+	"github.com/ApsaraDB/PolarDB-Stack-Daemon/polar-controller-manager/bizapis/context"
+	"github.com/ApsaraDB/PolarDB-Stack-Daemon/polar-controller-manager/errors"
+)
+
+// GetLogCleanupPlan
+/**
+ * @Title:  GetLogCleanupPlan
+ * @Description: 查询当前节点下一次按时间清理将删除的实例目录、超期日志及 rm_data_* 目录和它们的大小，不删除任何文件
+ * last=true 时返回 --log-cleanup-dry-run 下最近一次清理发布的计划
+ **/
+func GetLogCleanupPlan(ctx *context.Context) {
+	if ctx.GetContext().Query("last") == "true" {
+		plan := getLastLogCleanupPlan()
+		if plan == nil {
+			ctx.ResErr(errors.New("no log cleanup plan has been published, it is published only with --log-cleanup-dry-run"))
+			return
+		}
+		ctx.ResSucData(plan)
+		return
+	}
+	plan, err := planLogCleanup()
+	if err != nil {
+		ctx.Log.Errorf("failed to plan log cleanup, err:%v", err)
+		ctx.ResErr(err)
+		return
+	}
+	ctx.ResSucData(plan)
+}
@@ -0,0 +1,146 @@
+/*
+*Copyright (c) 2019-2021, Alibaba Group Holding Limited;
+*Licensed under the Apache License, Version 2.0 (the "License");
+*you may not use this file except in compliance with the License.
+*You may obtain a copy of the License at
+
+*   http://www.apache.org/licenses/LICENSE-2.0
+
+*Unless required by applicable law or agreed to in writing, software
+*distributed under the License is distributed on an "AS IS" BASIS,
+*WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*See the License for the specific language governing permissions and
+*limitations under the License.
+ */
+
+package db_log_monitor
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	config "github.com/ApsaraDB/PolarDB-Stack-Daemon/cmd/daemon/app/config"
+	"github.com/ApsaraDB/PolarDB-Stack-Daemon/polar-controller-manager/util"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/klog"
+)
+
+// 按时间清理与按水位清理不同时进行
+var cleanupLock sync.Mutex
+
+// 每个实例至少保留的日志数，数据库正在写入的日志为最新的一个
+const minKeepLogFiles = 1
+
+// checkLogDiskUsageTask
+/**
+ * @Title:  checkLogDiskUsageTask
+ * @Description:
+ *
+ *	日志目录所在文件系统的使用率达到高水位时，跨实例从最旧的 postgresql*.log 开始删除，直到低于低水位，
+ *	每个实例最新的 --log-retention-keep-files 个日志不删除；高水位 <= 0（默认）时不检查，--log-cleanup-dry-run 时只记录日志
+ *	删除全部可删除的日志也无法降到低水位时，说明空间主要被日志以外的文件占用，不删除并告警
+ **/
+func checkLogDiskUsageTask() {
+	defer utilruntime.HandleCrash()
+	high, low := config.Conf.LogDiskHighWatermark, config.Conf.LogDiskLowWatermark
+	if high <= 0 {
+		return
+	}
+	if low <= 0 || low > high {
+		low = high
+	}
+
+	root, err := resolveLogRoot(config.Conf.DbclusterLogDir)
+	if err != nil {
+		klog.Errorf("invalid dbcluster log dir %s, err: %v", config.Conf.DbclusterLogDir, err)
+		return
+	}
+	usage, err := util.GetDiskUsage(root)
+	if err != nil {
+		klog.Errorf("failed to get disk usage of %s, err: %v", root, err)
+		return
+	}
+	if usage.UsedPercent() < float64(high) {
+		klog.V(5).Infof("disk usage of %s is %.1f%%, below high watermark %d%%", root, usage.UsedPercent(), high)
+		return
+	}
+
+	cleanupLock.Lock()
+	defer cleanupLock.Unlock()
+	start := time.Now()
+	scan := scanLogDir(root, config.Conf.InsFolderOverdueDays, start)
+	logCleanupErrors("scan", scan.Errors)
+	logs, err := planWatermarkCleanup(scan.Logs, usage, low, int(config.Conf.LogRetentionKeepFiles))
+	if err != nil {
+		klog.Warningf("disk usage of %s is %.1f%%, above high watermark %d%%, skip deleting logs: %v",
+			root, usage.UsedPercent(), high, err)
+		return
+	}
+	klog.Warningf("disk usage of %s is %.1f%%, above high watermark %d%%, delete %d oldest logs to reach low watermark %d%%",
+		root, usage.UsedPercent(), high, len(logs), low)
+
+	var paths []string
+	for _, log := range logs {
+		paths = append(paths, log.Path)
+	}
+	if config.Conf.LogCleanupDryRun {
+		klog.Infof("[dry run] would delete logs %v", paths)
+		return
+	}
+	removed := deleteInsLogs(root, paths)
+	if usage, err = util.GetDiskUsage(root); err == nil {
+		klog.Infof("deleted %d logs %v in %v, disk usage of %s is %.1f%% now", len(removed), removed, time.Since(start), root, usage.UsedPercent())
+	}
+}
+
+// planWatermarkCleanup
+/**
+ * @Title:  planWatermarkCleanup
+ * @Description:
+ *
+ *	每个实例按修改时间保留最新的 keep 个日志（至少 1 个），其余日志按修改时间从旧到新，
+ *	累计大小达到使用率降到 low 所需释放的空间为止；空间的计算方式与 df 相同
+ *	全部可删除的日志加起来也不够时返回错误，不删除任何日志
+ **/
+func planWatermarkCleanup(logs []logFile, usage *util.DiskUsage, low int32, keep int) ([]logFile, error) {
+	if keep < minKeepLogFiles {
+		keep = minKeepLogFiles
+	}
+	capacity := float64(usage.Used() + usage.Available)
+	need := float64(usage.Used()) - capacity*float64(low)/100
+	if need <= 0 {
+		return nil, nil
+	}
+
+	byIns := make(map[string][]logFile)
+	for _, log := range logs {
+		byIns[log.InsId] = append(byIns[log.InsId], log)
+	}
+	var candidates []logFile
+	for _, insLogs := range byIns {
+		sort.Slice(insLogs, func(i, j int) bool {
+			return insLogs[i].ModTime.After(insLogs[j].ModTime)
+		})
+		if len(insLogs) > keep {
+			candidates = append(candidates, insLogs[keep:]...)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if !candidates[i].ModTime.Equal(candidates[j].ModTime) {
+			return candidates[i].ModTime.Before(candidates[j].ModTime)
+		}
+		return candidates[i].Path < candidates[j].Path
+	})
+
+	var freed float64
+	for i, log := range candidates {
+		freed += float64(log.Size)
+		if freed >= need {
+			return candidates[:i+1], nil
+		}
+	}
+	return nil, fmt.Errorf("deleting all %d deletable logs frees %.0f bytes, %.0f bytes are needed to reach low watermark %d%%",
+		len(candidates), freed, need, low)
+}
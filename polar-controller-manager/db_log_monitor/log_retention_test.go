@@ -0,0 +1,72 @@
+/*
+*Copyright (c) 2019-2021, Alibaba Group Holding Limited;
+*Licensed under the Apache License, Version 2.0 (the "License");
+*you may not use this file except in compliance with the License.
+*You may obtain a copy of the License at
+
+*   http://www.apache.org/licenses/LICENSE-2.0
+
+*Unless required by applicable law or agreed to in writing, software
+*distributed under the License is distributed on an "AS IS" BASIS,
+*WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*See the License for the specific language governing permissions and
+*limitations under the License.
+ */
+
+package db_log_monitor
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ApsaraDB/PolarDB-Stack-Daemon/polar-controller-manager/util"
+)
+
+func TestPlanWatermarkCleanup(t *testing.T) {
+	now := time.Now()
+	logs := []logFile{
+		{Path: "ins1/log/postgresql-1.log", InsId: "ins1", Size: 30, ModTime: now.Add(-5 * time.Hour)},
+		{Path: "ins1/log/postgresql-2.log", InsId: "ins1", Size: 30, ModTime: now.Add(-4 * time.Hour)},
+		{Path: "ins1/log/postgresql-3.log", InsId: "ins1", Size: 30, ModTime: now.Add(-time.Hour)},
+		{Path: "ins2/log/postgresql-1.log", InsId: "ins2", Size: 20, ModTime: now.Add(-6 * time.Hour)},
+		{Path: "ins2/log/postgresql-2.log", InsId: "ins2", Size: 20, ModTime: now},
+		// 只有一个日志的实例始终保留
+		{Path: "ins3/log/postgresql-1.log", InsId: "ins3", Size: 500, ModTime: now.Add(-10 * time.Hour)},
+	}
+	paths := func(logs []logFile, err error) []string {
+		if err != nil {
+			t.Errorf("unexpected plan err:%v", err)
+		}
+		var paths []string
+		for _, log := range logs {
+			paths = append(paths, log.Path)
+		}
+		return paths
+	}
+
+	// 使用率 90%，降到 85% 需要释放 50
+	usage := &util.DiskUsage{Total: 1000, Free: 100, Available: 100}
+	got := paths(planWatermarkCleanup(logs, usage, 85, 1))
+	expected := []string{"ins2/log/postgresql-1.log", "ins1/log/postgresql-1.log"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("plan got %v, expected %v", got, expected)
+	}
+
+	// 每个实例保留 2 个日志，降到 88% 需要释放 20
+	got = paths(planWatermarkCleanup(logs, usage, 88, 2))
+	expected = []string{"ins1/log/postgresql-1.log"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("plan keeping 2 logs got %v, expected %v", got, expected)
+	}
+
+	// 删除全部可删除的日志也无法降到低水位时不删除
+	if got, err := planWatermarkCleanup(logs, usage, 10, 2); err == nil || len(got) != 0 {
+		t.Errorf("expected unreachable low watermark fails, got %v, err:%v", got, err)
+	}
+
+	// 已低于低水位
+	if got := paths(planWatermarkCleanup(logs, usage, 95, 1)); len(got) != 0 {
+		t.Errorf("plan below low watermark got %v", got)
+	}
+}
@@ -18,8 +18,8 @@ package timer
 import (
 	"fmt"
 	config "github.com/ApsaraDB/PolarDB-Stack-Daemon/cmd/daemon/app/config"
-	"net"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -31,17 +31,26 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
 	clientset "k8s.io/client-go/kubernetes"
 	"k8s.io/klog"
+	"k8s.io/kubernetes/pkg/util/slice"
 )
 
 const PrintPeriodMinute = 1 * time.Minute
 
 type printPort struct {
-	client    *clientset.Clientset
-	configMap string
+	client        *clientset.Clientset
+	dynamicClient dynamic.Interface
+	configMap     string
+	scanner       portScanCoalescer
+	// 各已使用端口首次扫描到的时间，NodePortUsage 截断时也保留
+	firstSeen map[int]metav1.Time
 }
 
+// 本节点的端口扫描，StartPrintPort 后可用，供按需扫描的 API 使用
+var portPrinter *printPort
+
 type rangePort struct {
 	Start int
 	End   int
@@ -53,11 +62,24 @@ func StartPrintPort(client *clientset.Clientset, stop <-chan struct{}) {
 	defer klog.Infof("Shutting port usage controller")
 	host, _ := os.Hostname()
 
-	w := &printPort{client, fmt.Sprintf("cloud-provider-port-usage-%s", host)}
+	// NodePortUsage 通过 dynamic client 读写，创建失败时仅更新 configMap
+	dynamicClient, err := dynamic.NewForConfig(config.Conf.Kubeconfig)
+	if err != nil {
+		klog.Errorf("create dynamic client failed, NodePortUsage will not be updated: %v", err)
+	}
+
+	w := &printPort{client: client, dynamicClient: dynamicClient, configMap: getPortUsageConfigMapName(host),
+		firstSeen: make(map[int]metav1.Time)}
+	portPrinter = w
 
 	wait.Until(w.PrintPort, PrintPeriodMinute, stop)
 }
 
+// getPortUsageConfigMapName 节点端口占用 configMap 的名称
+func getPortUsageConfigMapName(host string) string {
+	return fmt.Sprintf("cloud-provider-port-usage-%s", host)
+}
+
 func (p *printPort) checkSwitchStatus() bool {
 	controllerConf, err := utils.GetControllerConfig()
 	if err != nil {
@@ -67,27 +89,13 @@ func (p *printPort) checkSwitchStatus() bool {
 	return controllerConf.EnablePrintPort
 }
 
-func (p *printPort) markUnPrintPort() []rangePort {
-	var res []rangePort
-
-	cm, err := p.client.CoreV1().ConfigMaps("kube-system").Get(config.Conf.MpdControllerConfigMapName, metav1.GetOptions{})
-	if err != nil && apierrors.IsNotFound(err) {
-		return res
-	} else if err != nil {
-		klog.Errorf("get %s configmap failed: %s", p.configMap, err.Error())
-		return res
-	}
-	ams := cm.Annotations
-
-	for _, v := range ams {
-		rangx := parseRange(v)
-
-		if rangx.Start == 0 {
-			continue
-		}
-		res = append(res, rangx)
+func (p *printPort) markUnPrintPort() []*portRangeConfig {
+	namedRanges, err := getNamedRanges(p.client)
+	if err != nil {
+		klog.Errorf("get port ranges for %s failed: %s", p.configMap, err.Error())
+		return nil
 	}
-	return res
+	return sortedRangeConfigs(namedRanges)
 }
 
 func buildAwkShellParts(rangx []rangePort) string {
@@ -143,13 +151,23 @@ func parseRange(rangx string) rangePort {
 *	除了已占用端口采用最新的端口扫描逻辑
 * 	其余延用原有逻辑
 * 	去除了 isPrintPort 的验证
+*	与按需扫描合并执行，见 portScanCoalescer
  */
 func (p *printPort) PrintPort() {
 	if !p.checkSwitchStatus() {
 		klog.Infof("PrintPort switch is off , skip port print!")
 		return
 	}
+	if _, err := p.scanner.do(p.printPortOnce); err != nil {
+		klog.Errorf("[timer port usage] print port failed: %v", err)
+	}
+}
 
+// printPortOnce
+/**
+ * @Title: 执行一次端口扫描，并将结果写入 configMap 与 NodePortUsage
+ **/
+func (p *printPort) printPortOnce() (*portScanResult, error) {
 	cm, err := p.client.CoreV1().ConfigMaps("kube-system").Get(p.configMap, metav1.GetOptions{})
 	if err != nil && apierrors.IsNotFound(err) {
 		cm = &v1.ConfigMap{
@@ -161,107 +179,210 @@ func (p *printPort) PrintPort() {
 		cm, err = p.client.CoreV1().ConfigMaps("kube-system").Create(cm)
 		if err != nil {
 			klog.Errorf("create %s configmap failed: %s", p.configMap, err.Error())
-			return
+			return nil, err
 		}
 	} else if err != nil {
 		klog.Errorf("get %s configmap failed: %s", p.configMap, err.Error())
-		return
+		return nil, err
 	}
 
-	rangePort := p.markUnPrintPort()
-	klog.Infof("Print Port range: %v", rangePort)
+	scanTime := time.Now()
+	rangeConfigs := p.markUnPrintPort()
+	klog.Infof("Print Port range: %v", rangeConfigs)
 
 	var newData = make(map[string]string)
 
 	// 采用新的端口扫描判断是否被点用，除已占用端口采用最的逻辑，其余延用原有逻辑，去除了 isPrintPort 的验证
-	alreadyUsePorts := scanRangePort(rangePort)
-
-	for _, alreadyUsePort := range alreadyUsePorts {
-		portKey := strconv.Itoa(alreadyUsePort)
-		if value, ok := newData[portKey]; ok {
-			newData[portKey] = value
-		} else {
-			newData[portKey] = "the port already use"
+	alreadyUsePorts, portSockets := scanPortRanges(rangeConfigs)
+
+	// value 为 json 格式的端口占用信息：协议（区分 TCP 与 UDP 冲突）及占用端口的进程、容器、pod
+	portUsages := buildPortUsage(p.client, portSockets)
+	scanDuration := time.Since(scanTime)
+	// 知名端口始终记为已使用
+	for _, port := range wellKnownPorts(rangeConfigs) {
+		if _, ok := portUsages[port]; !ok {
+			portUsages[port] = &portUsage{}
+			alreadyUsePorts = append(alreadyUsePorts, port)
 		}
+		portUsages[port].WellKnown = true
 	}
-
-	var isChanged bool
-
-	// 判断是否有元素需要删除
-	for key, value := range cm.Data {
-		if _, ok := newData[key]; !ok {
-			isChanged = true
-			klog.Infof("[timer port usage] - %s: %s", key, value)
-			break
+	// 预留的端口同样记为已使用，避免被其它分配方使用
+	reservations, err := listPortReservations(p.client)
+	if err != nil {
+		klog.Errorf("[timer port usage] list port reservations failed: %v", err)
+	}
+	for port, reservation := range reservations {
+		if _, ok := portUsages[port]; !ok {
+			portUsages[port] = &portUsage{}
+			alreadyUsePorts = append(alreadyUsePorts, port)
 		}
+		reservation := reservation
+		portUsages[port].Reservation = &reservation
 	}
-	if !isChanged {
-		for key, value := range newData {
-			if data, ok := cm.Data[key]; !ok || value != data {
-				isChanged = true
-				klog.Infof("[timer port usage] + %s: %s", key, value)
-				break
-			}
+	for _, alreadyUsePort := range alreadyUsePorts {
+		newData[strconv.Itoa(alreadyUsePort)] = portUsages[alreadyUsePort].String()
+	}
+	sort.Ints(alreadyUsePorts)
+	result := &portScanResult{ScanTime: scanTime, Ports: alreadyUsePorts, Usages: portUsages}
+
+	if p.dynamicClient != nil {
+		if err := updateNodePortUsage(p.client, p.dynamicClient, portUsages, p.firstSeen, scanTime, scanDuration); err != nil {
+			klog.Errorf("[timer port usage] update NodePortUsage failed: %v", err)
 		}
 	}
-	if isChanged {
-		if cm.Annotations == nil {
-			cm.Annotations = make(map[string]string)
+
+	// 数据可能分片存放，上次写入中断导致分片不完整时按空数据比较，本次将完整重写
+	rewrite := false
+	oldData, err := loadPortUsageData(p.client, cm)
+	if err != nil {
+		klog.Warningf("[timer port usage] load %s failed, rewrite it: %v", p.configMap, err)
+		rewrite = true
+	}
+
+	// 逐个端口比较新旧内容，变更写入本地历史，供 PortUsageHistory 查询
+	changes := diffPortUsageData(oldData, newData, scanTime)
+	for _, change := range changes {
+		if change.Action == portChangeRemove {
+			klog.Infof("[timer port usage] - %d: %s", change.Port, change.Value)
+		} else {
+			klog.Infof("[timer port usage] + %d: %s", change.Port, change.Value)
 		}
-		cm.Annotations["updateTimestamp"] = time.Now().UTC().Format("2006-01-02T15:04:05Z")
-		cm.Data = newData
-		_, err = p.client.CoreV1().ConfigMaps("kube-system").Update(cm)
+	}
+	if len(changes) > 0 || rewrite {
+		err = writePortUsageData(p.client, cm, newData)
 		if err != nil {
 			klog.Errorf("[timer port usage] update configmap failed: %v", err)
-			return
+			return nil, err
 		}
+		usageHistory.record(changes)
 	} else {
 		klog.Infof("[timer port usage] %s configmap is not changed.", p.configMap)
 	}
+	return result, nil
 }
 
 /**
  * @Title: 扫描区域端口是否可用
  * @Description:
  *
- *	指定扫描端口区域数组：rangePorts []rangePort
- *	将返回已被占用的端口list：alreadyUsePort
+ *	指定扫描端口区域数组：rangePorts []rangePort，同时检查 tcp 与 udp
+ *	将返回已被占用的端口list：alreadyUsePort，以及各端口上的 socket 及其状态：portSockets
  */
-func scanRangePort(rangePorts []rangePort) (alreadyUsePort []int) {
+func scanRangePort(rangePorts []rangePort) (alreadyUsePort []int, portSockets map[int][]portSocket) {
+	return scanPortRanges([]*portRangeConfig{{Ranges: rangePorts}})
+}
+
+// scanPortRanges
+/**
+ * @Title: 扫描命名区间中的端口是否可用
+ * @Description:
+ *
+ *	读取内核 tcp/tcp6/udp/udp6 socket 表，不再逐个端口尝试监听
+ *	开启 --port-scan-container-netns 时一并检查 pod 的 hostPort 及 iptables DNAT 规则，
+ *	容器网络命名空间中的 socket 不占用主机端口，只作为占用者信息附加到已被占用的端口上
+ *	socket 需落在某个区间内（排除 exclude），且协议与该区间的 protocol 匹配
+ *	将返回已被占用的端口list：alreadyUsePort，以及各端口上的 socket 及其状态：portSockets
+ */
+func scanPortRanges(rangeConfigs []*portRangeConfig) (alreadyUsePort []int, portSockets map[int][]portSocket) {
 	defer func() {
 		if err := recover(); err != nil {
 			klog.Errorf("scanRangePort scan range port error %v", err)
 		}
 	}()
 
-	klog.Infof("scanRangePort begin scan range %#v", rangePorts)
-	for _, rangePort := range rangePorts {
-		for port := rangePort.Start; port < rangePort.End; port++ {
-			if !isPortAvailable(port) {
-				alreadyUsePort = append(alreadyUsePort, port)
-			}
-		}
+	klog.Infof("scanRangePort begin scan range %v", rangeConfigs)
+	portSockets = make(map[int][]portSocket)
+	sockets, err := readSocketTables(procNetDir, protocolTCP, protocolTCP6, protocolUDP, protocolUDP6)
+	if err != nil {
+		klog.Errorf("scanRangePort read socket tables from %s error: %v", procNetDir, err)
+		return
+	}
+	for i := range sockets {
+		sockets[i].Source = portSourceHost
+	}
+	if config.Conf != nil && config.Conf.PortScanContainerNetns {
+		sockets = append(sockets, scanContainerSockets()...)
 	}
+	alreadyUsePort, portSockets = occupiedPorts(rangeConfigs, sockets)
 	klog.Infof("scanRangePort range port scan result:%#v", alreadyUsePort)
 	return
 }
 
+// occupiedPorts
 /**
- * @Title: 端口是否可用
+ * @Title: 按区间汇总被占用的端口及其 socket
  * @Description:
  *
- *	采用go socket对象尝试监听所在服务器指定端口
- *	- 若监听成功，说明该端口此时未被其它应用使用
- *	- 若监听失败，说明该端口已被占用
- */
-func isPortAvailable(port int) bool {
-	address := fmt.Sprintf("%s:%d", "0.0.0.0", port)
-	listener, err := net.Listen("tcp", address)
+ *	只有主机 socket、hostPort 及 DNAT 规则使端口计为占用，
+ *	容器网络命名空间中的 socket 仅附加到这些端口上，说明端口在哪个容器中被监听
+ **/
+func occupiedPorts(rangeConfigs []*portRangeConfig, sockets []portSocket) ([]int, map[int][]portSocket) {
+	var ports []int
+	portSockets := make(map[int][]portSocket)
+	for _, socket := range sockets {
+		if socket.Source == portSourceNetns || !socket.occupied() || !rangeConfigsMatch(rangeConfigs, socket) {
+			continue
+		}
+		if _, ok := portSockets[socket.Port]; !ok {
+			ports = append(ports, socket.Port)
+		}
+		portSockets[socket.Port] = append(portSockets[socket.Port], socket)
+	}
+	for _, socket := range sockets {
+		if socket.Source != portSourceNetns || !socket.occupied() || !rangeConfigsMatch(rangeConfigs, socket) {
+			continue
+		}
+		if _, ok := portSockets[socket.Port]; ok {
+			portSockets[socket.Port] = append(portSockets[socket.Port], socket)
+		}
+	}
+	sort.Ints(ports)
+	return ports, portSockets
+}
 
-	if err != nil {
-		return false
+// rangeConfigsMatch socket 是否需要在某个区间中计为占用
+func rangeConfigsMatch(rangeConfigs []*portRangeConfig, socket portSocket) bool {
+	for _, c := range rangeConfigs {
+		if c.contains(socket.Port) && c.matchProtocol(socket.Protocol) {
+			return true
+		}
+	}
+	return false
+}
+
+// wellKnownPorts 各区间中的知名端口，已排除的端口除外
+func wellKnownPorts(rangeConfigs []*portRangeConfig) []int {
+	var ports []int
+	seen := make(map[int]bool)
+	for _, c := range rangeConfigs {
+		for _, r := range c.WellKnown {
+			for port := r.Start; port < r.End; port++ {
+				if !seen[port] && c.isWellKnown(port) {
+					seen[port] = true
+					ports = append(ports, port)
+				}
+			}
+		}
 	}
+	sort.Ints(ports)
+	return ports
+}
 
-	defer listener.Close()
-	return true
+// portProtocols
+/**
+ * @Title: 汇总端口上 socket 的协议
+ * @Description:
+ *
+ *	tcp6、udp6 分别归入 tcp、udp，按字母序以逗号连接
+ **/
+func portProtocols(sockets []portSocket) string {
+	var protocols []string
+	for _, socket := range sockets {
+		protocol := strings.TrimSuffix(socket.Protocol, "6")
+		if !slice.ContainsString(protocols, protocol, nil) {
+			protocols = append(protocols, protocol)
+		}
+	}
+	sort.Strings(protocols)
+	return strings.Join(protocols, ",")
 }
@@ -0,0 +1,112 @@
+/*
+*Copyright (c) 2019-2021, Alibaba Group Holding Limited;
+*Licensed under the Apache License, Version 2.0 (the "License");
+*you may not use this file except in compliance with the License.
+*You may obtain a copy of the License at
+
+*   http://www.apache.org/licenses/LICENSE-2.0
+
+*Unless required by applicable law or agreed to in writing, software
+*distributed under the License is distributed on an "AS IS" BASIS,
+*WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*See the License for the specific language governing permissions and
+*limitations under the License.
+ */
+
+package timer
+
+import (
+	"net"
+	"sort"
+
+	"github.com/ApsaraDB/PolarDB-Stack-Daemon/polar-controller-manager/node_net_status"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+// socket 绑定地址的类别
+const (
+	bindScopeWildcard = "wildcard" // 0.0.0.0 或 ::，所有网卡
+	bindScopeClient   = "client"   // 客户网卡 ip
+	bindScopeLoopback = "loopback" // 127.0.0.0/8 或 ::1
+	bindScopeOther    = "other"    // 其它网卡 ip，如管控、存储网络
+)
+
+// getNodeClientIP
+/**
+ * @Title: 获取本节点客户网卡 ip
+ * @Description:
+ *
+ *	由 node_net_status 探测并记录在节点的 NodeClientIP condition 中，
+ *	condition 不存在或探测失败时返回 nil，此时绑定在客户网卡上的端口归为 other
+ **/
+func getNodeClientIP(client clientset.Interface) net.IP {
+	if client == nil {
+		return nil
+	}
+	nodeName := getCurrentNodeName()
+	node, err := client.CoreV1().Nodes().Get(nodeName, metav1.GetOptions{})
+	if err != nil {
+		klog.Errorf("[timer port usage] get node %s failed, client ip is unknown: %v", nodeName, err)
+		return nil
+	}
+	cond := node_net_status.GetNodeCondition(node, node_net_status.NodeClientIP)
+	if cond == nil || cond.Status != v1.ConditionTrue {
+		return nil
+	}
+	ip := net.ParseIP(cond.Message)
+	if ip == nil || ip.IsUnspecified() {
+		return nil
+	}
+	return ip
+}
+
+// bindScope
+/**
+ * @Title: 判断 socket 绑定地址的类别
+ * @Description:
+ *
+ *	ipv4-mapped 的 ipv6 地址（::ffff:a.b.c.d）按 ipv4 地址处理
+ **/
+func bindScope(ip net.IP, clientIP net.IP) string {
+	switch {
+	case ip == nil || ip.IsUnspecified():
+		return bindScopeWildcard
+	case ip.IsLoopback():
+		return bindScopeLoopback
+	case clientIP != nil && ip.Equal(clientIP):
+		return bindScopeClient
+	default:
+		return bindScopeOther
+	}
+}
+
+// bindScopes 汇总端口上 socket 的绑定类别，按名称排序
+// 容器网络命名空间中的 socket 不占用主机网络，不参与汇总
+func bindScopes(owners []portOwner) []string {
+	var scopes []string
+	seen := make(map[string]bool)
+	for _, owner := range owners {
+		if owner.Source == portSourceNetns {
+			continue
+		}
+		if owner.BindScope != "" && !seen[owner.BindScope] {
+			seen[owner.BindScope] = true
+			scopes = append(scopes, owner.BindScope)
+		}
+	}
+	sort.Strings(scopes)
+	return scopes
+}
+
+// onClientNetwork 端口在客户网络上是否被占用：绑定在任意地址或客户网卡 ip 上
+func onClientNetwork(scopes []string) bool {
+	for _, scope := range scopes {
+		if scope == bindScopeWildcard || scope == bindScopeClient {
+			return true
+		}
+	}
+	return false
+}
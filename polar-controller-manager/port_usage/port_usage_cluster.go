@@ -0,0 +1,128 @@
+/*
+*Copyright (c) 2019-2021, Alibaba Group Holding Limited;
+*Licensed under the Apache License, Version 2.0 (the "License");
+*you may not use this file except in compliance with the License.
+*You may obtain a copy of the License at
+
+*   http://www.apache.org/licenses/LICENSE-2.0
+
+*Unless required by applicable law or agreed to in writing, software
+*distributed under the License is distributed on an "AS IS" BASIS,
+*WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*See the License for the specific language governing permissions and
+*limitations under the License.
+ */
+
+package timer
+
+import (
+	"fmt"
+	"strconv"
+
+	clientset "k8s.io/client-go/kubernetes"
+)
+
+// 未指定数量时返回的候选端口数
+const defaultCandidateCount = 10
+
+// FindFreePortsRequest 查询多个节点上共同空闲端口的请求，RangeName 与 Range 二选一，Range 形如 5400-5410，包含两端
+type FindFreePortsRequest struct {
+	Nodes     []string `json:"nodes" binding:"required,min=1"`
+	RangeName string   `json:"rangeName"`
+	Range     string   `json:"range"`
+	Count     int      `json:"count"`
+}
+
+// FindFreePortsResult 查询结果，NodeUpdateTimestamps 为各节点端口扫描结果的更新时间
+type FindFreePortsResult struct {
+	Ports                []int             `json:"ports"`
+	NodeUpdateTimestamps map[string]string `json:"nodeUpdateTimestamps"`
+}
+
+// findFreePortsOnNodes
+/**
+ * @Title: 查询在所有指定节点上均空闲的端口
+ * @Description:
+ *
+ *	读取各节点的 port-usage configMap 求交集，configMap 中已包含各节点预留的端口
+ *	各节点扫描周期为 PrintPeriodMinute，结果可能有一个周期的延迟，分配时应配合端口预留使用
+ *	指定的区间须落在已配置的端口区间内，否则节点不会扫描这些端口
+ **/
+func findFreePortsOnNodes(client clientset.Interface, req *FindFreePortsRequest) (*FindFreePortsResult, error) {
+	namedRanges, err := getNamedRanges(client)
+	if err != nil {
+		return nil, err
+	}
+	var rangeConfig *portRangeConfig
+	if req.RangeName != "" {
+		var ok bool
+		if rangeConfig, ok = namedRanges[req.RangeName]; !ok {
+			return nil, fmt.Errorf("port range %q not found", req.RangeName)
+		}
+	} else {
+		ranges, err := parsePortList(req.Range)
+		if err != nil {
+			return nil, err
+		}
+		if len(ranges) != 1 {
+			return nil, fmt.Errorf("invalid port range %q, exactly one range is required", req.Range)
+		}
+		rangx := ranges[0]
+		if !coveredByRanges(rangx, namedRanges) {
+			return nil, fmt.Errorf("port range %q is not scanned, it should be in the configured port ranges", req.Range)
+		}
+		rangeConfig = &portRangeConfig{Name: req.Range, Ranges: []rangePort{rangx}}
+	}
+	count := req.Count
+	if count <= 0 {
+		count = defaultCandidateCount
+	}
+
+	result := &FindFreePortsResult{NodeUpdateTimestamps: make(map[string]string)}
+	used := make(map[int]bool)
+	for _, node := range req.Nodes {
+		data, cm, err := readPortUsageData(client, getPortUsageConfigMapName(node))
+		if err != nil {
+			return nil, fmt.Errorf("get port usage of node %s failed: %v", node, err)
+		}
+		result.NodeUpdateTimestamps[node] = cm.Annotations["updateTimestamp"]
+		for key := range data {
+			if port, err := strconv.Atoi(key); err == nil {
+				used[port] = true
+			}
+		}
+	}
+
+	for _, port := range rangeConfig.allocatablePorts() {
+		if len(result.Ports) >= count {
+			break
+		}
+		// 被任一区间排除的端口不会被扫描，无法确认是否空闲
+		if !used[port] && !excludedByRanges(port, namedRanges) {
+			result.Ports = append(result.Ports, port)
+		}
+	}
+	return result, nil
+}
+
+// coveredByRanges 区间 [Start, End) 是否落在某个已配置的区间内
+func coveredByRanges(rangx rangePort, namedRanges map[string]*portRangeConfig) bool {
+	for _, c := range namedRanges {
+		for _, r := range c.Ranges {
+			if rangx.Start >= r.Start && rangx.End <= r.End {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// excludedByRanges 端口是否被某个已配置的区间排除
+func excludedByRanges(port int, namedRanges map[string]*portRangeConfig) bool {
+	for _, c := range namedRanges {
+		if portInRanges(port, c.Exclude) {
+			return true
+		}
+	}
+	return false
+}
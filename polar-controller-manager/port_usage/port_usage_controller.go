@@ -0,0 +1,148 @@
+/*
+*Copyright (c) 2019-2021, Alibaba Group Holding Limited;
+*Licensed under the Apache License, Version 2.0 (the "License");
+*you may not use this file except in compliance with the License.
+*You may obtain a copy of the License at
+
+*   http://www.apache.org/licenses/LICENSE-2.0
+
+*Unless required by applicable law or agreed to in writing, software
+*distributed under the License is distributed on an "AS IS" BASIS,
+*WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*See the License for the specific language governing permissions and
+*limitations under the License.
+ */
+
+package timer
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	config "github.com/ApsaraDB/PolarDB-Stack-Daemon/cmd/daemon/app/config"
+	"github.com/ApsaraDB/PolarDB-Stack-Daemon/polar-controller-manager/bizapis/context"
+	"github.com/ApsaraDB/PolarDB-Stack-Daemon/polar-controller-manager/errors"
+)
+
+// ReservePorts
+/**
+ * @Title:  ReservePorts
+ * @Description: 从指定名称的端口区间中预留空闲端口，预留在 TTL 到期或显式释放前不会再被分配
+ **/
+func ReservePorts(ctx *context.Context) {
+	var req ReservePortsRequest
+	if err := ctx.GetContext().ShouldBindJSON(&req); err != nil {
+		ctx.ResErr(errors.NewValidatorError(err))
+		return
+	}
+	result, err := reservePorts(config.Conf.Client, &req)
+	if err != nil {
+		ctx.Log.Errorf("failed to reserve %d ports in range %s for %s, err:%v", req.Count, req.RangeName, req.Owner, err)
+		ctx.ResErr(err)
+		return
+	}
+	ctx.ResSucData(result)
+}
+
+// ReleasePorts
+/**
+ * @Title:  ReleasePorts
+ * @Description: 释放预留的端口
+ **/
+func ReleasePorts(ctx *context.Context) {
+	var req ReleasePortsRequest
+	if err := ctx.GetContext().ShouldBindJSON(&req); err != nil {
+		ctx.ResErr(errors.NewValidatorError(err))
+		return
+	}
+	released, err := releasePorts(config.Conf.Client, &req)
+	if err != nil {
+		ctx.Log.Errorf("failed to release ports of reservation %s, err:%v", req.ReservationId, err)
+		ctx.ResErr(err)
+		return
+	}
+	ctx.ResSucData(released)
+}
+
+// GetPortReservations
+/**
+ * @Title:  GetPortReservations
+ * @Description: 获取本节点上未过期的端口预留
+ **/
+func GetPortReservations(ctx *context.Context) {
+	reservations, err := listPortReservations(config.Conf.Client)
+	if err != nil {
+		ctx.Log.Errorf("failed to list port reservations, err:%v", err)
+		ctx.ResErr(err)
+		return
+	}
+	ctx.ResSucData(reservations)
+}
+
+// FindFreePortsOnNodes
+/**
+ * @Title:  FindFreePortsOnNodes
+ * @Description: 查询在所有指定节点上均空闲的端口，用于共享存储集群中主节点与只读节点使用同一端口
+ **/
+func FindFreePortsOnNodes(ctx *context.Context) {
+	var req FindFreePortsRequest
+	if err := ctx.GetContext().ShouldBindJSON(&req); err != nil {
+		ctx.ResErr(errors.NewValidatorError(err))
+		return
+	}
+	if req.RangeName == "" && req.Range == "" {
+		ctx.ResErr(errors.NewNormalError("ParamInvalidErr", "rangeName or range is required"))
+		return
+	}
+	result, err := findFreePortsOnNodes(config.Conf.Client, &req)
+	if err != nil {
+		ctx.Log.Errorf("failed to find free ports on nodes %v, err:%v", req.Nodes, err)
+		ctx.ResErr(err)
+		return
+	}
+	ctx.ResSucData(result)
+}
+
+// ScanPorts
+/**
+ * @Title:  ScanPorts
+ * @Description: 立即扫描本节点端口并更新 configMap，返回已用端口，请求体可选
+ **/
+func ScanPorts(ctx *context.Context) {
+	var req ScanPortsRequest
+	if err := ctx.GetContext().ShouldBindJSON(&req); err != nil && err != io.EOF {
+		ctx.ResErr(errors.NewValidatorError(err))
+		return
+	}
+	result, err := scanPortsNow(&req)
+	if err != nil {
+		ctx.Log.Errorf("failed to scan ports in ranges %v, err:%v", req.Ranges, err)
+		ctx.ResErr(err)
+		return
+	}
+	ctx.ResSucData(result)
+}
+
+// GetPortUsageHistory
+/**
+ * @Title:  GetPortUsageHistory
+ * @Description: 查询本节点端口占用变更历史及频繁切换的端口，port 与 since 均可选
+ **/
+func GetPortUsageHistory(ctx *context.Context) {
+	var port int
+	if p := ctx.GetContext().Query("port"); p != "" {
+		var err error
+		if port, err = strconv.Atoi(p); err != nil || port < 1 || port > 65535 {
+			ctx.ResErr(errors.NewNormalError("ParamInvalidErr", fmt.Sprintf("invalid port %q", p)))
+			return
+		}
+	}
+	since, err := parseHistorySince(ctx.GetContext().Query("since"), time.Now())
+	if err != nil {
+		ctx.ResErr(errors.NewNormalError("ParamInvalidErr", err.Error()))
+		return
+	}
+	ctx.ResSucData(usageHistory.query(port, since))
+}
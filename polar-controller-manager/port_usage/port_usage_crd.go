@@ -0,0 +1,325 @@
+/*
+*Copyright (c) 2019-2021, Alibaba Group Holding Limited;
+*Licensed under the Apache License, Version 2.0 (the "License");
+*you may not use this file except in compliance with the License.
+*You may obtain a copy of the License at
+
+*   http://www.apache.org/licenses/LICENSE-2.0
+
+*Unless required by applicable law or agreed to in writing, software
+*distributed under the License is distributed on an "AS IS" BASIS,
+*WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*See the License for the specific language governing permissions and
+*limitations under the License.
+ */
+
+package timer
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"sort"
+	"time"
+
+	config "github.com/ApsaraDB/PolarDB-Stack-Daemon/cmd/daemon/app/config"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+)
+
+const (
+	nodePortUsageGroup   = "polarstack.polardb.aliyun.com"
+	nodePortUsageVersion = "v1"
+	nodePortUsageKind    = "NodePortUsage"
+
+	// status 中最多记录的端口数，超出部分只计入 UsedPortCount，完整数据以分片 configMap 为准
+	maxNodePortUsageEntries = 4096
+	// 每个端口在 status 中最多记录的占用方数，超出部分只计入 OwnerCount
+	maxNodePortUsageOwners = 8
+	// 端口占用没有变化时，status 的 lastScanTime、lastSeen 也至少按此间隔刷新一次
+	nodePortUsageResyncPeriod = 10 * time.Minute
+)
+
+// NodePortUsage 为集群级资源，每个节点一个，名称为节点名，CRD 定义见 deploy/nodeportusage-crd.yaml
+var nodePortUsageResource = schema.GroupVersionResource{
+	Group:    nodePortUsageGroup,
+	Version:  nodePortUsageVersion,
+	Resource: "nodeportusages",
+}
+
+// nodePortUsage
+/**
+ * @Title: 节点端口占用情况的 CustomResource
+ * @Description:
+ *
+ *	spec 仅记录节点名，status 由本节点的 daemon 在扫描后更新
+ *	status 只记录各端口的概要及最多 maxNodePortUsageOwners 个占用方的来源、pid、容器与 pod，
+ *	命令行、绑定地址等详细信息仍只写入分片的 configMap，以免端口较多时对象超出 etcd 的大小限制
+ **/
+type nodePortUsage struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   nodePortUsageSpec   `json:"spec,omitempty"`
+	Status nodePortUsageStatus `json:"status,omitempty"`
+}
+
+type nodePortUsageSpec struct {
+	NodeName string `json:"nodeName"`
+}
+
+type nodePortUsageStatus struct {
+	// 更新 status 时所见到的 metadata.generation
+	ObservedGeneration       int64       `json:"observedGeneration,omitempty"`
+	LastScanTime             metav1.Time `json:"lastScanTime,omitempty"`
+	ScanDurationMilliseconds int64       `json:"scanDurationMilliseconds"`
+	UsedPortCount            int         `json:"usedPortCount"`
+	// 已使用端口超过 maxNodePortUsageEntries 时为 true，Ports 中只有端口号最小的部分
+	Truncated bool             `json:"truncated,omitempty"`
+	Ports     []portUsageEntry `json:"ports,omitempty"`
+}
+
+// portUsageEntry
+/**
+ * @Title: 一个已使用端口的状态
+ * @Description:
+ *
+ *	FirstSeen 为端口连续被使用以来首次扫描到的时间，端口释放后再次被使用时重新计时
+ *	LastSeen 为最近一次写入 status 时扫描到的时间，占用有变化的扫描都会写入，
+ *	占用没有变化时最多滞后 nodePortUsageResyncPeriod
+ *	OwnerCount 为占用方的个数，Owners 只保留前 maxNodePortUsageOwners 个，完整信息见本节点的 port-usage configMap
+ **/
+type portUsageEntry struct {
+	Port          int                `json:"port"`
+	Protocol      string             `json:"protocol,omitempty"`
+	Sources       []string           `json:"sources,omitempty"`
+	OwnerCount    int                `json:"ownerCount,omitempty"`
+	Owners        []portOwnerSummary `json:"owners,omitempty"`
+	BindScopes    []string           `json:"bindScopes,omitempty"`
+	ClientNetwork bool               `json:"clientNetwork,omitempty"`
+	ReservationId string             `json:"reservationId,omitempty"`
+	WellKnown     bool               `json:"wellKnown,omitempty"`
+	FirstSeen     metav1.Time        `json:"firstSeen"`
+	LastSeen      metav1.Time        `json:"lastSeen"`
+}
+
+// portOwnerSummary NodePortUsage 中记录的占用方概要
+type portOwnerSummary struct {
+	Source       string `json:"source,omitempty"`
+	Pid          int    `json:"pid,omitempty"`
+	ContainerId  string `json:"containerId,omitempty"`
+	PodNamespace string `json:"podNamespace,omitempty"`
+	PodName      string `json:"podName,omitempty"`
+}
+
+// getCurrentNodeName 本节点名称，NodePortUsage 的名称与之一致
+func getCurrentNodeName() string {
+	if config.Conf != nil && config.Conf.CurrentNodeName != "" {
+		return config.Conf.CurrentNodeName
+	}
+	host, _ := os.Hostname()
+	return host
+}
+
+// updateNodePortUsage
+/**
+ * @Title: 将本次扫描结果写入本节点的 NodePortUsage status
+ * @Description:
+ *
+ *	对象不存在时创建，并以节点作为 owner，节点删除时一并回收
+ *	FirstSeen 记录在 firstSeen 中，不受 status 截断的影响；本次扫描到的端口 LastSeen 均更新为扫描时间
+ *	除扫描时间外没有变化且距上次写入不足 nodePortUsageResyncPeriod 时不更新，避免每次扫描都写 apiserver
+ **/
+func updateNodePortUsage(client clientset.Interface, dynamicClient dynamic.Interface, portUsages map[int]*portUsage,
+	firstSeen map[int]metav1.Time, scanTime time.Time, scanDuration time.Duration) error {
+	name := getCurrentNodeName()
+	resource := dynamicClient.Resource(nodePortUsageResource)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		obj, err := resource.Get(name, metav1.GetOptions{})
+		if err != nil && apierrors.IsNotFound(err) {
+			obj, err = toUnstructured(newNodePortUsage(client, name))
+			if err != nil {
+				return err
+			}
+			obj, err = resource.Create(obj, metav1.CreateOptions{})
+		}
+		if err != nil {
+			return err
+		}
+
+		usage := &nodePortUsage{}
+		if err := fromUnstructured(obj, usage); err != nil {
+			return err
+		}
+		status := buildNodePortUsageStatus(usage.Status, portUsages, firstSeen, scanTime, scanDuration)
+		status.ObservedGeneration = usage.Generation
+		if !nodePortUsageStatusChanged(usage.Status, status) &&
+			scanTime.Sub(usage.Status.LastScanTime.Time) < nodePortUsageResyncPeriod {
+			return nil
+		}
+		usage.Status = status
+
+		if obj, err = toUnstructured(usage); err != nil {
+			return err
+		}
+		_, err = resource.UpdateStatus(obj, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// newNodePortUsage 新建本节点的 NodePortUsage，获取节点失败时不设置 owner
+func newNodePortUsage(client clientset.Interface, name string) *nodePortUsage {
+	usage := &nodePortUsage{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: nodePortUsageResource.GroupVersion().String(),
+			Kind:       nodePortUsageKind,
+		},
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       nodePortUsageSpec{NodeName: name},
+	}
+	node, err := client.CoreV1().Nodes().Get(name, metav1.GetOptions{})
+	if err != nil {
+		klog.Warningf("[timer port usage] get node %s failed, create NodePortUsage without owner: %v", name, err)
+		return usage
+	}
+	usage.OwnerReferences = []metav1.OwnerReference{{
+		APIVersion: "v1",
+		Kind:       "Node",
+		Name:       node.Name,
+		UID:        node.UID,
+	}}
+	return usage
+}
+
+// buildNodePortUsageStatus
+/**
+ * @Title: 根据上次的 status 与本次扫描结果生成新的 status
+ * @Description:
+ *
+ *	firstSeen 记录所有已使用端口（包括因截断未写入 status 的端口）首次扫描到的时间，
+ *	由调用方在多次扫描间保留；上次 status 中的时间用于重启后恢复，端口释放后从 firstSeen 中移除
+ **/
+func buildNodePortUsageStatus(old nodePortUsageStatus, portUsages map[int]*portUsage, firstSeen map[int]metav1.Time,
+	scanTime time.Time, scanDuration time.Duration) nodePortUsageStatus {
+	now := metav1.NewTime(scanTime)
+	for _, entry := range old.Ports {
+		if _, ok := firstSeen[entry.Port]; !ok && !entry.FirstSeen.IsZero() {
+			firstSeen[entry.Port] = entry.FirstSeen
+		}
+	}
+	for port := range firstSeen {
+		if _, ok := portUsages[port]; !ok {
+			delete(firstSeen, port)
+		}
+	}
+	for port := range portUsages {
+		if _, ok := firstSeen[port]; !ok {
+			firstSeen[port] = now
+		}
+	}
+
+	status := nodePortUsageStatus{
+		ObservedGeneration:       old.ObservedGeneration,
+		LastScanTime:             now,
+		ScanDurationMilliseconds: int64(scanDuration / time.Millisecond),
+	}
+	ports := make([]int, 0, len(portUsages))
+	for port := range portUsages {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+	status.UsedPortCount = len(ports)
+	if len(ports) > maxNodePortUsageEntries {
+		ports = ports[:maxNodePortUsageEntries]
+		status.Truncated = true
+	}
+	for _, port := range ports {
+		usage := portUsages[port]
+		entry := portUsageEntry{
+			Port:          port,
+			Protocol:      usage.Protocol,
+			Sources:       usage.Sources,
+			OwnerCount:    len(usage.Owners),
+			Owners:        summarizeOwners(usage.Owners),
+			BindScopes:    usage.BindScopes,
+			ClientNetwork: usage.ClientNetwork,
+			WellKnown:     usage.WellKnown,
+			FirstSeen:     firstSeen[port],
+			LastSeen:      now,
+		}
+		if usage.Reservation != nil {
+			entry.ReservationId = usage.Reservation.ReservationId
+		}
+		status.Ports = append(status.Ports, entry)
+	}
+	return status
+}
+
+// summarizeOwners 取占用方的来源、pid、容器与 pod，相同的概要只保留一个，最多 maxNodePortUsageOwners 个
+func summarizeOwners(owners []portOwner) []portOwnerSummary {
+	var summaries []portOwnerSummary
+	seen := make(map[portOwnerSummary]bool)
+	for _, owner := range owners {
+		summary := portOwnerSummary{
+			Source:       owner.Source,
+			Pid:          owner.Pid,
+			ContainerId:  owner.ContainerId,
+			PodNamespace: owner.PodNamespace,
+			PodName:      owner.PodName,
+		}
+		if seen[summary] {
+			continue
+		}
+		seen[summary] = true
+		summaries = append(summaries, summary)
+		if len(summaries) >= maxNodePortUsageOwners {
+			break
+		}
+	}
+	return summaries
+}
+
+// nodePortUsageStatusChanged 忽略扫描时间、扫描耗时与 LastSeen 后比较两次的 status
+func nodePortUsageStatusChanged(old, status nodePortUsageStatus) bool {
+	a, errA := json.Marshal(withoutScanTime(old))
+	b, errB := json.Marshal(withoutScanTime(status))
+	return errA != nil || errB != nil || !bytes.Equal(a, b)
+}
+
+func withoutScanTime(status nodePortUsageStatus) nodePortUsageStatus {
+	status.LastScanTime = metav1.Time{}
+	status.ScanDurationMilliseconds = 0
+	ports := make([]portUsageEntry, len(status.Ports))
+	for i, entry := range status.Ports {
+		entry.LastSeen = metav1.Time{}
+		ports[i] = entry
+	}
+	status.Ports = ports
+	return status
+}
+
+func toUnstructured(usage *nodePortUsage) (*unstructured.Unstructured, error) {
+	b, err := json.Marshal(usage)
+	if err != nil {
+		return nil, err
+	}
+	obj := &unstructured.Unstructured{}
+	if err := obj.UnmarshalJSON(b); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+func fromUnstructured(obj *unstructured.Unstructured, usage *nodePortUsage) error {
+	b, err := obj.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, usage)
+}
@@ -0,0 +1,192 @@
+/*
+*Copyright (c) 2019-2021, Alibaba Group Holding Limited;
+*Licensed under the Apache License, Version 2.0 (the "License");
+*you may not use this file except in compliance with the License.
+*You may obtain a copy of the License at
+
+*   http://www.apache.org/licenses/LICENSE-2.0
+
+*Unless required by applicable law or agreed to in writing, software
+*distributed under the License is distributed on an "AS IS" BASIS,
+*WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*See the License for the specific language governing permissions and
+*limitations under the License.
+ */
+
+package timer
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 本地保留的端口占用变更记录条数上限，超出时丢弃最早的记录
+const maxPortUsageHistory = 10000
+
+// 端口占用变更类型
+const (
+	portChangeAdd    = "add"    // 端口开始被使用
+	portChangeRemove = "remove" // 端口被释放
+	portChangeUpdate = "update" // 端口仍被使用，占用信息变化
+)
+
+// portUsageChange
+/**
+ * @Title: 一次端口占用变更
+ * @Description:
+ *
+ *	Value 为变更后 configMap 中该端口的值，remove 时为变更前的值，便于查看释放前的占用方
+ **/
+type portUsageChange struct {
+	Time   time.Time `json:"time"`
+	Port   int       `json:"port"`
+	Action string    `json:"action"`
+	Value  string    `json:"value"`
+}
+
+// portFlap 端口在已用与空闲之间切换的统计
+type portFlap struct {
+	Port        int `json:"port"`
+	Transitions int `json:"transitions"`
+	Adds        int `json:"adds"`
+	Removes     int `json:"removes"`
+}
+
+// PortUsageHistoryResult 端口占用历史查询结果
+// Flaps 为在已用与空闲之间来回切换（至少两次）的端口，按切换次数从多到少排列
+type PortUsageHistoryResult struct {
+	OldestTime  *time.Time        `json:"oldestTime,omitempty"`
+	Changes     []portUsageChange `json:"changes"`
+	Flaps       []portFlap        `json:"flaps"`
+	FlapPortNum int               `json:"flapPortNum"`
+}
+
+// portUsageHistory
+/**
+ * @Title: 本地的端口占用变更历史
+ * @Description:
+ *
+ *	仅保存在内存中，daemon 重启后清空，条数上限为 maxPortUsageHistory
+ **/
+type portUsageHistory struct {
+	mu      sync.RWMutex
+	changes []portUsageChange
+}
+
+var usageHistory = &portUsageHistory{}
+
+// record 追加变更记录，超出上限时丢弃最早的记录
+func (h *portUsageHistory) record(changes []portUsageChange) {
+	if len(changes) == 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.changes = append(h.changes, changes...)
+	if n := len(h.changes) - maxPortUsageHistory; n > 0 {
+		h.changes = append([]portUsageChange(nil), h.changes[n:]...)
+	}
+}
+
+// query
+/**
+ * @Title: 查询端口占用变更历史
+ * @Description:
+ *
+ *	port 为 0 时查询所有端口，since 为零值时不限制起始时间
+ **/
+func (h *portUsageHistory) query(port int, since time.Time) *PortUsageHistoryResult {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	result := &PortUsageHistoryResult{Changes: []portUsageChange{}, Flaps: []portFlap{}}
+	if len(h.changes) > 0 {
+		oldest := h.changes[0].Time
+		result.OldestTime = &oldest
+	}
+	flaps := make(map[int]*portFlap)
+	for _, change := range h.changes {
+		if (port != 0 && change.Port != port) || change.Time.Before(since) {
+			continue
+		}
+		result.Changes = append(result.Changes, change)
+
+		flap, ok := flaps[change.Port]
+		if !ok {
+			flap = &portFlap{Port: change.Port}
+			flaps[change.Port] = flap
+		}
+		switch change.Action {
+		case portChangeAdd:
+			flap.Adds++
+			flap.Transitions++
+		case portChangeRemove:
+			flap.Removes++
+			flap.Transitions++
+		}
+	}
+	for _, flap := range flaps {
+		if flap.Transitions >= 2 {
+			result.Flaps = append(result.Flaps, *flap)
+		}
+	}
+	sort.Slice(result.Flaps, func(i, j int) bool {
+		if result.Flaps[i].Transitions != result.Flaps[j].Transitions {
+			return result.Flaps[i].Transitions > result.Flaps[j].Transitions
+		}
+		return result.Flaps[i].Port < result.Flaps[j].Port
+	})
+	result.FlapPortNum = len(result.Flaps)
+	return result
+}
+
+// diffPortUsageData
+/**
+ * @Title: 比较 port-usage configMap 新旧内容，返回按端口排序的变更
+ **/
+func diffPortUsageData(oldData, newData map[string]string, now time.Time) []portUsageChange {
+	var changes []portUsageChange
+	for key, value := range oldData {
+		if _, ok := newData[key]; !ok {
+			if port, err := strconv.Atoi(key); err == nil {
+				changes = append(changes, portUsageChange{Time: now, Port: port, Action: portChangeRemove, Value: value})
+			}
+		}
+	}
+	for key, value := range newData {
+		port, err := strconv.Atoi(key)
+		if err != nil {
+			continue
+		}
+		if data, ok := oldData[key]; !ok {
+			changes = append(changes, portUsageChange{Time: now, Port: port, Action: portChangeAdd, Value: value})
+		} else if data != value {
+			changes = append(changes, portUsageChange{Time: now, Port: port, Action: portChangeUpdate, Value: value})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Port < changes[j].Port })
+	return changes
+}
+
+// parseHistorySince
+/**
+ * @Title: 解析查询参数 since
+ * @Description:
+ *
+ *	可为 RFC3339 时间，如 2021-09-01T08:00:00Z，或距当前的时长，如 1h、30m
+ **/
+func parseHistorySince(since string, now time.Time) (time.Time, error) {
+	if since == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, since); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(since); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid since %q, it should be RFC3339 time or duration such as 1h", since)
+}
@@ -0,0 +1,286 @@
+/*
+*Copyright (c) 2019-2021, Alibaba Group Holding Limited;
+*Licensed under the Apache License, Version 2.0 (the "License");
+*you may not use this file except in compliance with the License.
+*You may obtain a copy of the License at
+
+*   http://www.apache.org/licenses/LICENSE-2.0
+
+*Unless required by applicable law or agreed to in writing, software
+*distributed under the License is distributed on an "AS IS" BASIS,
+*WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*See the License for the specific language governing permissions and
+*limitations under the License.
+ */
+
+package timer
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	config "github.com/ApsaraDB/PolarDB-Stack-Daemon/cmd/daemon/app/config"
+	v1 "k8s.io/api/core/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+// 端口占用信息的来源
+const (
+	portSourceHost     = "host"     // 主机网络命名空间的 socket 表
+	portSourceNetns    = "netns"    // 容器网络命名空间的 socket 表，仅作为占用者信息，不单独计为占用
+	portSourceHostPort = "hostPort" // pod 声明的 hostPort 映射
+	portSourceDnat     = "dnat"     // iptables nat 表中的 DNAT 规则
+)
+
+// hostPort 映射及 DNAT 规则没有对应的 socket，以此状态标识
+const (
+	hostPortState = "HOSTPORT"
+	dnatState     = "DNAT"
+)
+
+// 列出 nat 表规则的命令，ipv6 的规则不存在或命令不存在时跳过
+var natRuleCommands = [][]string{
+	{"iptables", "-t", "nat", "-S"},
+	{"ip6tables", "-t", "nat", "-S"},
+}
+
+// scanContainerSockets
+/**
+ * @Title: 获取容器网络命名空间中的 socket 及本节点 pod 的 hostPort 映射
+ * @Description:
+ *
+ *	非 hostNetwork 的 pod 有独立的网络命名空间，主机 socket 表中看不到，
+ *	但仍可能通过 hostPort 或 iptables DNAT 与主机端口冲突
+ *	容器网络命名空间中的 socket 只说明端口在容器内被监听，由 scanPortRanges 附加到已占用的端口上
+ *	任意一部分失败时仅记录日志，返回其余部分
+ **/
+func scanContainerSockets() []portSocket {
+	sockets, err := readContainerNetnsSockets(procDir)
+	if err != nil {
+		klog.Errorf("scanContainerSockets read container netns sockets error: %v", err)
+	}
+
+	var client clientset.Interface
+	if config.Conf.Client != nil {
+		client = config.Conf.Client
+	}
+	pods, err := listNodePods(client)
+	if err != nil {
+		klog.Errorf("scanContainerSockets list pods on node %s error: %v", config.Conf.CurrentNodeName, err)
+	}
+	sockets = append(sockets, podHostPortSockets(pods)...)
+	return append(sockets, readDnatSockets()...)
+}
+
+// readDnatSockets 执行 natRuleCommands 并解析其中的 DNAT 规则，命令失败时仅记录日志
+func readDnatSockets() []portSocket {
+	var sockets []portSocket
+	for _, command := range natRuleCommands {
+		var stderr bytes.Buffer
+		cmd := exec.Command(command[0], command[1:]...)
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			klog.Warningf("readDnatSockets run %s error: %v, %s", strings.Join(command, " "), err, strings.TrimSpace(stderr.String()))
+			continue
+		}
+		sockets = append(sockets, parseDnatRules(bytes.NewReader(out))...)
+	}
+	return sockets
+}
+
+// parseDnatRules
+/**
+ * @Title: 解析 iptables -t nat -S 输出中的 DNAT 规则
+ * @Description:
+ *
+ *	只处理带 -j DNAT 且指定了 --dport/--dports 的规则，如 CNI portmap 为 hostPort 生成的
+ *	-A CNI-DN-xxx -p tcp -m tcp --dport 5500 -j DNAT --to-destination 10.244.1.5:80
+ *	目的端口即主机上被占用的端口，-d 为单个地址时作为绑定地址，取反（!）的条件跳过
+ **/
+func parseDnatRules(r io.Reader) []portSocket {
+	var sockets []portSocket
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0] != "-A" {
+			continue
+		}
+		var protocol, ports string
+		var localIP net.IP
+		dnat := false
+		for i := 0; i < len(fields)-1; i++ {
+			if fields[i] == "!" {
+				// 取反的条件不能确定占用的端口
+				i++
+				continue
+			}
+			switch fields[i] {
+			case "-p", "--protocol":
+				protocol = strings.ToLower(fields[i+1])
+			case "-d", "--destination":
+				localIP = net.ParseIP(strings.TrimSuffix(strings.TrimSuffix(fields[i+1], "/32"), "/128"))
+			case "--dport", "--dports", "--destination-port", "--destination-ports":
+				ports = fields[i+1]
+			case "-j":
+				dnat = fields[i+1] == "DNAT"
+			}
+		}
+		if !dnat || ports == "" || (protocol != protocolTCP && protocol != protocolUDP) {
+			continue
+		}
+		for _, rangx := range parseDnatPorts(ports) {
+			for port := rangx.Start; port < rangx.End; port++ {
+				sockets = append(sockets, portSocket{
+					Protocol: protocol,
+					LocalIP:  localIP,
+					Port:     port,
+					State:    dnatState,
+					Source:   portSourceDnat,
+				})
+			}
+		}
+	}
+	return sockets
+}
+
+// parseDnatPorts 解析 iptables 的端口写法：单个端口、a:b 区间，multiport 以逗号分隔，无法解析的部分跳过
+func parseDnatPorts(ports string) []rangePort {
+	var result []rangePort
+	for _, item := range strings.Split(ports, ",") {
+		bounds := strings.SplitN(item, ":", 2)
+		start, err := strconv.Atoi(bounds[0])
+		if err != nil || start <= 0 || start > 65535 {
+			continue
+		}
+		end := start
+		if len(bounds) == 2 {
+			end, err = strconv.Atoi(bounds[1])
+			if err != nil || end < start || end > 65535 {
+				continue
+			}
+		}
+		result = append(result, rangePort{Start: start, End: end + 1})
+	}
+	return result
+}
+
+// readContainerNetnsSockets
+/**
+ * @Title: 读取主机以外各网络命名空间的 socket 表
+ * @Description:
+ *
+ *	由 /proc/<pid>/ns/net 的链接目标（如 net:[4026532512]）区分网络命名空间，与 1 号进程相同的为主机网络
+ *	每个网络命名空间取 pid 最小的进程，读取其 /proc/<pid>/net 下的 socket 表
+ **/
+func readContainerNetnsSockets(procDir string) ([]portSocket, error) {
+	hostNetns, err := os.Readlink(filepath.Join(procDir, "1", "ns", "net"))
+	if err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(procDir)
+	if err != nil {
+		return nil, err
+	}
+
+	netnsPids := make(map[string]int)
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		netns, err := os.Readlink(filepath.Join(procDir, entry.Name(), "ns", "net"))
+		if err != nil || netns == hostNetns {
+			// 进程已退出或无权限，跳过
+			continue
+		}
+		if old, ok := netnsPids[netns]; !ok || pid < old {
+			netnsPids[netns] = pid
+		}
+	}
+
+	var netnsList []string
+	for netns := range netnsPids {
+		netnsList = append(netnsList, netns)
+	}
+	sort.Strings(netnsList)
+
+	var sockets []portSocket
+	for _, netns := range netnsList {
+		pid := netnsPids[netns]
+		dir := filepath.Join(procDir, strconv.Itoa(pid), "net")
+		entries, err := readSocketTables(dir, protocolTCP, protocolTCP6, protocolUDP, protocolUDP6)
+		if err != nil {
+			klog.Warningf("readContainerNetnsSockets read socket tables of %s from %s error: %v", netns, dir, err)
+			continue
+		}
+		for i := range entries {
+			entries[i].Source = portSourceNetns
+			entries[i].NetNs = netns
+		}
+		sockets = append(sockets, entries...)
+	}
+	return sockets, nil
+}
+
+// podHostPortSockets
+/**
+ * @Title: 将 pod 声明的 hostPort 转换为占用记录
+ * @Description:
+ *
+ *	hostNetwork 的 pod 直接监听主机端口，已包含在主机 socket 表中，跳过
+ *	已结束的 pod 不再占用端口，跳过
+ **/
+func podHostPortSockets(pods []v1.Pod) []portSocket {
+	var sockets []portSocket
+	for _, pod := range pods {
+		if pod.Spec.HostNetwork || pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		ref := &podRef{Name: pod.Name, Namespace: pod.Namespace}
+		for _, container := range pod.Spec.Containers {
+			for _, port := range container.Ports {
+				if port.HostPort == 0 {
+					continue
+				}
+				protocol := strings.ToLower(string(port.Protocol))
+				if protocol == "" {
+					protocol = protocolTCP
+				}
+				sockets = append(sockets, portSocket{
+					Protocol: protocol,
+					LocalIP:  net.ParseIP(port.HostIP),
+					Port:     int(port.HostPort),
+					State:    hostPortState,
+					Source:   portSourceHostPort,
+					Pod:      ref,
+				})
+			}
+		}
+	}
+	return sockets
+}
+
+// portSources 汇总端口占用信息的来源，按名称排序
+func portSources(owners []portOwner) []string {
+	var sources []string
+	seen := make(map[string]bool)
+	for _, owner := range owners {
+		if owner.Source != "" && !seen[owner.Source] {
+			seen[owner.Source] = true
+			sources = append(sources, owner.Source)
+		}
+	}
+	sort.Strings(sources)
+	return sources
+}
@@ -0,0 +1,322 @@
+/*
+*Copyright (c) 2019-2021, Alibaba Group Holding Limited;
+*Licensed under the Apache License, Version 2.0 (the "License");
+*you may not use this file except in compliance with the License.
+*You may obtain a copy of the License at
+
+*   http://www.apache.org/licenses/LICENSE-2.0
+
+*Unless required by applicable law or agreed to in writing, software
+*distributed under the License is distributed on an "AS IS" BASIS,
+*WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*See the License for the specific language governing permissions and
+*limitations under the License.
+ */
+
+package timer
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	config "github.com/ApsaraDB/PolarDB-Stack-Daemon/cmd/daemon/app/config"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+// 主机 proc 目录，daemon 以 hostPID 运行，可看到主机上所有进程
+var procDir = "/proc"
+
+// cmdline 过长时截断，避免撑大 configMap
+const maxCmdlineLength = 256
+
+// cgroup 路径中的容器 id：docker-<id>.scope、/docker/<id>、cri-containerd-<id>.scope、crio-<id>.scope、/kubepods/.../<id>
+var containerIdRegexp = regexp.MustCompile(`([0-9a-f]{64})(\.scope)?$`)
+
+// portOwner
+/**
+ * @Title: 占用端口的一个 socket 及其所属的进程、容器、pod
+ **/
+type portOwner struct {
+	Source       string `json:"source,omitempty"`
+	NetNs        string `json:"netNs,omitempty"`
+	Protocol     string `json:"protocol"`
+	State        string `json:"state"`
+	BindAddress  string `json:"bindAddress,omitempty"`
+	BindScope    string `json:"bindScope,omitempty"`
+	Pid          int    `json:"pid,omitempty"`
+	Cmdline      string `json:"cmdline,omitempty"`
+	ContainerId  string `json:"containerId,omitempty"`
+	PodName      string `json:"podName,omitempty"`
+	PodNamespace string `json:"podNamespace,omitempty"`
+}
+
+// portUsage
+/**
+ * @Title: 端口占用信息，以 json 格式作为 port-usage configMap 中端口的 value
+ * @Description:
+ *
+ *	端口被预留时带上预留信息，为知名端口时 WellKnown 为 true，
+ *	仅被预留或仅为知名端口而未被占用的端口没有 Protocol 与 Owners
+ *	BindScopes 为各 socket 绑定地址的类别，ClientNetwork 表示端口在客户网络上被占用，
+ *	仅绑定在 loopback 或其它网卡上的端口 ClientNetwork 为 false
+ *	Sources 为占用信息的来源：host、netns、hostPort、dnat，见 port_usage_netns.go
+ **/
+type portUsage struct {
+	Protocol      string           `json:"protocol,omitempty"`
+	Sources       []string         `json:"sources,omitempty"`
+	Owners        []portOwner      `json:"owners,omitempty"`
+	BindScopes    []string         `json:"bindScopes,omitempty"`
+	ClientNetwork bool             `json:"clientNetwork,omitempty"`
+	Reservation   *portReservation `json:"reservation,omitempty"`
+	WellKnown     bool             `json:"wellKnown,omitempty"`
+}
+
+type podRef struct {
+	Name      string
+	Namespace string
+}
+
+// buildPortUsage
+/**
+ * @Title: 将端口上的 socket 归属到进程、容器、pod
+ * @Description:
+ *
+ *	通过 socket inode 在 /proc/<pid>/fd 中找到进程，
+ *	再由 /proc/<pid>/cgroup 得到容器 id，最后匹配本节点上的 pod
+ *	同时按本节点客户网卡 ip 判断各 socket 绑定地址的类别
+ *	任意一步失败时保留已得到的信息，不影响端口占用的结论
+ *	端口只归属到监听或已 bind 的 socket，accept 得到的连接与监听 socket 同端口，不单独计为占用方
+ **/
+func buildPortUsage(client clientset.Interface, portSockets map[int][]portSocket) map[int]*portUsage {
+	portSockets = occupiedSockets(portSockets)
+	inodes := make(map[uint64]bool)
+	for _, sockets := range portSockets {
+		for _, socket := range sockets {
+			if socket.Inode != 0 {
+				inodes[socket.Inode] = true
+			}
+		}
+	}
+	inodePids := findSocketPids(procDir, inodes)
+
+	pidContainers := make(map[int]string)
+	for _, pid := range inodePids {
+		if _, ok := pidContainers[pid]; ok {
+			continue
+		}
+		pidContainers[pid] = readContainerId(procDir, pid)
+	}
+	containerPods := getNodeContainerPods(client)
+	clientIP := getNodeClientIP(client)
+
+	usages := make(map[int]*portUsage)
+	for port, sockets := range portSockets {
+		usage := &portUsage{Protocol: portProtocols(sockets)}
+		for _, socket := range sockets {
+			owner := portOwner{
+				Source:    socket.Source,
+				NetNs:     socket.NetNs,
+				Protocol:  socket.Protocol,
+				State:     socket.State,
+				BindScope: bindScope(socket.LocalIP, clientIP),
+			}
+			if socket.LocalIP != nil {
+				owner.BindAddress = socket.LocalIP.String()
+			}
+			if socket.Pod != nil {
+				owner.PodName = socket.Pod.Name
+				owner.PodNamespace = socket.Pod.Namespace
+			}
+			if pid, ok := inodePids[socket.Inode]; ok {
+				owner.Pid = pid
+				owner.Cmdline = readCmdline(procDir, pid)
+				owner.ContainerId = pidContainers[pid]
+				if pod, ok := containerPods[owner.ContainerId]; ok {
+					owner.PodName = pod.Name
+					owner.PodNamespace = pod.Namespace
+				}
+			}
+			if !containsOwner(usage.Owners, owner) {
+				usage.Owners = append(usage.Owners, owner)
+			}
+		}
+		usage.Sources = portSources(usage.Owners)
+		usage.BindScopes = bindScopes(usage.Owners)
+		usage.ClientNetwork = onClientNetwork(usage.BindScopes)
+		usages[port] = usage
+	}
+	return usages
+}
+
+func (u *portUsage) String() string {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return u.Protocol
+	}
+	return string(b)
+}
+
+// occupiedSockets 只保留各端口上计为占用的 socket
+func occupiedSockets(portSockets map[int][]portSocket) map[int][]portSocket {
+	result := make(map[int][]portSocket, len(portSockets))
+	for port, sockets := range portSockets {
+		for _, socket := range sockets {
+			if socket.occupied() {
+				result[port] = append(result[port], socket)
+			}
+		}
+	}
+	return result
+}
+
+func containsOwner(owners []portOwner, owner portOwner) bool {
+	for _, o := range owners {
+		if o == owner {
+			return true
+		}
+	}
+	return false
+}
+
+// findSocketPids
+/**
+ * @Title: 通过 /proc/<pid>/fd 查找 socket inode 所属进程
+ * @Description:
+ *
+ *	fd 的链接目标形如 socket:[12345]，同一 socket 被多个进程共享时（如 fork 出的 worker）取 pid 最小者
+ **/
+func findSocketPids(procDir string, inodes map[uint64]bool) map[uint64]int {
+	inodePids := make(map[uint64]int)
+	if len(inodes) == 0 {
+		return inodePids
+	}
+	entries, err := ioutil.ReadDir(procDir)
+	if err != nil {
+		klog.Errorf("findSocketPids read %s error: %v", procDir, err)
+		return inodePids
+	}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		fdDir := filepath.Join(procDir, entry.Name(), "fd")
+		fds, err := ioutil.ReadDir(fdDir)
+		if err != nil {
+			// 进程已退出或无权限，跳过
+			continue
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+			inode, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]"), 10, 64)
+			if err != nil || !inodes[inode] {
+				continue
+			}
+			if old, ok := inodePids[inode]; !ok || pid < old {
+				inodePids[inode] = pid
+			}
+		}
+	}
+	return inodePids
+}
+
+// readCmdline 读取进程命令行，参数以空格连接
+func readCmdline(procDir string, pid int) string {
+	b, err := ioutil.ReadFile(filepath.Join(procDir, strconv.Itoa(pid), "cmdline"))
+	if err != nil {
+		return ""
+	}
+	cmdline := strings.TrimSpace(strings.Replace(string(b), "\x00", " ", -1))
+	if len(cmdline) > maxCmdlineLength {
+		cmdline = cmdline[:maxCmdlineLength] + "..."
+	}
+	return cmdline
+}
+
+// readContainerId
+/**
+ * @Title: 从 /proc/<pid>/cgroup 中解析容器 id
+ * @Description:
+ *
+ *	兼容 cgroupfs 与 systemd 两种 cgroup driver，主机进程返回空
+ **/
+func readContainerId(procDir string, pid int) string {
+	f, err := os.Open(filepath.Join(procDir, strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// hierarchy-ID:controller-list:cgroup-path
+		parts := strings.SplitN(scanner.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if id := parseContainerId(parts[2]); id != "" {
+			return id
+		}
+	}
+	return ""
+}
+
+func parseContainerId(cgroupPath string) string {
+	match := containerIdRegexp.FindStringSubmatch(cgroupPath)
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
+
+// getNodeContainerPods
+/**
+ * @Title: 获取本节点上容器 id 与 pod 的对应关系
+ **/
+func getNodeContainerPods(client clientset.Interface) map[string]podRef {
+	containerPods := make(map[string]podRef)
+	pods, err := listNodePods(client)
+	if err != nil {
+		klog.Errorf("getNodeContainerPods list pods on node %s error: %v", config.Conf.CurrentNodeName, err)
+		return containerPods
+	}
+	for _, pod := range pods {
+		ref := podRef{Name: pod.Name, Namespace: pod.Namespace}
+		var statuses []v1.ContainerStatus
+		statuses = append(statuses, pod.Status.InitContainerStatuses...)
+		statuses = append(statuses, pod.Status.ContainerStatuses...)
+		for _, status := range statuses {
+			// containerID 形如 docker://<id>、containerd://<id>
+			if idx := strings.Index(status.ContainerID, "://"); idx >= 0 {
+				containerPods[status.ContainerID[idx+3:]] = ref
+			}
+		}
+	}
+	return containerPods
+}
+
+// listNodePods 获取调度到本节点上的 pod，未配置节点名时返回空
+func listNodePods(client clientset.Interface) ([]v1.Pod, error) {
+	if client == nil || config.Conf == nil || config.Conf.CurrentNodeName == "" {
+		return nil, nil
+	}
+	pods, err := client.CoreV1().Pods("").List(metav1.ListOptions{
+		FieldSelector: fmt.Sprintf("spec.nodeName=%s", config.Conf.CurrentNodeName),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pods.Items, nil
+}
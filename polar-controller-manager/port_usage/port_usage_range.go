@@ -0,0 +1,293 @@
+/*
+*Copyright (c) 2019-2021, Alibaba Group Holding Limited;
+*Licensed under the Apache License, Version 2.0 (the "License");
+*you may not use this file except in compliance with the License.
+*You may obtain a copy of the License at
+
+*   http://www.apache.org/licenses/LICENSE-2.0
+
+*Unless required by applicable law or agreed to in writing, software
+*distributed under the License is distributed on an "AS IS" BASIS,
+*WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*See the License for the specific language governing permissions and
+*limitations under the License.
+ */
+
+package timer
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	config "github.com/ApsaraDB/PolarDB-Stack-Daemon/cmd/daemon/app/config"
+	"github.com/ApsaraDB/PolarDB-Stack-Daemon/polar-controller-manager/util"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+	"sigs.k8s.io/yaml"
+)
+
+// 端口区间配置错误时上报的事件原因
+const eventReasonInvalidPortRange = "InvalidPortRange"
+
+// portList
+/**
+ * @Title: 逗号分隔的端口列表，如 "5400-5800,6000"
+ * @Description:
+ *
+ *	yaml 中单个端口会被解析为数字，这里同时接受字符串与数字
+ **/
+type portList string
+
+func (l *portList) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*l = portList(s)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(b, &n); err != nil {
+		return fmt.Errorf("port list should be a string like \"5400-5800,6000\", got %s", string(b))
+	}
+	*l = portList(n.String())
+	return nil
+}
+
+// portRangeSpec
+/**
+ * @Title: 端口区间配置 configMap 中一个命名区间的内容
+ * @Description:
+ *
+ *	data 的 key 为区间名称，value 为 yaml 或 json，如：
+ *	  ports: 5400-5800,15400-15800
+ *	  exclude: 5432,5500-5510
+ *	  wellKnown: 5433
+ *	  protocol: tcp
+ *	ports 必填；exclude 中的端口不扫描也不分配；wellKnown 中的端口始终视为已使用；
+ *	protocol 可为 tcp、udp，为空时同时检查 tcp 与 udp
+ **/
+type portRangeSpec struct {
+	Ports     portList `json:"ports"`
+	Exclude   portList `json:"exclude,omitempty"`
+	WellKnown portList `json:"wellKnown,omitempty"`
+	Protocol  string   `json:"protocol,omitempty"`
+}
+
+// portRangeConfig
+/**
+ * @Title: 解析后的命名端口区间，各 rangePort 均为 [Start, End)
+ **/
+type portRangeConfig struct {
+	Name      string
+	Protocol  string
+	Ranges    []rangePort
+	Exclude   []rangePort
+	WellKnown []rangePort
+}
+
+// contains 端口是否属于该区间且未被排除
+func (c *portRangeConfig) contains(port int) bool {
+	return portInRanges(port, c.Ranges) && !portInRanges(port, c.Exclude)
+}
+
+// isWellKnown 端口是否为该区间中的知名端口
+func (c *portRangeConfig) isWellKnown(port int) bool {
+	return c.contains(port) && portInRanges(port, c.WellKnown)
+}
+
+// allocatablePorts 区间中可分配的端口：未被排除且不是知名端口，按从小到大排列
+func (c *portRangeConfig) allocatablePorts() []int {
+	var ports []int
+	seen := make(map[int]bool)
+	for _, r := range c.Ranges {
+		for port := r.Start; port < r.End; port++ {
+			if !seen[port] && c.contains(port) && !c.isWellKnown(port) {
+				seen[port] = true
+				ports = append(ports, port)
+			}
+		}
+	}
+	sort.Ints(ports)
+	return ports
+}
+
+// matchProtocol socket 的协议是否需要在该区间中检查，tcp6、udp6 分别归入 tcp、udp
+func (c *portRangeConfig) matchProtocol(protocol string) bool {
+	return c.Protocol == "" || c.Protocol == strings.TrimSuffix(protocol, "6")
+}
+
+func (c *portRangeConfig) String() string {
+	return fmt.Sprintf("%s%v(protocol:%q, exclude:%v, wellKnown:%v)", c.Name, c.Ranges, c.Protocol, c.Exclude, c.WellKnown)
+}
+
+// portInRanges 与原逐个端口扫描保持一致，区间为 [Start, End)
+func portInRanges(port int, rangePorts []rangePort) bool {
+	for _, rangePort := range rangePorts {
+		if port >= rangePort.Start && port < rangePort.End {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePortList
+/**
+ * @Title: 解析逗号分隔的端口列表
+ * @Description:
+ *
+ *	每一项为单个端口或以 - 连接的闭区间，返回 [Start, End) 形式的 rangePort
+ *	与 parseRange 不同，任何非法项均返回错误
+ **/
+func parsePortList(list string) ([]rangePort, error) {
+	var res []rangePort
+	for _, item := range util.ReduceArray(strings.Split(list, ",")) {
+		parts := strings.Split(item, "-")
+		if len(parts) > 2 {
+			return nil, fmt.Errorf("invalid port range %q", item)
+		}
+		start, err := parsePort(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		end := start
+		if len(parts) == 2 {
+			if end, err = parsePort(parts[1]); err != nil {
+				return nil, err
+			}
+		}
+		if start > end {
+			return nil, fmt.Errorf("invalid port range %q, start is greater than end", item)
+		}
+		res = append(res, rangePort{start, end + 1})
+	}
+	return res, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q, it should be in 1-65535", s)
+	}
+	return port, nil
+}
+
+// parsePortRangeSpec
+/**
+ * @Title: 解析并校验一个命名区间
+ **/
+func parsePortRangeSpec(name string, value string) (*portRangeConfig, error) {
+	var spec portRangeSpec
+	if err := yaml.UnmarshalStrict([]byte(value), &spec); err != nil {
+		return nil, err
+	}
+	c := &portRangeConfig{Name: name, Protocol: strings.ToLower(strings.TrimSpace(spec.Protocol))}
+	if c.Protocol != "" && c.Protocol != protocolTCP && c.Protocol != protocolUDP {
+		return nil, fmt.Errorf("invalid protocol %q, it should be tcp, udp or empty", spec.Protocol)
+	}
+	var err error
+	if c.Ranges, err = parsePortList(string(spec.Ports)); err != nil {
+		return nil, fmt.Errorf("invalid ports: %v", err)
+	}
+	if len(c.Ranges) == 0 {
+		return nil, fmt.Errorf("ports is required")
+	}
+	if c.Exclude, err = parsePortList(string(spec.Exclude)); err != nil {
+		return nil, fmt.Errorf("invalid exclude: %v", err)
+	}
+	if c.WellKnown, err = parsePortList(string(spec.WellKnown)); err != nil {
+		return nil, fmt.Errorf("invalid wellKnown: %v", err)
+	}
+	return c, nil
+}
+
+// getNamedRanges
+/**
+ * @Title: 获取需要扫描的命名端口区间
+ * @Description:
+ *
+ *	优先读取专用的端口区间配置 configMap（--port-range-cm-name），
+ *	其中无法解析的区间将被忽略，并以 Warning 事件上报到该 configMap
+ *	专用 configMap 不存在时沿用原逻辑：以 mpd controller configMap 的 annotation 作为区间
+ **/
+func getNamedRanges(client clientset.Interface) (map[string]*portRangeConfig, error) {
+	cm, err := client.CoreV1().ConfigMaps(util.KubeSystemNamespace).Get(config.Conf.PortRangeConfigMapName, metav1.GetOptions{})
+	if err != nil && apierrors.IsNotFound(err) {
+		return getLegacyNamedRanges(client)
+	} else if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]*portRangeConfig)
+	for name, value := range cm.Data {
+		c, err := parsePortRangeSpec(name, value)
+		if err != nil {
+			klog.Errorf("invalid port range %s in configmap %s: %v", name, cm.Name, err)
+			reportInvalidPortRange(cm, name, err)
+			continue
+		}
+		res[name] = c
+	}
+	return res, nil
+}
+
+// getLegacyNamedRanges
+/**
+ * @Title: 以 mpd controller configMap 的 annotation 作为端口区间
+ * @Description:
+ *
+ *	以 annotation 的 key 作为区间名称，无法解析为区间的 annotation 忽略
+ *	configMap 不存在时返回空
+ **/
+func getLegacyNamedRanges(client clientset.Interface) (map[string]*portRangeConfig, error) {
+	res := make(map[string]*portRangeConfig)
+
+	cm, err := client.CoreV1().ConfigMaps(util.KubeSystemNamespace).Get(config.Conf.MpdControllerConfigMapName, metav1.GetOptions{})
+	if err != nil && apierrors.IsNotFound(err) {
+		return res, nil
+	} else if err != nil {
+		return nil, err
+	}
+	ams := cm.Annotations
+
+	for k, v := range ams {
+		rangx := parseRange(v)
+
+		if rangx.Start == 0 {
+			continue
+		}
+		res[k] = &portRangeConfig{Name: k, Ranges: []rangePort{rangx}}
+	}
+	return res, nil
+}
+
+// sortedRangeConfigs 按名称排序，保证扫描与日志输出稳定
+func sortedRangeConfigs(namedRanges map[string]*portRangeConfig) []*portRangeConfig {
+	var res []*portRangeConfig
+	for _, c := range namedRanges {
+		res = append(res, c)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+// reportInvalidPortRange 以 Warning 事件上报端口区间配置错误
+func reportInvalidPortRange(cm *v1.ConfigMap, name string, err error) {
+	if config.Conf == nil || config.Conf.EventRecorder == nil {
+		return
+	}
+	ref := &v1.ObjectReference{
+		Kind:            "ConfigMap",
+		APIVersion:      "v1",
+		Namespace:       cm.Namespace,
+		Name:            cm.Name,
+		UID:             cm.UID,
+		ResourceVersion: cm.ResourceVersion,
+	}
+	config.Conf.EventRecorder.Eventf(ref, v1.EventTypeWarning, eventReasonInvalidPortRange,
+		"port range %s is ignored: %v", name, err)
+}
@@ -0,0 +1,306 @@
+/*
+*Copyright (c) 2019-2021, Alibaba Group Holding Limited;
+*Licensed under the Apache License, Version 2.0 (the "License");
+*you may not use this file except in compliance with the License.
+*You may obtain a copy of the License at
+
+*   http://www.apache.org/licenses/LICENSE-2.0
+
+*Unless required by applicable law or agreed to in writing, software
+*distributed under the License is distributed on an "AS IS" BASIS,
+*WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*See the License for the specific language governing permissions and
+*limitations under the License.
+ */
+
+package timer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ApsaraDB/PolarDB-Stack-Daemon/polar-controller-manager/util"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+)
+
+// 未指定 TTL 时端口预留的时长
+const defaultReservationTTL = 5 * time.Minute
+
+// 同一 daemon 内的预留、释放串行执行，跨进程的并发由 configMap 的 resourceVersion 保证
+var reservationLock sync.Mutex
+
+// 预留或释放端口成功后调用，使 port-usage configMap 及 NodePortUsage 立即反映预留的变化
+var reservationChanged = refreshPortUsage
+
+// portReservation
+/**
+ * @Title: 一个端口的预留信息，以 json 格式存放在 port-reservation configMap 中，key 为端口
+ **/
+type portReservation struct {
+	ReservationId string    `json:"reservationId"`
+	Owner         string    `json:"owner"`
+	RangeName     string    `json:"rangeName"`
+	ReserveTime   time.Time `json:"reserveTime"`
+	ExpireTime    time.Time `json:"expireTime"`
+}
+
+// ReservePortsRequest 预留端口请求
+type ReservePortsRequest struct {
+	RangeName  string `json:"rangeName" binding:"required"`
+	Count      int    `json:"count" binding:"required,min=1"`
+	Owner      string `json:"owner" binding:"required"`
+	TTLSeconds int64  `json:"ttlSeconds"`
+}
+
+// ReleasePortsRequest 释放端口请求，Ports 为空时释放该预留下的所有端口
+type ReleasePortsRequest struct {
+	ReservationId string `json:"reservationId" binding:"required"`
+	Ports         []int  `json:"ports"`
+}
+
+// PortReservationResult 预留结果
+type PortReservationResult struct {
+	ReservationId string    `json:"reservationId"`
+	Owner         string    `json:"owner"`
+	RangeName     string    `json:"rangeName"`
+	Ports         []int     `json:"ports"`
+	ExpireTime    time.Time `json:"expireTime"`
+}
+
+func getReservationConfigMapName() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("cloud-provider-port-reservation-%s", host)
+}
+
+// reservePorts
+/**
+ * @Title: 从指定名称的端口区间中预留 count 个空闲端口
+ * @Description:
+ *
+ *	空闲端口需同时满足：当前未被占用，且未被其它未过期的预留占有
+ *	预留写入本节点的 port-reservation configMap，daemon 重启后仍然有效，
+ *	并立即重新扫描，使预留的端口写入 port-usage configMap
+ **/
+func reservePorts(client clientset.Interface, req *ReservePortsRequest) (*PortReservationResult, error) {
+	reservationLock.Lock()
+	defer reservationLock.Unlock()
+
+	namedRanges, err := getNamedRanges(client)
+	if err != nil {
+		return nil, err
+	}
+	rangeConfig, ok := namedRanges[req.RangeName]
+	if !ok {
+		return nil, fmt.Errorf("port range %q not found", req.RangeName)
+	}
+	ttl := time.Duration(req.TTLSeconds) * time.Second
+	if ttl <= 0 {
+		ttl = defaultReservationTTL
+	}
+
+	var result *PortReservationResult
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, reservations, err := getPortReservations(client)
+		if err != nil {
+			return err
+		}
+		alreadyUsePorts, _ := scanPortRanges([]*portRangeConfig{rangeConfig})
+		used := make(map[int]bool)
+		for _, port := range alreadyUsePorts {
+			used[port] = true
+		}
+
+		now := time.Now()
+		result = &PortReservationResult{
+			ReservationId: util.GetUniqueID(),
+			Owner:         req.Owner,
+			RangeName:     req.RangeName,
+			ExpireTime:    now.Add(ttl),
+		}
+		for _, port := range rangeConfig.allocatablePorts() {
+			if len(result.Ports) >= req.Count {
+				break
+			}
+			if _, reserved := reservations[port]; reserved || used[port] {
+				continue
+			}
+			result.Ports = append(result.Ports, port)
+			reservations[port] = portReservation{
+				ReservationId: result.ReservationId,
+				Owner:         req.Owner,
+				RangeName:     req.RangeName,
+				ReserveTime:   now,
+				ExpireTime:    result.ExpireTime,
+			}
+		}
+		if len(result.Ports) < req.Count {
+			return fmt.Errorf("only %d free ports left in range %v, %d requested",
+				len(result.Ports), rangeConfig, req.Count)
+		}
+		return updatePortReservations(client, cm, reservations)
+	})
+	if err != nil {
+		return nil, err
+	}
+	klog.Infof("[port reservation] %s reserved ports %v in range %s for %s until %s",
+		result.ReservationId, result.Ports, result.RangeName, result.Owner, result.ExpireTime.Format(time.RFC3339))
+	reservationChanged()
+	return result, nil
+}
+
+// releasePorts
+/**
+ * @Title: 释放预留的端口，返回实际释放的端口，有端口释放时立即重新扫描
+ **/
+func releasePorts(client clientset.Interface, req *ReleasePortsRequest) (released []int, err error) {
+	reservationLock.Lock()
+	defer reservationLock.Unlock()
+
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		released = nil
+		cm, reservations, err := getPortReservations(client)
+		if err != nil {
+			return err
+		}
+		for port, reservation := range reservations {
+			if reservation.ReservationId != req.ReservationId {
+				continue
+			}
+			if len(req.Ports) > 0 && !containsPort(req.Ports, port) {
+				continue
+			}
+			delete(reservations, port)
+			released = append(released, port)
+		}
+		return updatePortReservations(client, cm, reservations)
+	})
+	sort.Ints(released)
+	if err == nil {
+		klog.Infof("[port reservation] %s released ports %v", req.ReservationId, released)
+		if len(released) > 0 {
+			reservationChanged()
+		}
+	}
+	return
+}
+
+// listPortReservations
+/**
+ * @Title: 获取当前未过期的预留，已过期的预留将被清理
+ **/
+func listPortReservations(client clientset.Interface) (map[int]portReservation, error) {
+	reservationLock.Lock()
+	defer reservationLock.Unlock()
+
+	var reservations map[int]portReservation
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var cm *v1.ConfigMap
+		var err error
+		cm, reservations, err = getPortReservations(client)
+		if err != nil {
+			return err
+		}
+		return updatePortReservations(client, cm, reservations)
+	})
+	return reservations, err
+}
+
+// getPortReservations
+/**
+ * @Title: 读取 port-reservation configMap，不存在时创建
+ * @Description:
+ *
+ *	返回的预留中已剔除过期项，无法解析的项同样剔除
+ **/
+func getPortReservations(client clientset.Interface) (*v1.ConfigMap, map[int]portReservation, error) {
+	configMap := getReservationConfigMapName()
+	cm, err := client.CoreV1().ConfigMaps(util.KubeSystemNamespace).Get(configMap, metav1.GetOptions{})
+	if err != nil && apierrors.IsNotFound(err) {
+		cm = &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      configMap,
+				Namespace: util.KubeSystemNamespace,
+			},
+		}
+		cm, err = client.CoreV1().ConfigMaps(util.KubeSystemNamespace).Create(cm)
+		if err != nil {
+			klog.Errorf("create %s configmap failed: %s", configMap, err.Error())
+			return nil, nil, err
+		}
+	} else if err != nil {
+		klog.Errorf("get %s configmap failed: %s", configMap, err.Error())
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	reservations := make(map[int]portReservation)
+	for key, value := range cm.Data {
+		port, err := strconv.Atoi(key)
+		if err != nil {
+			klog.Warningf("[port reservation] drop invalid port %q in %s", key, configMap)
+			continue
+		}
+		var reservation portReservation
+		if err := json.Unmarshal([]byte(value), &reservation); err != nil {
+			klog.Warningf("[port reservation] drop invalid reservation of port %d in %s: %v", port, configMap, err)
+			continue
+		}
+		if !now.Before(reservation.ExpireTime) {
+			klog.Infof("[port reservation] %s of port %d for %s expired at %s", reservation.ReservationId,
+				port, reservation.Owner, reservation.ExpireTime.Format(time.RFC3339))
+			continue
+		}
+		reservations[port] = reservation
+	}
+	return cm, reservations, nil
+}
+
+// updatePortReservations 将预留写回 configMap，内容未变化时不更新
+func updatePortReservations(client clientset.Interface, cm *v1.ConfigMap, reservations map[int]portReservation) error {
+	newData := make(map[string]string)
+	for port, reservation := range reservations {
+		b, err := json.Marshal(reservation)
+		if err != nil {
+			return err
+		}
+		newData[strconv.Itoa(port)] = string(b)
+	}
+	if len(newData) == len(cm.Data) {
+		isChanged := false
+		for key, value := range newData {
+			if data, ok := cm.Data[key]; !ok || value != data {
+				isChanged = true
+				break
+			}
+		}
+		if !isChanged {
+			return nil
+		}
+	}
+	if cm.Annotations == nil {
+		cm.Annotations = make(map[string]string)
+	}
+	cm.Annotations["updateTimestamp"] = time.Now().UTC().Format("2006-01-02T15:04:05Z")
+	cm.Data = newData
+	_, err := client.CoreV1().ConfigMaps(util.KubeSystemNamespace).Update(cm)
+	return err
+}
+
+func containsPort(ports []int, port int) bool {
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,171 @@
+/*
+*Copyright (c) 2019-2021, Alibaba Group Holding Limited;
+*Licensed under the Apache License, Version 2.0 (the "License");
+*you may not use this file except in compliance with the License.
+*You may obtain a copy of the License at
+
+*   http://www.apache.org/licenses/LICENSE-2.0
+
+*Unless required by applicable law or agreed to in writing, software
+*distributed under the License is distributed on an "AS IS" BASIS,
+*WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*See the License for the specific language governing permissions and
+*limitations under the License.
+ */
+
+package timer
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// ScanPortsRequest 按需扫描请求，Ranges 为空时返回所有已配置区间中的已用端口
+// 每项为单个端口或闭区间，如 "5400-5800"，须落在已配置的端口区间内
+type ScanPortsRequest struct {
+	Ranges []string `json:"ranges"`
+}
+
+// ScanPortsResult 按需扫描结果，Usages 的 key 为端口
+type ScanPortsResult struct {
+	ScanTime time.Time          `json:"scanTime"`
+	Ports    []int              `json:"ports"`
+	Usages   map[int]*portUsage `json:"usages"`
+}
+
+// portScanResult 一次扫描的结果，Ports 按从小到大排列
+type portScanResult struct {
+	ScanTime time.Time
+	Ports    []int
+	Usages   map[int]*portUsage
+}
+
+type portScanCall struct {
+	done   chan struct{}
+	result *portScanResult
+	err    error
+}
+
+// portScanCoalescer
+/**
+ * @Title: 合并并发的端口扫描
+ * @Description:
+ *
+ *	同一时刻只执行一次扫描；扫描进行中到达的请求（含定时扫描）不会复用进行中的结果，
+ *	因为该次扫描可能早于请求方释放端口，这些请求合并为紧随其后的一次扫描并共享其结果
+ **/
+type portScanCoalescer struct {
+	mu      sync.Mutex
+	running *portScanCall
+	pending *portScanCall
+}
+
+func (c *portScanCoalescer) do(scan func() (*portScanResult, error)) (*portScanResult, error) {
+	c.mu.Lock()
+	if c.running == nil {
+		call := &portScanCall{done: make(chan struct{})}
+		c.running = call
+		c.mu.Unlock()
+		c.run(call, scan)
+		return call.result, call.err
+	}
+	if c.pending == nil {
+		c.pending = &portScanCall{done: make(chan struct{})}
+	}
+	call := c.pending
+	c.mu.Unlock()
+
+	<-call.done
+	return call.result, call.err
+}
+
+// run 执行扫描，结束后由当前 goroutine 继续执行排队中的下一次扫描
+func (c *portScanCoalescer) run(call *portScanCall, scan func() (*portScanResult, error)) {
+	for call != nil {
+		call.result, call.err = scan()
+		close(call.done)
+
+		c.mu.Lock()
+		call = c.pending
+		c.pending = nil
+		c.running = call
+		c.mu.Unlock()
+	}
+}
+
+// refreshPortUsage
+/**
+ * @Title: 在后台立即扫描一次本节点端口，更新 configMap 与 NodePortUsage
+ * @Description:
+ *
+ *	用于预留、释放端口之后，不必等到下一次定时扫描；controller 未启动或关闭了端口输出时不扫描
+ *	与其它扫描合并执行，见 portScanCoalescer
+ **/
+func refreshPortUsage() {
+	p := portPrinter
+	if p == nil {
+		return
+	}
+	go func() {
+		if !p.checkSwitchStatus() {
+			return
+		}
+		if _, err := p.scanner.do(p.printPortOnce); err != nil {
+			klog.Errorf("[timer port usage] refresh port usage failed: %v", err)
+		}
+	}()
+}
+
+// scanPortsNow
+/**
+ * @Title: 立即扫描本节点端口，更新 configMap 并返回已用端口
+ * @Description:
+ *
+ *	始终扫描所有已配置的区间，以免 configMap 中其它区间的端口被清除；
+ *	请求中的区间仅用于过滤返回结果
+ **/
+func scanPortsNow(req *ScanPortsRequest) (*ScanPortsResult, error) {
+	p := portPrinter
+	if p == nil {
+		return nil, fmt.Errorf("port usage controller is not started")
+	}
+	if !p.checkSwitchStatus() {
+		return nil, fmt.Errorf("port print is disabled in controller config")
+	}
+
+	var filter []rangePort
+	if len(req.Ranges) > 0 {
+		rangePorts, err := parsePortList(strings.Join(req.Ranges, ","))
+		if err != nil {
+			return nil, err
+		}
+		namedRanges, err := getNamedRanges(p.client)
+		if err != nil {
+			return nil, err
+		}
+		for _, rangx := range rangePorts {
+			if !coveredByRanges(rangx, namedRanges) {
+				return nil, fmt.Errorf("port range %d-%d is not scanned, it should be in the configured port ranges", rangx.Start, rangx.End-1)
+			}
+		}
+		filter = rangePorts
+	}
+
+	scanResult, err := p.scanner.do(p.printPortOnce)
+	if err != nil {
+		return nil, err
+	}
+	result := &ScanPortsResult{ScanTime: scanResult.ScanTime, Ports: []int{}, Usages: make(map[int]*portUsage)}
+	for _, port := range scanResult.Ports {
+		if filter != nil && !portInRanges(port, filter) {
+			continue
+		}
+		result.Ports = append(result.Ports, port)
+		result.Usages[port] = scanResult.Usages[port]
+	}
+	return result, nil
+}
@@ -0,0 +1,210 @@
+/*
+*Copyright (c) 2019-2021, Alibaba Group Holding Limited;
+*Licensed under the Apache License, Version 2.0 (the "License");
+*you may not use this file except in compliance with the License.
+*You may obtain a copy of the License at
+
+*   http://www.apache.org/licenses/LICENSE-2.0
+
+*Unless required by applicable law or agreed to in writing, software
+*distributed under the License is distributed on an "AS IS" BASIS,
+*WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*See the License for the specific language governing permissions and
+*limitations under the License.
+ */
+
+package timer
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/ApsaraDB/PolarDB-Stack-Daemon/polar-controller-manager/util"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+// 索引 configMap 上记录分片信息的 annotation
+const (
+	annotationShardCount      = "shardCount"      // 分片数，为 0 或不存在时数据直接存放在索引 configMap 中
+	annotationShardGeneration = "shardGeneration" // 数据版本，每次写入加 1，分片上记录其所属的版本
+)
+
+// 单个 configMap 数据的上限，configMap 总大小不能超过 1MiB，预留 metadata 的空间
+var maxShardDataSize = 768 * 1024
+
+// 读取时分片版本不一致（写入进行中）的重试次数及间隔
+const (
+	shardReadRetries  = 5
+	shardReadInterval = 200 * time.Millisecond
+)
+
+// getPortUsageShardName 第 n 个分片的名称
+func getPortUsageShardName(configMap string, n int) string {
+	return fmt.Sprintf("%s-%d", configMap, n)
+}
+
+// splitPortUsageData
+/**
+ * @Title: 按端口顺序将数据切分为不超过 maxSize 的分片
+ **/
+func splitPortUsageData(data map[string]string, maxSize int) []map[string]string {
+	var keys []string
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		pi, _ := strconv.Atoi(keys[i])
+		pj, _ := strconv.Atoi(keys[j])
+		return pi < pj
+	})
+
+	shards := []map[string]string{{}}
+	size := 0
+	for _, key := range keys {
+		itemSize := len(key) + len(data[key])
+		if size+itemSize > maxSize && size > 0 {
+			shards = append(shards, map[string]string{})
+			size = 0
+		}
+		shards[len(shards)-1][key] = data[key]
+		size += itemSize
+	}
+	return shards
+}
+
+// writePortUsageData
+/**
+ * @Title: 写入端口占用数据，数据过大时分片存放
+ * @Description:
+ *
+ *	数据未超过单个 configMap 的上限时直接写入索引 configMap，与未分片前保持兼容
+ *	超过时先以新版本写入各分片 <configMap>-<n>，再更新索引 configMap 的分片数与版本，最后删除多余的分片
+ *	读取方以索引中的版本校验各分片，写入过程中不会读到新旧混合的数据，见 readPortUsageData
+ **/
+func writePortUsageData(client clientset.Interface, index *v1.ConfigMap, data map[string]string) error {
+	oldShardCount := shardCountOf(index)
+	generation := shardGenerationOf(index) + 1
+	shards := splitPortUsageData(data, maxShardDataSize)
+
+	shardCount := 0
+	if len(shards) > 1 {
+		shardCount = len(shards)
+		for n, shardData := range shards {
+			if err := writePortUsageShard(client, getPortUsageShardName(index.Name, n), shardData, generation); err != nil {
+				return err
+			}
+		}
+		data = nil
+	}
+
+	if index.Annotations == nil {
+		index.Annotations = make(map[string]string)
+	}
+	index.Annotations["updateTimestamp"] = time.Now().UTC().Format("2006-01-02T15:04:05Z")
+	index.Annotations[annotationShardCount] = strconv.Itoa(shardCount)
+	index.Annotations[annotationShardGeneration] = strconv.FormatInt(generation, 10)
+	index.Data = data
+	if _, err := client.CoreV1().ConfigMaps(util.KubeSystemNamespace).Update(index); err != nil {
+		return err
+	}
+
+	for n := shardCount; n < oldShardCount; n++ {
+		name := getPortUsageShardName(index.Name, n)
+		err := client.CoreV1().ConfigMaps(util.KubeSystemNamespace).Delete(name, &metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			klog.Warningf("[timer port usage] delete stale shard %s failed: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func writePortUsageShard(client clientset.Interface, name string, data map[string]string, generation int64) error {
+	cm, err := client.CoreV1().ConfigMaps(util.KubeSystemNamespace).Get(name, metav1.GetOptions{})
+	if err != nil && apierrors.IsNotFound(err) {
+		cm = &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   util.KubeSystemNamespace,
+				Annotations: map[string]string{annotationShardGeneration: strconv.FormatInt(generation, 10)},
+			},
+			Data: data,
+		}
+		_, err = client.CoreV1().ConfigMaps(util.KubeSystemNamespace).Create(cm)
+		return err
+	} else if err != nil {
+		return err
+	}
+	if cm.Annotations == nil {
+		cm.Annotations = make(map[string]string)
+	}
+	cm.Annotations[annotationShardGeneration] = strconv.FormatInt(generation, 10)
+	cm.Data = data
+	_, err = client.CoreV1().ConfigMaps(util.KubeSystemNamespace).Update(cm)
+	return err
+}
+
+// readPortUsageData
+/**
+ * @Title: 读取节点的端口占用数据，兼容分片与未分片两种存放方式
+ * @Description:
+ *
+ *	分片的版本与索引不一致时说明写入正在进行，稍后重新读取，多次仍不一致时返回错误
+ *	同时返回索引 configMap，用于获取 updateTimestamp 等信息
+ **/
+func readPortUsageData(client clientset.Interface, configMap string) (map[string]string, *v1.ConfigMap, error) {
+	for i := 0; ; i++ {
+		index, err := client.CoreV1().ConfigMaps(util.KubeSystemNamespace).Get(configMap, metav1.GetOptions{})
+		if err != nil {
+			return nil, nil, err
+		}
+		data, err := loadPortUsageData(client, index)
+		if err == nil {
+			return data, index, nil
+		}
+		if i+1 >= shardReadRetries {
+			return nil, nil, err
+		}
+		time.Sleep(shardReadInterval)
+	}
+}
+
+// loadPortUsageData 根据索引 configMap 读取完整的数据，任一分片缺失或版本不一致时返回错误
+func loadPortUsageData(client clientset.Interface, index *v1.ConfigMap) (map[string]string, error) {
+	shardCount := shardCountOf(index)
+	if shardCount == 0 {
+		return index.Data, nil
+	}
+	generation := index.Annotations[annotationShardGeneration]
+	data := make(map[string]string)
+	for n := 0; n < shardCount; n++ {
+		name := getPortUsageShardName(index.Name, n)
+		shard, err := client.CoreV1().ConfigMaps(util.KubeSystemNamespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("get shard %s of generation %s failed: %v", name, generation, err)
+		}
+		if shard.Annotations[annotationShardGeneration] != generation {
+			return nil, fmt.Errorf("shard %s is of generation %s, expected %s, it is being updated",
+				name, shard.Annotations[annotationShardGeneration], generation)
+		}
+		for key, value := range shard.Data {
+			data[key] = value
+		}
+	}
+	return data, nil
+}
+
+func shardCountOf(index *v1.ConfigMap) int {
+	count, _ := strconv.Atoi(index.Annotations[annotationShardCount])
+	return count
+}
+
+func shardGenerationOf(index *v1.ConfigMap) int64 {
+	generation, _ := strconv.ParseInt(index.Annotations[annotationShardGeneration], 10, 64)
+	return generation
+}
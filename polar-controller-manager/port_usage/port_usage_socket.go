@@ -0,0 +1,198 @@
+/*
+*Copyright (c) 2019-2021, Alibaba Group Holding Limited;
+*Licensed under the Apache License, Version 2.0 (the "License");
+*you may not use this file except in compliance with the License.
+*You may obtain a copy of the License at
+
+*   http://www.apache.org/licenses/LICENSE-2.0
+
+*Unless required by applicable law or agreed to in writing, software
+*distributed under the License is distributed on an "AS IS" BASIS,
+*WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*See the License for the specific language governing permissions and
+*limitations under the License.
+ */
+
+package timer
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// 内核 socket 表所在目录，daemon 以 hostNetwork 运行，读到的即为主机网络命名空间
+var procNetDir = "/proc/net"
+
+const (
+	protocolTCP  = "tcp"
+	protocolTCP6 = "tcp6"
+	protocolUDP  = "udp"
+	protocolUDP6 = "udp6"
+)
+
+// tcpStates /proc/net/tcp 中 st 列与状态名的对应关系，见 include/net/tcp_states.h
+var tcpStates = map[string]string{
+	"01": "ESTABLISHED",
+	"02": "SYN_SENT",
+	"03": "SYN_RECV",
+	"04": "FIN_WAIT1",
+	"05": "FIN_WAIT2",
+	"06": "TIME_WAIT",
+	"07": "CLOSE",
+	"08": "CLOSE_WAIT",
+	"09": "LAST_ACK",
+	"0A": "LISTEN",
+	"0B": "CLOSING",
+}
+
+// portSocket
+/**
+ * @Title: socket 表中的一条记录
+ * @Description:
+ *
+ *	Source 为记录来源，容器网络命名空间中的 socket 带有 NetNs，
+ *	pod hostPort 映射没有对应的 socket，以 Pod 记录所属 pod
+ **/
+type portSocket struct {
+	Protocol string
+	LocalIP  net.IP
+	Port     int
+	State    string
+	Inode    uint64
+	Source   string
+	NetNs    string
+	Pod      *podRef
+}
+
+// occupied
+/**
+ * @Title: socket 是否占用端口
+ * @Description:
+ *
+ *	只有 tcp 的 LISTEN、已 bind 未 connect 的 udp（UNCONN）、pod 的 hostPort 映射及 DNAT 规则视为占用，
+ *	ESTABLISHED 等连接多为本机发起的出向连接，本地端口为临时端口，每次扫描都会变化，不计为占用
+ **/
+func (s *portSocket) occupied() bool {
+	switch s.State {
+	case "LISTEN", "UNCONN", hostPortState, dnatState:
+		return true
+	default:
+		return false
+	}
+}
+
+// readSocketTables
+/**
+ * @Title: 读取指定协议的内核 socket 表
+ * @Description:
+ *
+ *	一次读取 dir 下对应协议的文件（tcp、tcp6、udp、udp6），不做任何 bind 操作
+ *	文件不存在时（如关闭了 ipv6）跳过
+ **/
+func readSocketTables(dir string, protocols ...string) ([]portSocket, error) {
+	var sockets []portSocket
+	for _, protocol := range protocols {
+		f, err := os.Open(filepath.Join(dir, protocol))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		entries, err := parseSocketTable(f, protocol)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("parse %s failed: %v", filepath.Join(dir, protocol), err)
+		}
+		sockets = append(sockets, entries...)
+	}
+	return sockets, nil
+}
+
+// parseSocketTable
+/**
+ * @Title: 解析 /proc/net/{tcp,tcp6,udp,udp6} 格式的内容
+ **/
+func parseSocketTable(r io.Reader, protocol string) ([]portSocket, error) {
+	var sockets []portSocket
+	scanner := bufio.NewScanner(r)
+	header := true
+	for scanner.Scan() {
+		if header {
+			header = false
+			continue
+		}
+		fields := strings.Fields(scanner.Text())
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+		if len(fields) < 10 {
+			continue
+		}
+		ip, port, err := parseSocketAddr(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		inode, err := strconv.ParseUint(fields[9], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid inode %q: %v", fields[9], err)
+		}
+		sockets = append(sockets, portSocket{
+			Protocol: protocol,
+			LocalIP:  ip,
+			Port:     port,
+			State:    socketStateName(protocol, fields[3]),
+			Inode:    inode,
+		})
+	}
+	return sockets, scanner.Err()
+}
+
+// socketStateName
+/**
+ * @Title: 将 st 列转换为可读的状态
+ * @Description:
+ *
+ *	udp 复用 tcp 的状态编码，未 connect 的 udp socket 为 07，这里记为 UNCONN
+ **/
+func socketStateName(protocol string, st string) string {
+	st = strings.ToUpper(st)
+	if (protocol == protocolUDP || protocol == protocolUDP6) && st == "07" {
+		return "UNCONN"
+	}
+	if state, ok := tcpStates[st]; ok {
+		return state
+	}
+	return st
+}
+
+// parseSocketAddr
+/**
+ * @Title: 解析 "0100007F:1538" 形式的地址
+ * @Description:
+ *
+ *	ip 部份按 32 位字分组，每个字以主机字节序打印（amd64、arm64 均为小端），端口为大端十六进制
+ **/
+func parseSocketAddr(addr string) (net.IP, int, error) {
+	parts := strings.Split(addr, ":")
+	if len(parts) != 2 {
+		return nil, 0, fmt.Errorf("invalid socket address %q", addr)
+	}
+	raw, err := hex.DecodeString(parts[0])
+	if err != nil || (len(raw) != net.IPv4len && len(raw) != net.IPv6len) {
+		return nil, 0, fmt.Errorf("invalid socket ip %q", parts[0])
+	}
+	for i := 0; i < len(raw); i += 4 {
+		raw[i], raw[i+1], raw[i+2], raw[i+3] = raw[i+3], raw[i+2], raw[i+1], raw[i]
+	}
+	port, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid socket port %q", parts[1])
+	}
+	return net.IP(raw), int(port), nil
+}
@@ -16,9 +16,25 @@
 package timer
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	config "github.com/ApsaraDB/PolarDB-Stack-Daemon/cmd/daemon/app/config"
+	"github.com/ApsaraDB/PolarDB-Stack-Daemon/polar-controller-manager/node_net_status"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
 )
 
 func TestParseRange(test *testing.T) {
@@ -49,7 +65,7 @@ func CommonRangeCompare(rangx string, range1Expected rangePort, test *testing.T)
 	}
 }
 
-func TestIsPortAvailable(test *testing.T) {
+func TestScanRangePort(test *testing.T) {
 
 	var res []rangePort
 
@@ -58,27 +74,874 @@ func TestIsPortAvailable(test *testing.T) {
 	//fmt.Printf("netstat -tunpa | egrep \"tcp|udp\"| awk '{if ($7==\"\") print $4\"->\"$6; else print $4\"->\"$7}' | awk '{match($0,/.+:([^,]+)->/,a);print a[1]\" \"$0}'|awk '{if ($1!=\"22\" %v) print}'|sort", buildAwkShellParts(res))
 
 	var port = 5433
-	isNotUsed := isPortAvailable(port)
-	if isNotUsed {
-		test.Logf("port:%d is not used, it will be listened, then test isPortAvailable method", port)
-		address := fmt.Sprintf("%s:%d", "0.0.0.0", port)
-		listener, err := net.Listen("tcp", address)
-
-		if err != nil {
-			test.Errorf("expected that listening on port %d is done, but actual is err:%v", port, err)
-		}
-
+	address := fmt.Sprintf("%s:%d", "0.0.0.0", port)
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		test.Logf("port:%d is already used, err:%v", port, err)
+	} else {
+		test.Logf("port:%d is not used, it is listened now, then test scanRangePort method", port)
 		defer listener.Close()
 	}
 
 	test.Logf("port:%d is used now", port)
 	var testRangePorts []rangePort
 	testRangePorts = append(testRangePorts, rangePort{port, port + 1})
-	alreadyUsePort := scanRangePort(testRangePorts)
-	if len(alreadyUsePort) == 1 && alreadyUsePort[0] == port {
+	alreadyUsePort, portSockets := scanRangePort(testRangePorts)
+	if len(alreadyUsePort) == 1 && alreadyUsePort[0] == port && len(portSockets[port]) > 0 {
 		test.Log("passed")
 	} else {
 		test.Errorf("expected %d is used, but actual is %v", port, alreadyUsePort)
 	}
 
 }
+
+func TestParseSocketTable(test *testing.T) {
+	tcp := `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:1538 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 31582 1 0000000000000000 100 0 0 10 0
+   1: 0100007F:7531 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 31583 1 0000000000000000 100 0 0 10 0
+   2: 0100007F:1538 0100007F:D2F0 06 00000000:00000000 03:00001234 00000000     0        0 0 3 0000000000000000
+   3: 0100007F:7532 0100007F:1538 01 00000000:00000000 00:00000000 00000000     0        0 31584 1 0000000000000000 20 4 30 10 -1
+`
+	sockets, err := parseSocketTable(strings.NewReader(tcp), protocolTCP)
+	if err != nil {
+		test.Fatalf("parse tcp table failed, err:%v", err)
+	}
+	if len(sockets) != 4 {
+		test.Fatalf("expected 4 sockets, actual is %v", sockets)
+	}
+	if sockets[0].Port != 5432 || sockets[0].State != "LISTEN" || !sockets[0].LocalIP.Equal(net.IPv4zero) || sockets[0].Inode != 31582 {
+		test.Errorf("unexpected socket %+v", sockets[0])
+	}
+	if sockets[1].Port != 30001 || !sockets[1].LocalIP.Equal(net.ParseIP("127.0.0.1")) {
+		test.Errorf("unexpected socket %+v", sockets[1])
+	}
+	if sockets[2].State != "TIME_WAIT" || sockets[2].occupied() {
+		test.Errorf("time wait socket should not occupy port, %+v", sockets[2])
+	}
+	if sockets[3].Port != 30002 || sockets[3].State != "ESTABLISHED" || sockets[3].occupied() {
+		test.Errorf("established socket should not occupy port, %+v", sockets[3])
+	}
+	if !sockets[0].occupied() || !sockets[1].occupied() {
+		test.Errorf("listen socket should occupy port, %+v", sockets[:2])
+	}
+
+	udp6 := `  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+  100: 00000000000000000000000001000000:1F90 00000000000000000000000000000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 41236 2 0000000000000000 0
+`
+	sockets, err = parseSocketTable(strings.NewReader(udp6), protocolUDP6)
+	if err != nil {
+		test.Fatalf("parse udp6 table failed, err:%v", err)
+	}
+	if len(sockets) != 1 || sockets[0].Port != 8080 || sockets[0].State != "UNCONN" || !sockets[0].LocalIP.Equal(net.IPv6loopback) {
+		test.Errorf("unexpected udp6 sockets %+v", sockets)
+	}
+}
+
+func TestScanRangePortUdp(test *testing.T) {
+	var port = 5434
+	conn, err := net.ListenPacket("udp", fmt.Sprintf("%s:%d", "0.0.0.0", port))
+	if err != nil {
+		test.Skipf("failed to listen udp port:%d, err:%v", port, err)
+	}
+	defer conn.Close()
+
+	alreadyUsePort, portSockets := scanRangePort([]rangePort{{port, port + 1}})
+	if len(alreadyUsePort) != 1 || alreadyUsePort[0] != port {
+		test.Fatalf("expected udp port %d is used, but actual is %v", port, alreadyUsePort)
+	}
+	if protocols := portProtocols(portSockets[port]); protocols != "udp" {
+		test.Errorf("expected protocols of port %d is udp, actual is %s", port, protocols)
+	} else {
+		test.Log("passed")
+	}
+}
+
+func TestParseContainerId(test *testing.T) {
+	id := "8a3c5d1e2f4b6a7c9d0e1f2a3b4c5d6e7f8a9b0c1d2e3f4a5b6c7d8e9f0a1b2c"
+	cases := map[string]string{
+		"/kubepods/burstable/pod0f0a4d1e-1d2b-11ec-9621-0242ac130002/" + id:                                id,
+		"/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod1.slice/docker-" + id + ".scope": id,
+		"/system.slice/containerd.service/kubepods-burstable-pod2.slice:cri-containerd:" + id:              id,
+		"/kubepods.slice/kubepods-pod3.slice/crio-" + id + ".scope":                                        id,
+		"/docker/" + id: id,
+		"/user.slice/user-0.slice/session-1.scope": "",
+		"/": "",
+	}
+	for cgroupPath, expected := range cases {
+		if actual := parseContainerId(cgroupPath); actual != expected {
+			test.Errorf("cgroup path:%s, expected:%s, actual:%s", cgroupPath, expected, actual)
+		}
+	}
+}
+
+func TestFindSocketPids(test *testing.T) {
+	port := 5435
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", "127.0.0.1", port))
+	if err != nil {
+		test.Skipf("failed to listen port:%d, err:%v", port, err)
+	}
+	defer listener.Close()
+
+	_, portSockets := scanRangePort([]rangePort{{port, port + 1}})
+	usages := buildPortUsage(nil, portSockets)
+	usage, ok := usages[port]
+	if !ok || len(usage.Owners) != 1 {
+		test.Fatalf("expected one owner of port %d, actual is %v", port, usage)
+	}
+	if usage.Owners[0].Pid != os.Getpid() || usage.Owners[0].Cmdline == "" {
+		test.Errorf("expected owner pid of port %d is %d, actual is %+v", port, os.Getpid(), usage.Owners[0])
+	} else {
+		test.Logf("passed, usage:%s", usage)
+	}
+
+	// 已 accept 的连接不应再产生新的占用方
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		test.Fatalf("failed to dial port:%d, err:%v", port, err)
+	}
+	defer conn.Close()
+	accepted, err := listener.Accept()
+	if err != nil {
+		test.Fatalf("failed to accept port:%d, err:%v", port, err)
+	}
+	defer accepted.Close()
+	sockets, err := readSocketTables(procNetDir, protocolTCP)
+	if err != nil {
+		test.Fatalf("read socket tables failed, err:%v", err)
+	}
+	portSockets = map[int][]portSocket{}
+	for _, socket := range sockets {
+		if socket.Port == port {
+			portSockets[port] = append(portSockets[port], socket)
+		}
+	}
+	if len(portSockets[port]) < 2 {
+		test.Fatalf("expected listen and established sockets on port %d, actual is %+v", port, portSockets[port])
+	}
+	usage = buildPortUsage(nil, portSockets)[port]
+	if usage == nil || len(usage.Owners) != 1 || usage.Owners[0].State != "LISTEN" {
+		test.Errorf("expected only the listener owns port %d, actual is %v", port, usage)
+	}
+}
+
+func TestReservePorts(test *testing.T) {
+	config.Conf = (&config.Config{MpdControllerConfigMapName: "polardb4mpd-controller", PortRangeConfigMapName: "polarstack-daemon-port-ranges"}).Complete()
+	client := fake.NewSimpleClientset(&v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "polardb4mpd-controller",
+			Namespace:   "kube-system",
+			Annotations: map[string]string{"test-range": "45400-45410"},
+		},
+	})
+
+	first, err := reservePorts(client, &ReservePortsRequest{RangeName: "test-range", Count: 3, Owner: "test-owner", TTLSeconds: 60})
+	if err != nil {
+		test.Fatalf("failed to reserve ports, err:%v", err)
+	}
+	if len(first.Ports) != 3 {
+		test.Fatalf("expected 3 ports reserved, actual is %v", first.Ports)
+	}
+	second, err := reservePorts(client, &ReservePortsRequest{RangeName: "test-range", Count: 3, Owner: "test-owner"})
+	if err != nil {
+		test.Fatalf("failed to reserve ports, err:%v", err)
+	}
+	for _, port := range second.Ports {
+		if containsPort(first.Ports, port) {
+			test.Errorf("port %d is reserved twice, first:%v, second:%v", port, first.Ports, second.Ports)
+		}
+	}
+	if _, err := reservePorts(client, &ReservePortsRequest{RangeName: "test-range", Count: 5, Owner: "test-owner"}); err == nil {
+		test.Errorf("expected reserving more ports than left fails")
+	}
+	if _, err := reservePorts(client, &ReservePortsRequest{RangeName: "not-exist", Count: 1, Owner: "test-owner"}); err == nil {
+		test.Errorf("expected reserving ports in unknown range fails")
+	}
+
+	released, err := releasePorts(client, &ReleasePortsRequest{ReservationId: first.ReservationId})
+	if err != nil || len(released) != 3 {
+		test.Fatalf("expected 3 ports released, actual is %v, err:%v", released, err)
+	}
+	reservations, err := listPortReservations(client)
+	if err != nil || len(reservations) != 3 {
+		test.Fatalf("expected 3 ports still reserved, actual is %v, err:%v", reservations, err)
+	}
+	for port, reservation := range reservations {
+		if reservation.ReservationId != second.ReservationId {
+			test.Errorf("unexpected reservation of port %d: %+v", port, reservation)
+		}
+	}
+}
+
+func TestReservationTriggersRefresh(test *testing.T) {
+	config.Conf = (&config.Config{MpdControllerConfigMapName: "polardb4mpd-controller", PortRangeConfigMapName: "polarstack-daemon-port-ranges"}).Complete()
+	client := fake.NewSimpleClientset(&v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "polardb4mpd-controller",
+			Namespace:   "kube-system",
+			Annotations: map[string]string{"test-range": "45420-45425"},
+		},
+	})
+	refreshed := 0
+	defer func(f func()) { reservationChanged = f }(reservationChanged)
+	reservationChanged = func() { refreshed++ }
+
+	result, err := reservePorts(client, &ReservePortsRequest{RangeName: "test-range", Count: 2, Owner: "test-owner"})
+	if err != nil || refreshed != 1 {
+		test.Fatalf("expected a refresh after reserving, refreshed:%d, err:%v", refreshed, err)
+	}
+	if _, err := reservePorts(client, &ReservePortsRequest{RangeName: "test-range", Count: 10, Owner: "test-owner"}); err == nil || refreshed != 1 {
+		test.Errorf("expected no refresh after a failed reservation, refreshed:%d, err:%v", refreshed, err)
+	}
+	if _, err := releasePorts(client, &ReleasePortsRequest{ReservationId: "not-exist"}); err != nil || refreshed != 1 {
+		test.Errorf("expected no refresh when nothing is released, refreshed:%d, err:%v", refreshed, err)
+	}
+	if _, err := releasePorts(client, &ReleasePortsRequest{ReservationId: result.ReservationId}); err != nil || refreshed != 2 {
+		test.Errorf("expected a refresh after releasing, refreshed:%d, err:%v", refreshed, err)
+	}
+}
+
+func TestExpiredReservation(test *testing.T) {
+	expired := portReservation{ReservationId: "expired", Owner: "test-owner", ExpireTime: time.Now().Add(-time.Second)}
+	b, _ := json.Marshal(expired)
+	client := fake.NewSimpleClientset(&v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: getReservationConfigMapName(), Namespace: "kube-system"},
+		Data:       map[string]string{"45400": string(b)},
+	})
+	reservations, err := listPortReservations(client)
+	if err != nil || len(reservations) != 0 {
+		test.Fatalf("expected expired reservation is dropped, actual is %v, err:%v", reservations, err)
+	}
+	cm, _ := client.CoreV1().ConfigMaps("kube-system").Get(getReservationConfigMapName(), metav1.GetOptions{})
+	if len(cm.Data) != 0 {
+		test.Errorf("expected expired reservation is removed from configmap, actual is %v", cm.Data)
+	}
+}
+
+func TestFindFreePortsOnNodes(test *testing.T) {
+	config.Conf = (&config.Config{MpdControllerConfigMapName: "polardb4mpd-controller", PortRangeConfigMapName: "polarstack-daemon-port-ranges"}).Complete()
+	client := fake.NewSimpleClientset(
+		&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "polardb4mpd-controller",
+				Namespace:   "kube-system",
+				Annotations: map[string]string{"test-range": "5400-5410"},
+			},
+		},
+		&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: getPortUsageConfigMapName("node-1"), Namespace: "kube-system"},
+			Data:       map[string]string{"5400": "{}", "5402": "{}"},
+		},
+		&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: getPortUsageConfigMapName("node-2"), Namespace: "kube-system"},
+			Data:       map[string]string{"5401": "{}", "5404": "{}"},
+		},
+	)
+
+	result, err := findFreePortsOnNodes(client, &FindFreePortsRequest{Nodes: []string{"node-1", "node-2"}, RangeName: "test-range", Count: 3})
+	if err != nil {
+		test.Fatalf("failed to find free ports, err:%v", err)
+	}
+	if fmt.Sprint(result.Ports) != "[5403 5405 5406]" {
+		test.Errorf("expected free ports [5403 5405 5406], actual is %v", result.Ports)
+	}
+
+	result, err = findFreePortsOnNodes(client, &FindFreePortsRequest{Nodes: []string{"node-1"}, Range: "5400-5403"})
+	if err != nil {
+		test.Fatalf("failed to find free ports, err:%v", err)
+	}
+	if fmt.Sprint(result.Ports) != "[5401 5403]" {
+		test.Errorf("expected free ports [5401 5403], actual is %v", result.Ports)
+	}
+	for _, rangx := range []string{"", "5400-5401,5403", "5403-5400", "abc"} {
+		if _, err = findFreePortsOnNodes(client, &FindFreePortsRequest{Nodes: []string{"node-1"}, Range: rangx}); err == nil {
+			test.Errorf("expected failure for invalid range %q", rangx)
+		}
+	}
+
+	if _, err = findFreePortsOnNodes(client, &FindFreePortsRequest{Nodes: []string{"node-1", "node-3"}, RangeName: "test-range"}); err == nil {
+		test.Errorf("expected failure for node without port usage")
+	}
+	if _, err = findFreePortsOnNodes(client, &FindFreePortsRequest{Nodes: []string{"node-1"}, Range: "6000-6010"}); err == nil {
+		test.Errorf("expected failure for range not scanned")
+	}
+}
+
+func TestParsePortRangeSpec(test *testing.T) {
+	c, err := parsePortRangeSpec("db", "ports: 5400-5410,6000\nexclude: 5402,5404-5405\nwellKnown: 5400\nprotocol: TCP\n")
+	if err != nil {
+		test.Fatalf("failed to parse port range, err:%v", err)
+	}
+	if fmt.Sprint(c.Ranges) != "[{5400 5411} {6000 6001}]" || fmt.Sprint(c.Exclude) != "[{5402 5403} {5404 5406}]" || c.Protocol != protocolTCP {
+		test.Errorf("unexpected port range %v", c)
+	}
+	if !c.isWellKnown(5400) || c.contains(5405) || !c.contains(6000) || c.contains(5411) {
+		test.Errorf("unexpected port range %v", c)
+	}
+	if ports := c.allocatablePorts(); fmt.Sprint(ports) != "[5401 5403 5406 5407 5408 5409 5410 6000]" {
+		test.Errorf("unexpected allocatable ports %v", ports)
+	}
+
+	if c, err = parsePortRangeSpec("single", "ports: 5432"); err != nil || fmt.Sprint(c.Ranges) != "[{5432 5433}]" {
+		test.Errorf("expected single numeric port to be parsed, range:%v, err:%v", c, err)
+	}
+	if c, err = parsePortRangeSpec("json", `{"ports": "5400-5401", "protocol": "udp"}`); err != nil || c.Protocol != protocolUDP {
+		test.Errorf("expected json port range to be parsed, range:%v, err:%v", c, err)
+	}
+
+	for _, value := range []string{
+		"exclude: 5400",
+		"ports: 5400-5300",
+		"ports: 0-100",
+		"ports: 5400-70000",
+		"ports: 5400-5410-5420",
+		"ports: 5400,abc",
+		"ports: 5400\nprotocol: sctp",
+		"ports: 5400\nexcluded: 5401",
+	} {
+		if _, err := parsePortRangeSpec("invalid", value); err == nil {
+			test.Errorf("expected failure for port range %q", value)
+		}
+	}
+}
+
+func TestGetNamedRanges(test *testing.T) {
+	config.Conf = (&config.Config{MpdControllerConfigMapName: "polardb4mpd-controller", PortRangeConfigMapName: "polarstack-daemon-port-ranges"}).Complete()
+	mpdConfigMap := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "polardb4mpd-controller",
+			Namespace:   "kube-system",
+			Annotations: map[string]string{"legacy-range": "5400-5410", "other": "not a range"},
+		},
+	}
+
+	namedRanges, err := getNamedRanges(fake.NewSimpleClientset(mpdConfigMap))
+	if err != nil {
+		test.Fatalf("failed to get named ranges, err:%v", err)
+	}
+	if len(namedRanges) != 1 || fmt.Sprint(namedRanges["legacy-range"].Ranges) != "[{5400 5410}]" {
+		test.Errorf("expected legacy range from annotations, actual is %v", namedRanges)
+	}
+
+	namedRanges, err = getNamedRanges(fake.NewSimpleClientset(mpdConfigMap, &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "polarstack-daemon-port-ranges", Namespace: "kube-system"},
+		Data: map[string]string{
+			"db":      "ports: 5400-5800\nexclude: 5432",
+			"invalid": "ports: 5400-",
+		},
+	}))
+	if err != nil {
+		test.Fatalf("failed to get named ranges, err:%v", err)
+	}
+	if len(namedRanges) != 1 || namedRanges["db"] == nil || !portInRanges(5432, namedRanges["db"].Exclude) {
+		test.Errorf("expected only valid range from port range configmap, actual is %v", namedRanges)
+	}
+}
+
+func TestScanPortRangesWithConfig(test *testing.T) {
+	var port = 5435
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", "0.0.0.0", port))
+	if err != nil {
+		test.Skipf("failed to listen tcp port:%d, err:%v", port, err)
+	}
+	defer listener.Close()
+
+	alreadyUsePort, _ := scanPortRanges([]*portRangeConfig{{Name: "udp", Protocol: protocolUDP, Ranges: []rangePort{{port, port + 1}}}})
+	if len(alreadyUsePort) != 0 {
+		test.Errorf("expected tcp port %d is ignored by udp range, but actual is %v", port, alreadyUsePort)
+	}
+	alreadyUsePort, _ = scanPortRanges([]*portRangeConfig{{Name: "exclude", Ranges: []rangePort{{port, port + 1}}, Exclude: []rangePort{{port, port + 1}}}})
+	if len(alreadyUsePort) != 0 {
+		test.Errorf("expected excluded port %d is ignored, but actual is %v", port, alreadyUsePort)
+	}
+	alreadyUsePort, _ = scanPortRanges([]*portRangeConfig{{Name: "tcp", Protocol: protocolTCP, Ranges: []rangePort{{port, port + 1}}}})
+	if len(alreadyUsePort) != 1 || alreadyUsePort[0] != port {
+		test.Errorf("expected tcp port %d is used, but actual is %v", port, alreadyUsePort)
+	}
+}
+
+func TestUpdateNodePortUsage(test *testing.T) {
+	config.Conf = (&config.Config{CurrentNodeName: "node-1"}).Complete()
+	client := fake.NewSimpleClientset(&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1", UID: "node-1-uid"}})
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+
+	firstScan := time.Now().Add(-time.Minute)
+	firstSeen := make(map[int]metav1.Time)
+	err := updateNodePortUsage(client, dynamicClient, map[int]*portUsage{
+		5432: {Protocol: "tcp", Owners: []portOwner{{Protocol: "tcp", State: "LISTEN", Pid: 100}}},
+	}, firstSeen, firstScan, 20*time.Millisecond)
+	if err != nil {
+		test.Fatalf("failed to create NodePortUsage, err:%v", err)
+	}
+
+	secondScan := time.Now()
+	err = updateNodePortUsage(client, dynamicClient, map[int]*portUsage{
+		5432: {Protocol: "tcp"},
+		5433: {WellKnown: true},
+	}, firstSeen, secondScan, 30*time.Millisecond)
+	if err != nil {
+		test.Fatalf("failed to update NodePortUsage, err:%v", err)
+	}
+
+	obj, err := dynamicClient.Resource(nodePortUsageResource).Get("node-1", metav1.GetOptions{})
+	if err != nil {
+		test.Fatalf("failed to get NodePortUsage, err:%v", err)
+	}
+	usage := &nodePortUsage{}
+	if err := fromUnstructured(obj, usage); err != nil {
+		test.Fatalf("failed to convert NodePortUsage, err:%v", err)
+	}
+	if usage.Spec.NodeName != "node-1" || len(usage.OwnerReferences) != 1 || usage.OwnerReferences[0].UID != "node-1-uid" {
+		test.Errorf("unexpected NodePortUsage %+v", usage.ObjectMeta)
+	}
+	if usage.Status.ScanDurationMilliseconds != 30 || len(usage.Status.Ports) != 2 {
+		test.Fatalf("unexpected NodePortUsage status %+v", usage.Status)
+	}
+	if p := usage.Status.Ports[0]; p.Port != 5432 || p.FirstSeen.Unix() != firstScan.Unix() || p.LastSeen.Unix() != secondScan.Unix() {
+		test.Errorf("expected first seen of port 5432 is kept, actual is %+v", p)
+	}
+	if p := usage.Status.Ports[1]; p.Port != 5433 || !p.WellKnown || p.FirstSeen.Unix() != secondScan.Unix() {
+		test.Errorf("unexpected status of port 5433 %+v", p)
+	}
+
+	// 只有扫描时间变化时不更新 status，超过 nodePortUsageResyncPeriod 后再刷新
+	sameUsages := map[int]*portUsage{
+		5432: {Protocol: "tcp"},
+		5433: {WellKnown: true},
+	}
+	getStatus := func() nodePortUsageStatus {
+		obj, err := dynamicClient.Resource(nodePortUsageResource).Get("node-1", metav1.GetOptions{})
+		if err != nil {
+			test.Fatalf("failed to get NodePortUsage, err:%v", err)
+		}
+		usage := &nodePortUsage{}
+		if err := fromUnstructured(obj, usage); err != nil {
+			test.Fatalf("failed to convert NodePortUsage, err:%v", err)
+		}
+		return usage.Status
+	}
+	if err = updateNodePortUsage(client, dynamicClient, sameUsages, firstSeen, secondScan.Add(time.Minute), 40*time.Millisecond); err != nil {
+		test.Fatalf("failed to update NodePortUsage, err:%v", err)
+	}
+	if status := getStatus(); status.LastScanTime.Unix() != secondScan.Unix() || status.ScanDurationMilliseconds != 30 {
+		test.Errorf("expected unchanged status is not updated, actual is %+v", status)
+	}
+	// 重启后 firstSeen 为空，由上次的 status 恢复
+	resync := secondScan.Add(nodePortUsageResyncPeriod)
+	if err = updateNodePortUsage(client, dynamicClient, sameUsages, make(map[int]metav1.Time), resync, 40*time.Millisecond); err != nil {
+		test.Fatalf("failed to update NodePortUsage, err:%v", err)
+	}
+	if status := getStatus(); status.LastScanTime.Unix() != resync.Unix() || status.Ports[0].FirstSeen.Unix() != firstScan.Unix() {
+		test.Errorf("expected status is refreshed after resync period, actual is %+v", status)
+	}
+}
+
+func TestBuildNodePortUsageStatus(test *testing.T) {
+	portUsages := make(map[int]*portUsage)
+	for port := 10000; port < 10000+maxNodePortUsageEntries+10; port++ {
+		portUsages[port] = &portUsage{Protocol: "tcp"}
+	}
+	portUsages[10000] = &portUsage{
+		Protocol:    "tcp",
+		Owners:      []portOwner{{Protocol: "tcp", State: "LISTEN", Pid: 100}, {Protocol: "tcp6", State: "LISTEN", Pid: 100}},
+		Reservation: &portReservation{ReservationId: "r-1"},
+	}
+	firstScan := time.Now().Add(-time.Minute)
+	firstSeen := make(map[int]metav1.Time)
+	status := buildNodePortUsageStatus(nodePortUsageStatus{}, portUsages, firstSeen, firstScan, time.Millisecond)
+	if status.UsedPortCount != maxNodePortUsageEntries+10 || !status.Truncated || len(status.Ports) != maxNodePortUsageEntries {
+		test.Errorf("expected status is truncated, actual count:%d truncated:%v ports:%d", status.UsedPortCount, status.Truncated, len(status.Ports))
+	}
+	expectedOwners := []portOwnerSummary{{Pid: 100}}
+	if p := status.Ports[0]; p.Port != 10000 || p.OwnerCount != 2 || p.ReservationId != "r-1" || !reflect.DeepEqual(p.Owners, expectedOwners) {
+		test.Errorf("unexpected status of port 10000 %+v", p)
+	}
+
+	// 截断在 status 之外的端口同样保留首次扫描到的时间
+	lastPort := 10000 + maxNodePortUsageEntries + 9
+	// 释放 10 个端口后，原先被截断的端口进入 status
+	for port := 10001; port <= 10010; port++ {
+		delete(portUsages, port)
+	}
+	secondScan := time.Now()
+	status = buildNodePortUsageStatus(status, portUsages, firstSeen, secondScan, time.Millisecond)
+	if t := firstSeen[lastPort]; t.Unix() != firstScan.Unix() {
+		test.Errorf("expected first seen of truncated port %d is kept, actual is %v", lastPort, t)
+	}
+	if _, ok := firstSeen[10001]; ok {
+		test.Errorf("expected released port 10001 is removed from first seen")
+	}
+	if p := status.Ports[len(status.Ports)-1]; p.Port != lastPort || p.FirstSeen.Unix() != firstScan.Unix() || p.LastSeen.Unix() != secondScan.Unix() {
+		test.Errorf("unexpected status of port %d %+v", lastPort, p)
+	}
+
+	owners := make([]portOwner, 20)
+	for i := range owners {
+		owners[i] = portOwner{Source: portSourceNetns, Pid: i + 1, PodName: fmt.Sprintf("pod-%d", i)}
+	}
+	if summaries := summarizeOwners(owners); len(summaries) != maxNodePortUsageOwners || summaries[0].PodName != "pod-0" {
+		test.Errorf("expected owners are bounded, actual is %+v", summaries)
+	}
+}
+
+// deploy/all.yaml 中的 NodePortUsage CRD 须与 deploy/nodeportusage-crd.yaml 一致
+func TestNodePortUsageCRDInAllYaml(test *testing.T) {
+	crd, err := ioutil.ReadFile(filepath.Join("..", "..", "deploy", "nodeportusage-crd.yaml"))
+	if err != nil {
+		test.Fatalf("read nodeportusage crd failed, err:%v", err)
+	}
+	all, err := ioutil.ReadFile(filepath.Join("..", "..", "deploy", "all.yaml"))
+	if err != nil {
+		test.Fatalf("read all.yaml failed, err:%v", err)
+	}
+	for _, doc := range strings.Split(string(all), "\n---\n") {
+		if strings.Contains(doc, "name: nodeportusages."+nodePortUsageGroup) {
+			if strings.TrimSpace(doc) != strings.TrimSpace(string(crd)) {
+				test.Errorf("NodePortUsage CRD in deploy/all.yaml differs from deploy/nodeportusage-crd.yaml")
+			}
+			return
+		}
+	}
+	test.Errorf("NodePortUsage CRD not found in deploy/all.yaml")
+}
+
+func TestPortScanCoalescer(test *testing.T) {
+	var c portScanCoalescer
+	var scans int
+	started := make(chan struct{})
+	release := make(chan struct{})
+	scan := func() (*portScanResult, error) {
+		scans++
+		if scans == 1 {
+			close(started)
+			<-release
+		}
+		return &portScanResult{Ports: []int{scans}}, nil
+	}
+
+	first := make(chan *portScanResult)
+	go func() {
+		result, _ := c.do(scan)
+		first <- result
+	}()
+	<-started
+
+	var wg sync.WaitGroup
+	results := make([]*portScanResult, 5)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = c.do(scan)
+		}(i)
+	}
+	// 等待请求进入排队后再结束第一次扫描
+	for {
+		c.mu.Lock()
+		queued := c.pending != nil
+		c.mu.Unlock()
+		if queued {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	if result := <-first; result.Ports[0] != 1 {
+		test.Errorf("expected first caller gets the first scan, actual is %v", result.Ports)
+	}
+	wg.Wait()
+	for _, result := range results {
+		if result.Ports[0] != 2 {
+			test.Errorf("expected queued callers share the second scan, actual is %v", result.Ports)
+		}
+	}
+	if scans != 2 {
+		test.Errorf("expected 2 scans, actual is %d", scans)
+	}
+}
+
+func TestBindScope(test *testing.T) {
+	config.Conf = (&config.Config{CurrentNodeName: "node-1"}).Complete()
+	client := fake.NewSimpleClientset(&v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-1"},
+		Status: v1.NodeStatus{Conditions: []v1.NodeCondition{
+			{Type: node_net_status.NodeClientIP, Status: v1.ConditionTrue, Message: "10.0.0.8"},
+		}},
+	})
+	clientIP := getNodeClientIP(client)
+	if !clientIP.Equal(net.ParseIP("10.0.0.8")) {
+		test.Fatalf("expected client ip 10.0.0.8, actual is %v", clientIP)
+	}
+
+	for ip, expected := range map[string]string{
+		"0.0.0.0":          bindScopeWildcard,
+		"::":               bindScopeWildcard,
+		"127.0.0.1":        bindScopeLoopback,
+		"::1":              bindScopeLoopback,
+		"10.0.0.8":         bindScopeClient,
+		"::ffff:10.0.0.8":  bindScopeClient,
+		"192.168.1.2":      bindScopeOther,
+		"fe80::1":          bindScopeOther,
+		"::ffff:127.0.0.1": bindScopeLoopback,
+	} {
+		if scope := bindScope(net.ParseIP(ip), clientIP); scope != expected {
+			test.Errorf("expected bind scope of %s is %s, actual is %s", ip, expected, scope)
+		}
+	}
+	if scope := bindScope(net.ParseIP("10.0.0.8"), nil); scope != bindScopeOther {
+		test.Errorf("expected bind scope other when client ip is unknown, actual is %s", scope)
+	}
+
+	scopes := bindScopes([]portOwner{{BindScope: bindScopeLoopback}, {BindScope: bindScopeLoopback}})
+	if fmt.Sprint(scopes) != "[loopback]" || onClientNetwork(scopes) {
+		test.Errorf("expected port bound on loopback only is not on client network, scopes:%v", scopes)
+	}
+	scopes = bindScopes([]portOwner{{BindScope: bindScopeLoopback}, {BindScope: bindScopeClient}})
+	if fmt.Sprint(scopes) != "[client loopback]" || !onClientNetwork(scopes) {
+		test.Errorf("expected port bound on client ip is on client network, scopes:%v", scopes)
+	}
+}
+
+func TestReadContainerNetnsSockets(test *testing.T) {
+	dir, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		test.Fatalf("failed to create temp dir, err:%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tcp := `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:1538 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 31582 1 0000000000000000 100 0 0 10 0
+`
+	for pid, netns := range map[string]string{"1": "net:[4026531992]", "20": "net:[4026531992]", "100": "net:[4026532512]", "101": "net:[4026532512]"} {
+		if err := os.MkdirAll(filepath.Join(dir, pid, "ns"), 0755); err != nil {
+			test.Fatalf("failed to create ns dir, err:%v", err)
+		}
+		if err := os.Symlink(netns, filepath.Join(dir, pid, "ns", "net")); err != nil {
+			test.Fatalf("failed to create netns link, err:%v", err)
+		}
+		if err := os.MkdirAll(filepath.Join(dir, pid, "net"), 0755); err != nil {
+			test.Fatalf("failed to create net dir, err:%v", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, pid, "net", "tcp"), []byte(tcp), 0644); err != nil {
+			test.Fatalf("failed to write tcp table, err:%v", err)
+		}
+	}
+
+	sockets, err := readContainerNetnsSockets(dir)
+	if err != nil {
+		test.Fatalf("failed to read container netns sockets, err:%v", err)
+	}
+	if len(sockets) != 1 {
+		test.Fatalf("expected 1 socket from the container netns only, actual is %+v", sockets)
+	}
+	if s := sockets[0]; s.Port != 5432 || s.Source != portSourceNetns || s.NetNs != "net:[4026532512]" {
+		test.Errorf("unexpected container socket %+v", s)
+	}
+}
+
+func TestPodHostPortSockets(test *testing.T) {
+	pods := []v1.Pod{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "proxy", Namespace: "default"},
+			Spec: v1.PodSpec{Containers: []v1.Container{{Ports: []v1.ContainerPort{
+				{ContainerPort: 80, HostPort: 5500},
+				{ContainerPort: 53, HostPort: 5501, Protocol: v1.ProtocolUDP, HostIP: "127.0.0.1"},
+				{ContainerPort: 8080},
+			}}}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "host-network", Namespace: "default"},
+			Spec:       v1.PodSpec{HostNetwork: true, Containers: []v1.Container{{Ports: []v1.ContainerPort{{ContainerPort: 5502, HostPort: 5502}}}}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "completed", Namespace: "default"},
+			Spec:       v1.PodSpec{Containers: []v1.Container{{Ports: []v1.ContainerPort{{ContainerPort: 80, HostPort: 5503}}}}},
+			Status:     v1.PodStatus{Phase: v1.PodSucceeded},
+		},
+	}
+	sockets := podHostPortSockets(pods)
+	if len(sockets) != 2 {
+		test.Fatalf("expected 2 host port mappings, actual is %+v", sockets)
+	}
+	if s := sockets[0]; s.Port != 5500 || s.Protocol != protocolTCP || s.Source != portSourceHostPort || s.Pod.Name != "proxy" || s.LocalIP != nil {
+		test.Errorf("unexpected host port mapping %+v", s)
+	}
+	if s := sockets[1]; s.Port != 5501 || s.Protocol != protocolUDP || !s.LocalIP.Equal(net.ParseIP("127.0.0.1")) {
+		test.Errorf("unexpected host port mapping %+v", s)
+	}
+
+	usages := buildPortUsage(nil, map[int][]portSocket{
+		5500: {sockets[0], {Protocol: protocolTCP, Port: 5500, State: "LISTEN", Source: portSourceNetns, NetNs: "net:[4026532512]"}},
+	})
+	usage := usages[5500]
+	if fmt.Sprint(usage.Sources) != "[hostPort netns]" || fmt.Sprint(usage.BindScopes) != "[wildcard]" || !usage.ClientNetwork {
+		test.Errorf("unexpected port usage %v", usage)
+	}
+	if usage.Owners[0].PodName != "proxy" || usage.Owners[0].State != hostPortState {
+		test.Errorf("unexpected host port owner %+v", usage.Owners[0])
+	}
+}
+
+func TestParseDnatRules(test *testing.T) {
+	rules := `-P PREROUTING ACCEPT
+-N CNI-DN-1a2b3c
+-A CNI-HOSTPORT-DNAT -p tcp -m comment --comment "dnat name: \"cbr0\" id: \"abc\"" -m multiport --dports 5500,5510:5511 -j CNI-DN-1a2b3c
+-A CNI-DN-1a2b3c -p tcp -m tcp --dport 5500 -j DNAT --to-destination 10.244.1.5:80
+-A CNI-DN-1a2b3c -d 192.168.1.10/32 -p udp -m udp --dport 5501 -j DNAT --to-destination 10.244.1.5:53
+-A CNI-DN-1a2b3c -p tcp -m multiport --dports 5510:5511 -j DNAT --to-destination 10.244.1.5
+-A CNI-DN-1a2b3c -p tcp -m tcp ! --dport 5520 -j DNAT --to-destination 10.244.1.6:80
+-A KUBE-SEP-XYZ -p tcp -m tcp -j DNAT --to-destination 10.244.1.7:8080
+-A KUBE-NODEPORTS -p tcp -m tcp --dport 30080 -j KUBE-SVC-XYZ
+`
+	sockets := parseDnatRules(strings.NewReader(rules))
+	var actual []string
+	for _, s := range sockets {
+		if s.Source != portSourceDnat || s.State != dnatState || !s.occupied() {
+			test.Errorf("unexpected dnat socket %+v", s)
+		}
+		actual = append(actual, fmt.Sprintf("%s/%d/%v", s.Protocol, s.Port, s.LocalIP))
+	}
+	expected := []string{"tcp/5500/<nil>", "udp/5501/192.168.1.10", "tcp/5510/<nil>", "tcp/5511/<nil>"}
+	if !reflect.DeepEqual(actual, expected) {
+		test.Errorf("parse dnat rules got %v, expected %v", actual, expected)
+	}
+
+	if ports := parseDnatPorts("80,a,90:88,100:102"); !reflect.DeepEqual(ports, []rangePort{{80, 81}, {100, 103}}) {
+		test.Errorf("parse dnat ports got %v", ports)
+	}
+}
+
+func TestOccupiedPorts(test *testing.T) {
+	rangeConfigs := []*portRangeConfig{{Name: "tcp", Protocol: protocolTCP, Ranges: []rangePort{{5000, 6000}}}}
+	sockets := []portSocket{
+		// 只在容器中监听的端口不占用主机端口
+		{Protocol: protocolTCP, Port: 5432, State: "LISTEN", Source: portSourceNetns, NetNs: "net:[1]"},
+		{Protocol: protocolTCP, Port: 5500, State: "LISTEN", Source: portSourceNetns, NetNs: "net:[2]"},
+		{Protocol: protocolTCP, Port: 5500, State: dnatState, Source: portSourceDnat},
+		{Protocol: protocolTCP, Port: 5501, State: "LISTEN", Source: portSourceHost},
+		{Protocol: protocolTCP, Port: 5502, State: hostPortState, Source: portSourceHostPort},
+		{Protocol: protocolUDP, Port: 5502, State: "UNCONN", Source: portSourceNetns, NetNs: "net:[3]"},
+		{Protocol: protocolTCP, Port: 5503, State: "ESTABLISHED", Source: portSourceHost},
+	}
+	ports, portSockets := occupiedPorts(rangeConfigs, sockets)
+	if !reflect.DeepEqual(ports, []int{5500, 5501, 5502}) {
+		test.Errorf("occupied ports got %v, expected [5500 5501 5502]", ports)
+	}
+	if len(portSockets[5500]) != 2 || portSockets[5500][0].Source != portSourceDnat || portSockets[5500][1].NetNs != "net:[2]" {
+		test.Errorf("expected the netns socket attached to the dnat port, got %+v", portSockets[5500])
+	}
+	if len(portSockets[5502]) != 1 {
+		test.Errorf("udp netns socket should not be attached to a tcp range, got %+v", portSockets[5502])
+	}
+}
+
+func TestPortUsageHistory(test *testing.T) {
+	start := time.Now().Add(-time.Hour)
+	changes := diffPortUsageData(
+		map[string]string{"5400": "a", "5401": "b", "5402": "c"},
+		map[string]string{"5401": "b", "5402": "c2", "5403": "d"},
+		start)
+	if fmt.Sprint(changes) != fmt.Sprint([]portUsageChange{
+		{Time: start, Port: 5400, Action: portChangeRemove, Value: "a"},
+		{Time: start, Port: 5402, Action: portChangeUpdate, Value: "c2"},
+		{Time: start, Port: 5403, Action: portChangeAdd, Value: "d"},
+	}) {
+		test.Fatalf("unexpected changes %v", changes)
+	}
+
+	h := &portUsageHistory{}
+	h.record(changes)
+	h.record([]portUsageChange{{Time: start.Add(10 * time.Minute), Port: 5400, Action: portChangeAdd}})
+	h.record([]portUsageChange{{Time: start.Add(20 * time.Minute), Port: 5400, Action: portChangeRemove}})
+
+	result := h.query(0, time.Time{})
+	if len(result.Changes) != 5 || result.FlapPortNum != 1 || result.Flaps[0] != (portFlap{Port: 5400, Transitions: 3, Adds: 1, Removes: 2}) {
+		test.Errorf("unexpected history %+v", result)
+	}
+	result = h.query(5400, start.Add(5*time.Minute))
+	if len(result.Changes) != 2 || result.FlapPortNum != 1 || result.Flaps[0].Transitions != 2 {
+		test.Errorf("unexpected history of port 5400 since 5 minutes later %+v", result)
+	}
+	result = h.query(5403, time.Time{})
+	if len(result.Changes) != 1 || result.FlapPortNum != 0 {
+		test.Errorf("unexpected history of port 5403 %+v", result)
+	}
+
+	for i := 0; i < maxPortUsageHistory; i++ {
+		h.record([]portUsageChange{{Time: start.Add(time.Hour), Port: 6000, Action: portChangeUpdate}})
+	}
+	if result = h.query(0, time.Time{}); len(result.Changes) != maxPortUsageHistory || result.Changes[0].Port != 6000 {
+		test.Errorf("expected history is bounded to %d changes, actual is %d", maxPortUsageHistory, len(result.Changes))
+	}
+}
+
+func TestParseHistorySince(test *testing.T) {
+	now := time.Now()
+	if since, err := parseHistorySince("", now); err != nil || !since.IsZero() {
+		test.Errorf("expected zero since, actual is %v, err:%v", since, err)
+	}
+	if since, err := parseHistorySince("1h", now); err != nil || !since.Equal(now.Add(-time.Hour)) {
+		test.Errorf("expected since one hour ago, actual is %v, err:%v", since, err)
+	}
+	if since, err := parseHistorySince("2021-09-01T08:00:00Z", now); err != nil || since.Unix() != 1630483200 {
+		test.Errorf("expected since 2021-09-01T08:00:00Z, actual is %v, err:%v", since, err)
+	}
+	if _, err := parseHistorySince("yesterday", now); err == nil {
+		test.Errorf("expected failure for invalid since")
+	}
+}
+
+func TestShardPortUsageData(test *testing.T) {
+	defer func(size int) { maxShardDataSize = size }(maxShardDataSize)
+	maxShardDataSize = 12
+
+	configMap := getPortUsageConfigMapName("node-1")
+	client := fake.NewSimpleClientset(&v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: configMap, Namespace: "kube-system"}})
+	getIndex := func() *v1.ConfigMap {
+		cm, err := client.CoreV1().ConfigMaps("kube-system").Get(configMap, metav1.GetOptions{})
+		if err != nil {
+			test.Fatalf("failed to get index configmap, err:%v", err)
+		}
+		return cm
+	}
+
+	data := map[string]string{"5400": "{}", "5401": "{}", "5402": "{}", "5403": "{}", "5404": "{}", "5405": "{}"}
+	if err := writePortUsageData(client, getIndex(), data); err != nil {
+		test.Fatalf("failed to write sharded data, err:%v", err)
+	}
+	index := getIndex()
+	if shardCountOf(index) != 3 || shardGenerationOf(index) != 1 || len(index.Data) != 0 {
+		test.Errorf("unexpected index %+v", index.ObjectMeta)
+	}
+	read, _, err := readPortUsageData(client, configMap)
+	if err != nil || fmt.Sprint(read) != fmt.Sprint(data) {
+		test.Errorf("expected %v, actual is %v, err:%v", data, read, err)
+	}
+
+	// 写入中断：分片已是新版本，索引仍为旧版本
+	shard, _ := client.CoreV1().ConfigMaps("kube-system").Get(getPortUsageShardName(configMap, 1), metav1.GetOptions{})
+	shard.Annotations[annotationShardGeneration] = "2"
+	client.CoreV1().ConfigMaps("kube-system").Update(shard)
+	if _, err := loadPortUsageData(client, getIndex()); err == nil {
+		test.Errorf("expected failure for inconsistent shard generation")
+	}
+
+	// 数据变小后不再分片，多余的分片被删除
+	data = map[string]string{"5400": "{}"}
+	if err := writePortUsageData(client, getIndex(), data); err != nil {
+		test.Fatalf("failed to write data, err:%v", err)
+	}
+	index = getIndex()
+	if shardCountOf(index) != 0 || shardGenerationOf(index) != 2 || fmt.Sprint(index.Data) != fmt.Sprint(data) {
+		test.Errorf("unexpected index %+v, data:%v", index.ObjectMeta, index.Data)
+	}
+	for n := 0; n < 3; n++ {
+		if _, err := client.CoreV1().ConfigMaps("kube-system").Get(getPortUsageShardName(configMap, n), metav1.GetOptions{}); err == nil {
+			test.Errorf("expected shard %d is deleted", n)
+		}
+	}
+	if read, _, err = readPortUsageData(client, configMap); err != nil || fmt.Sprint(read) != fmt.Sprint(data) {
+		test.Errorf("expected %v, actual is %v, err:%v", data, read, err)
+	}
+}
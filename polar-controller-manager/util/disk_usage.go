@@ -0,0 +1,71 @@
+/*
+*Copyright (c) 2019-2021, Alibaba Group Holding Limited;
+*Licensed under the Apache License, Version 2.0 (the "License");
+*you may not use this file except in compliance with the License.
+*You may obtain a copy of the License at
+
+*   http://www.apache.org/licenses/LICENSE-2.0
+
+*Unless required by applicable law or agreed to in writing, software
+*distributed under the License is distributed on an "AS IS" BASIS,
+*WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*See the License for the specific language governing permissions and
+*limitations under the License.
+ */
+
+package util
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// DiskUsage 目录所在文件系统的空间，单位字节，Available 为非 root 用户可用的空间
+type DiskUsage struct {
+	Path      string
+	Total     uint64
+	Free      uint64
+	Available uint64
+}
+
+// GetDiskUsage
+/**
+ * @Title:  GetDiskUsage
+ * @Description:
+ *
+ *	通过 statfs 获取目录所在文件系统的空间
+ **/
+func GetDiskUsage(path string) (*DiskUsage, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return nil, fmt.Errorf("statfs %s: %v", path, err)
+	}
+	if stat.Blocks == 0 {
+		return nil, fmt.Errorf("statfs %s: no blocks", path)
+	}
+	bsize := uint64(stat.Bsize)
+	return &DiskUsage{
+		Path:      path,
+		Total:     uint64(stat.Blocks) * bsize,
+		Free:      uint64(stat.Bfree) * bsize,
+		Available: uint64(stat.Bavail) * bsize,
+	}, nil
+}
+
+// Used 已使用的空间
+func (d *DiskUsage) Used() uint64 {
+	return d.Total - d.Free
+}
+
+// UsedPercent 已使用空间的百分比，与 df 的 Use% 相同，不计入为 root 保留的空间
+func (d *DiskUsage) UsedPercent() float64 {
+	if d.Used()+d.Available == 0 {
+		return 0
+	}
+	return float64(d.Used()) * 100 / float64(d.Used()+d.Available)
+}
+
+// FreePercent 非 root 用户可用空间占总空间的百分比
+func (d *DiskUsage) FreePercent() float64 {
+	return float64(d.Available) * 100 / float64(d.Total)
+}
@@ -0,0 +1,29 @@
+/*
+*Copyright (c) 2019-2021, Alibaba Group Holding Limited;
+*Licensed under the Apache License, Version 2.0 (the "License");
+*you may not use this file except in compliance with the License.
+*You may obtain a copy of the License at
+
+*   http://www.apache.org/licenses/LICENSE-2.0
+
+*Unless required by applicable law or agreed to in writing, software
+*distributed under the License is distributed on an "AS IS" BASIS,
+*WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*See the License for the specific language governing permissions and
+*limitations under the License.
+ */
+
+package util
+
+import "testing"
+
+func TestDiskUsage(t *testing.T) {
+	// 与 df 相同，为 root 保留的 50 不计入
+	usage := &DiskUsage{Total: 1000, Free: 250, Available: 200}
+	if usage.Used() != 750 || usage.UsedPercent() != float64(750)*100/950 || usage.FreePercent() != 20 {
+		t.Errorf("usage got used %d, used percent %v, free percent %v", usage.Used(), usage.UsedPercent(), usage.FreePercent())
+	}
+	if _, err := GetDiskUsage("/not/exist/path"); err == nil {
+		t.Errorf("disk usage of not existing path should fail")
+	}
+}
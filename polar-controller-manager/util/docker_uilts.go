@@ -17,12 +17,20 @@ package util
 
 import (
 	"context"
-	. "docker.io/go-docker"
+	"fmt"
 	"k8s.io/klog"
+	"sync"
 )
 
 // 每次检测镜像是否存在，将结果临时 cache 住，在同一批次的检查中，避免重复。
-var cache map[string]bool
+var cache map[string]*imageCheckResult
+var cacheLock sync.RWMutex
+
+// imageCheckResult 镜像不存在时 info 为 nil，检查失败时 err 不为 nil
+type imageCheckResult struct {
+	info *ImageInfo
+	err  error
+}
 
 // ClearImagesCache
 /**
@@ -32,7 +40,9 @@ var cache map[string]bool
  *	清空 镜像检测的缓存
  **/
 func ClearImagesCache() {
-	cache = make(map[string]bool, 0)
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+	cache = make(map[string]*imageCheckResult, 0)
 }
 
 // ImageIsExists
@@ -40,44 +50,129 @@ func ClearImagesCache() {
  * @Title:  ImageIsExists
  * @Description:
  *
- *	通过 docker sdk api 检查镜像是否存在于本机
+ *	检查镜像是否存在于本机，按 SetContainerRuntime 的设置访问 docker、containerd 或 CRI-O
  *
  **/
 func ImageIsExists(image string, logPrefix string) (exists bool) {
-	var client *Client
+	return GetImageInfo(image, logPrefix) != nil
+}
+
+// GetImageInfo
+/**
+ * @Title:  GetImageInfo
+ * @Description:
+ *
+ *	获取本机镜像的信息，镜像不存在或检查失败时返回 nil
+ *
+ **/
+func GetImageInfo(image string, logPrefix string) *ImageInfo {
+	info, _ := InspectImage(image, logPrefix)
+	return info
+}
+
+// InspectImage
+/**
+ * @Title:  InspectImage
+ * @Description:
+ *
+ *	获取本机镜像的信息，镜像不存在时返回 nil, nil，无法连接运行时等检查失败时返回错误
+ *
+ **/
+func InspectImage(image string, logPrefix string) (info *ImageInfo, err error) {
+	return inspectImage(image, logPrefix, true)
+}
+
+// InspectImageNoCache
+/**
+ * @Title:  InspectImageNoCache
+ * @Description:
+ *
+ *	与 InspectImage 相同，但不使用检测缓存，用于镜像可能已被删除（镜像回收或手工删除）时确认镜像是否存在
+ *	先丢弃该镜像已缓存的结果再重新检查
+ *
+ **/
+func InspectImageNoCache(image string, logPrefix string) (*ImageInfo, error) {
+	return inspectImage(image, logPrefix, false)
+}
+
+func inspectImage(image string, logPrefix string, useCache bool) (info *ImageInfo, err error) {
+	var store ImageStore
 	defer func() {
-		if err := recover(); err != nil {
-			klog.Errorf("%s failed to check docker image:%s, err:%v", logPrefix, image, err)
+		if e := recover(); e != nil {
+			klog.Errorf("%s failed to check image:%s, err:%v", logPrefix, image, e)
+			info, err = nil, fmt.Errorf("%v", e)
 		}
-		if client != nil {
-			err := client.Close()
+		if store != nil {
+			err := store.Close()
 			if err != nil {
-				klog.Errorf("%s failed to close docker client when checking image:%s, err:%v", logPrefix, image, err)
+				klog.Errorf("%s failed to close %s client when checking image:%s, err:%v", logPrefix, store.Runtime(), image, err)
 			}
 		}
 	}()
-	status, exists := cache[image]
-	if exists {
-		return status
+	if useCache {
+		cacheLock.RLock()
+		result, exists := cache[image]
+		cacheLock.RUnlock()
+		if exists {
+			return result.info, result.err
+		}
+	} else {
+		cacheLock.Lock()
+		delete(cache, image)
+		cacheLock.Unlock()
 	}
 
-	client, err := NewEnvClient()
+	store, err = NewImageStore()
 	if err != nil {
-		klog.Warningf("%s failed to create docker client to check image, return false by default. err:%v",
+		klog.Warningf("%s failed to create image store to check image, return false by default. err:%v",
 			logPrefix, err)
-		return false
+		return nil, err
 	}
-	klog.Infof("Current host docker client version: %#v", client.ClientVersion())
 
-	imageInspect, _, err := client.ImageInspectWithRaw(context.Background(), image)
+	info, err = store.ImageStatus(context.Background(), image)
 	if err != nil {
-		klog.Errorf("%s failed to docker inspect image:%s, err:%s", logPrefix, image, err.Error())
-		cache[image] = false
-		return false
+		klog.Errorf("%s failed to inspect image:%s on %s, err:%s", logPrefix, image, store.Runtime(), err.Error())
+		info = nil
+	} else if info == nil {
+		klog.Infof("%s image:%s not found on %s", logPrefix, image, store.Runtime())
 	} else {
-		klog.Infof("%s found image:%s, id:%v", logPrefix, image, imageInspect.ID)
+		klog.Infof("%s found image:%s on %s, id:%v", logPrefix, image, store.Runtime(), info.ID)
 	}
 
-	cache[image] = true
-	return true
+	cacheLock.Lock()
+	if cache != nil {
+		cache[image] = &imageCheckResult{info: info, err: err}
+	}
+	cacheLock.Unlock()
+	return info, err
+}
+
+// PullImage
+/**
+ * @Title:  PullImage
+ * @Description:
+ *
+ *	通过本机的容器运行时拉取镜像，拉取完成后清除该镜像的检测缓存
+ *
+ **/
+func PullImage(ctx context.Context, image string, logPrefix string) error {
+	store, err := NewImageStore()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := store.Close(); err != nil {
+			klog.Errorf("%s failed to close %s client when pulling image:%s, err:%v", logPrefix, store.Runtime(), image, err)
+		}
+	}()
+
+	klog.Infof("%s start to pull image:%s on %s", logPrefix, image, store.Runtime())
+	if err := store.PullImage(ctx, image); err != nil {
+		return err
+	}
+	cacheLock.Lock()
+	delete(cache, image)
+	cacheLock.Unlock()
+	klog.Infof("%s pulled image:%s on %s", logPrefix, image, store.Runtime())
+	return nil
 }
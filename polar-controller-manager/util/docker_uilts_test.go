@@ -27,3 +27,30 @@ func TestImageIsExists(t *testing.T) {
 		t.Log("passed")
 	}
 }
+
+func TestInspectImageNoCache(t *testing.T) {
+	oldEndpoints := defaultRuntimeEndpoints
+	defer func() {
+		defaultRuntimeEndpoints = oldEndpoints
+		ClearImagesCache()
+	}()
+	// 没有可用的运行时，检查一定失败
+	defaultRuntimeEndpoints = nil
+
+	image := "reg.not.exist/polar/ps-daemon:1.0"
+	ClearImagesCache()
+	cacheLock.Lock()
+	cache[image] = &imageCheckResult{info: &ImageInfo{ID: "sha256:cached"}}
+	cacheLock.Unlock()
+
+	if info, err := InspectImage(image, "test"); err != nil || info == nil || info.ID != "sha256:cached" {
+		t.Errorf("InspectImage got %+v, %v, expected the cached image", info, err)
+	}
+	if info, err := InspectImageNoCache(image, "test"); err == nil || info != nil {
+		t.Errorf("InspectImageNoCache got %+v, %v, expected failure without container runtime", info, err)
+	}
+	// 缓存被刷新为最新的检查结果
+	if info := GetImageInfo(image, "test"); info != nil {
+		t.Errorf("GetImageInfo got %+v after InspectImageNoCache, expected nil", info)
+	}
+}
@@ -19,17 +19,22 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"k8s.io/klog"
 	"net/http"
 	"net/url"
+	"os"
 	"time"
 )
 
 type HttpClient struct {
 	Host    string
 	Timeout time.Duration
+	// HttpsPost 使用的 TLS 配置，为空时跳过证书验证
+	TLSConfig *tls.Config
 }
 
 // Post
@@ -57,8 +62,15 @@ func (request *HttpClient) Post(path string, header map[string]string, body inte
  **/
 func (request *HttpClient) HttpsPost(path string, header map[string]string, body interface{}) (res *http.Response, err error) {
 	req, err := request.buildRequest(context.Background(), "POST", path, header, nil, body)
-	// 跳过签名证书验证
-	tr := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := request.TLSConfig
+	if tlsConfig == nil {
+		// 跳过签名证书验证
+		tlsConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	tr := &http.Transport{TLSClientConfig: tlsConfig}
 	httpClient := http.Client{Timeout: request.Timeout, Transport: tr}
 	res, err = httpClient.Do(req)
 	if err != nil {
@@ -72,6 +84,80 @@ func (request *HttpClient) HttpsPost(path string, header map[string]string, body
 	return
 }
 
+// NewTLSClientConfig
+/**
+ * @Title:  NewTLSClientConfig
+ * @Description:
+ *
+ *	校验服务端证书的 TLS 配置，caFile 为空时使用系统根证书，serverName 为证书中应包含的名称
+ *	通过 ip 访问时证书中通常不含该 ip，以 serverName 校验
+ *	certFile、keyFile 不为空时作为客户端证书提供给服务端
+ **/
+func NewTLSClientConfig(caFile string, serverName string, certFile string, keyFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{ServerName: serverName}
+	if certFile != "" && keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate %s error: %s", certFile, err.Error())
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if caFile == "" {
+		return tlsConfig, nil
+	}
+	pool, err := loadCertPool(caFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.RootCAs = pool
+	return tlsConfig, nil
+}
+
+// NewMutualTLSServerConfig
+/**
+ * @Title:  NewMutualTLSServerConfig
+ * @Description:
+ *
+ *	要求并校验客户端证书的 TLS 配置，客户端证书只以 caFile 中的 CA 校验，caFile 不能为空
+ **/
+func NewMutualTLSServerConfig(caFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert}
+	if caFile == "" {
+		return nil, fmt.Errorf("ca file is required to verify client certificates")
+	}
+	pool, err := loadCertPool(caFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.ClientCAs = pool
+	return tlsConfig, nil
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	ca, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("read ca file %s error: %s", caFile, err.Error())
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificate found in ca file %s", caFile)
+	}
+	return pool, nil
+}
+
+// TLSFilesExist 证书与私钥文件均存在时返回 true
+func TLSFilesExist(certFile string, keyFile string) bool {
+	if certFile == "" || keyFile == "" {
+		return false
+	}
+	for _, file := range []string{certFile, keyFile} {
+		if _, err := os.Stat(file); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
 // buildRequest
 /**
  * @Title:  buildRequest
@@ -0,0 +1,115 @@
+/*
+*Copyright (c) 2019-2021, Alibaba Group Holding Limited;
+*Licensed under the Apache License, Version 2.0 (the "License");
+*you may not use this file except in compliance with the License.
+*You may obtain a copy of the License at
+
+*   http://www.apache.org/licenses/LICENSE-2.0
+
+*Unless required by applicable law or agreed to in writing, software
+*distributed under the License is distributed on an "AS IS" BASIS,
+*WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*See the License for the specific language governing permissions and
+*limitations under the License.
+ */
+
+package util
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert 生成由 parent 签发的证书，parent 为空时生成自签名的 CA，返回证书与私钥文件路径
+func writeTestCert(t *testing.T, dir string, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key failed, err:%v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("create certificate failed, err:%v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key failed, err:%v", err)
+	}
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return cert, key, certFile, keyFile
+}
+
+func TestMutualTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mtls")
+	if err != nil {
+		t.Fatalf("create temp dir failed, err:%v", err)
+	}
+	defer os.RemoveAll(dir)
+	ca, caKey, caFile, _ := writeTestCert(t, dir, "ca", nil, nil)
+	_, _, certFile, keyFile := writeTestCert(t, dir, "polarstack-daemon", ca, caKey)
+
+	serverConfig, err := NewMutualTLSServerConfig(caFile)
+	if err != nil {
+		t.Fatalf("failed to create server tls config, err:%v", err)
+	}
+	serverCert, err := NewTLSClientConfig("", "", certFile, keyFile)
+	if err != nil {
+		t.Fatalf("failed to load server certificate, err:%v", err)
+	}
+	serverConfig.Certificates = serverCert.Certificates
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = serverConfig
+	server.StartTLS()
+	defer server.Close()
+
+	withCert, err := NewTLSClientConfig(caFile, "polarstack-daemon", certFile, keyFile)
+	if err != nil {
+		t.Fatalf("failed to create client tls config, err:%v", err)
+	}
+	if _, err = (&http.Client{Transport: &http.Transport{TLSClientConfig: withCert}}).Get(server.URL); err != nil {
+		t.Errorf("expected request with client certificate succeeds, err:%v", err)
+	}
+
+	withoutCert, err := NewTLSClientConfig(caFile, "polarstack-daemon", "", "")
+	if err != nil {
+		t.Fatalf("failed to create client tls config, err:%v", err)
+	}
+	if _, err = (&http.Client{Transport: &http.Transport{TLSClientConfig: withoutCert}}).Get(server.URL); err == nil {
+		t.Errorf("expected request without client certificate fails")
+	}
+
+	if _, err = NewMutualTLSServerConfig(""); err == nil {
+		t.Errorf("expected failure for empty client ca file")
+	}
+	if _, err = NewTLSClientConfig(caFile, "polarstack-daemon", filepath.Join(dir, "not-exist.crt"), keyFile); err == nil {
+		t.Errorf("expected failure for missing client certificate")
+	}
+}
@@ -0,0 +1,230 @@
+/*
+*Copyright (c) 2019-2021, Alibaba Group Holding Limited;
+*Licensed under the Apache License, Version 2.0 (the "License");
+*you may not use this file except in compliance with the License.
+*You may obtain a copy of the License at
+
+*   http://www.apache.org/licenses/LICENSE-2.0
+
+*Unless required by applicable law or agreed to in writing, software
+*distributed under the License is distributed on an "AS IS" BASIS,
+*WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*See the License for the specific language governing permissions and
+*limitations under the License.
+ */
+
+package util
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// 支持的容器运行时
+const (
+	ContainerRuntimeAuto       = "auto"
+	ContainerRuntimeDocker     = "docker"
+	ContainerRuntimeContainerd = "containerd"
+	ContainerRuntimeCrio       = "crio"
+)
+
+// 各容器运行时的默认 socket，auto 时按此顺序探测
+var defaultRuntimeEndpoints = []struct {
+	Runtime  string
+	Endpoint string
+}{
+	{ContainerRuntimeDocker, "/var/run/docker.sock"},
+	{ContainerRuntimeCrio, "/var/run/crio/crio.sock"},
+	{ContainerRuntimeContainerd, "/run/containerd/containerd.sock"},
+}
+
+// ImageInfo 镜像在本机的信息，不同运行时的 ID 格式可能不同，CRI 不提供镜像的创建时间，Created 为空
+// Platform 仅 ImageStatus 返回，运行时不提供时为空
+type ImageInfo struct {
+	ID          string
+	RepoTags    []string
+	RepoDigests []string
+	Size        int64
+	Created     string
+	Platform    Platform
+}
+
+// ImageEvent 本机镜像的变化，Refs 为涉及的镜像名或镜像 ID
+type ImageEvent struct {
+	Action string
+	Refs   []string
+}
+
+// MatchDigest
+/**
+ * @Title:  MatchDigest
+ * @Description:
+ *
+ *	镜像是否与期望的 digest 一致，digest 可为 sha256:<hex> 或 <repo>@sha256:<hex>
+ *	与 RepoDigests 中任一 manifest digest 或镜像 ID 相同即认为一致
+ **/
+func (i *ImageInfo) MatchDigest(digest string) bool {
+	digest = strings.TrimSpace(digest)
+	if at := strings.LastIndex(digest, "@"); at >= 0 {
+		digest = digest[at+1:]
+	}
+	if digest == "" {
+		return false
+	}
+	if strings.EqualFold(i.ID, digest) {
+		return true
+	}
+	for _, repoDigest := range i.RepoDigests {
+		if at := strings.LastIndex(repoDigest, "@"); at >= 0 && strings.EqualFold(repoDigest[at+1:], digest) {
+			return true
+		}
+	}
+	return false
+}
+
+// ImageStore
+/**
+ * @Title:  ImageStore
+ * @Description:
+ *
+ *	本机镜像存储的抽象，屏蔽 docker、containerd、CRI-O 的差异
+ *	ImageStatus 在镜像不存在时返回 nil, nil
+ *	PullImage 在拉取完成后返回，不使用镜像仓库认证信息
+ *	WatchImages 持续将本机镜像的变化交给 handler，直到 ctx 结束或出错
+ *	RemoveImage 按镜像名删除，docker 在镜像还有其它名称时仅删除该名称，
+ *	CRI（containerd、CRI-O）则删除镜像及其全部名称
+ *	RunningContainerImages 返回运行中的容器所用镜像的 ID 及镜像名
+ **/
+type ImageStore interface {
+	Runtime() string
+	ImageStatus(ctx context.Context, image string) (*ImageInfo, error)
+	PullImage(ctx context.Context, image string) error
+	WatchImages(ctx context.Context, handler func(ImageEvent)) error
+	ListImages(ctx context.Context) ([]ImageInfo, error)
+	RemoveImage(ctx context.Context, image string) error
+	RunningContainerImages(ctx context.Context) ([]string, error)
+	Close() error
+}
+
+var (
+	runtimeLock     sync.RWMutex
+	runtimeName     = ContainerRuntimeAuto
+	runtimeEndpoint string
+)
+
+// SetContainerRuntime
+/**
+ * @Title:  SetContainerRuntime
+ * @Description:
+ *
+ *	设置镜像检测使用的容器运行时及其 socket，runtime 为空或 auto 时按 socket 自动探测
+ *	endpoint 为空时使用该运行时的默认 socket
+ **/
+func SetContainerRuntime(runtime string, endpoint string) error {
+	runtime = strings.ToLower(strings.TrimSpace(runtime))
+	if runtime == "" {
+		runtime = ContainerRuntimeAuto
+	}
+	switch runtime {
+	case ContainerRuntimeAuto, ContainerRuntimeDocker, ContainerRuntimeContainerd, ContainerRuntimeCrio:
+	default:
+		return fmt.Errorf("unsupported container runtime %q, it should be auto, docker, containerd or crio", runtime)
+	}
+	runtimeLock.Lock()
+	defer runtimeLock.Unlock()
+	runtimeName = runtime
+	runtimeEndpoint = strings.TrimPrefix(endpoint, "unix://")
+	return nil
+}
+
+// detectContainerRuntime
+/**
+ * @Title:  detectContainerRuntime
+ * @Description:
+ *
+ *	返回实际使用的运行时及 socket，auto 时取第一个存在的默认 socket
+ **/
+func detectContainerRuntime() (string, string, error) {
+	runtimeLock.RLock()
+	runtime, endpoint := runtimeName, runtimeEndpoint
+	runtimeLock.RUnlock()
+
+	if runtime != ContainerRuntimeAuto {
+		if endpoint == "" {
+			for _, e := range defaultRuntimeEndpoints {
+				if e.Runtime == runtime {
+					endpoint = e.Endpoint
+				}
+			}
+		}
+		return runtime, endpoint, nil
+	}
+	for _, e := range defaultRuntimeEndpoints {
+		if info, err := os.Stat(e.Endpoint); err == nil && info.Mode()&os.ModeSocket != 0 {
+			return e.Runtime, e.Endpoint, nil
+		}
+	}
+	return "", "", fmt.Errorf("no container runtime socket found, tried %v", defaultRuntimeEndpoints)
+}
+
+// NewImageStore
+/**
+ * @Title:  NewImageStore
+ * @Description:
+ *
+ *	按 SetContainerRuntime 的设置创建镜像存储，使用完毕后需 Close
+ **/
+func NewImageStore() (ImageStore, error) {
+	runtime, endpoint, err := detectContainerRuntime()
+	if err != nil {
+		return nil, err
+	}
+	switch runtime {
+	case ContainerRuntimeDocker:
+		return newDockerImageStore(endpoint)
+	default:
+		return newCriImageStore(runtime, endpoint)
+	}
+}
+
+// NormalizeImageRef
+/**
+ * @Title:  NormalizeImageRef
+ * @Description:
+ *
+ *	统一镜像名的写法，便于比较：去掉默认仓库 docker.io 及 library/，未指定 tag 与 digest 时补上 :latest
+ *	镜像 ID（sha256:<hex>）原样返回
+ **/
+func NormalizeImageRef(ref string) string {
+	ref = strings.TrimSpace(ref)
+	if ref == "" || strings.HasPrefix(ref, "sha256:") {
+		return ref
+	}
+	for _, prefix := range []string{"docker.io/", "index.docker.io/"} {
+		ref = strings.TrimPrefix(ref, prefix)
+	}
+	ref = strings.TrimPrefix(ref, "library/")
+	if strings.Contains(ref, "@") {
+		return ref
+	}
+	// 最后一段中的 : 为 tag，前面的 : 可能是仓库端口
+	if !strings.Contains(ref[strings.LastIndex(ref, "/")+1:], ":") {
+		ref += ":latest"
+	}
+	return ref
+}
+
+// ImageRepository 镜像名中 tag 或 digest 之前的部份，ref 应为 NormalizeImageRef 的结果
+func ImageRepository(ref string) string {
+	if at := strings.Index(ref, "@"); at >= 0 {
+		return ref[:at]
+	}
+	slash := strings.LastIndex(ref, "/")
+	if colon := strings.LastIndex(ref, ":"); colon > slash {
+		return ref[:colon]
+	}
+	return ref
+}
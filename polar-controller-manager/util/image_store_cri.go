@@ -0,0 +1,215 @@
+/*
+*Copyright (c) 2019-2021, Alibaba Group Holding Limited;
+*Licensed under the Apache License, Version 2.0 (the "License");
+*you may not use this file except in compliance with the License.
+*You may obtain a copy of the License at
+
+*   http://www.apache.org/licenses/LICENSE-2.0
+
+*Unless required by applicable law or agreed to in writing, software
+*distributed under the License is distributed on an "AS IS" BASIS,
+*WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*See the License for the specific language governing permissions and
+*limitations under the License.
+ */
+
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"time"
+
+	"google.golang.org/grpc"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+)
+
+// 连接 CRI socket 的超时时间
+const criDialTimeout = 5 * time.Second
+
+// CRI 没有镜像事件，通过定期列出镜像比较得到变化
+var criImagePollInterval = 3 * time.Second
+
+// criImageStore
+/**
+ * @Title:  criImageStore
+ * @Description:
+ *
+ *	通过 CRI ImageService 访问本机镜像，containerd 与 CRI-O 均提供该接口，运行中的容器通过同一 socket 的 RuntimeService 获取
+ *	containerd 的镜像位于 k8s.io namespace，与 kubelet 所见一致
+ **/
+type criImageStore struct {
+	runtime       string
+	conn          *grpc.ClientConn
+	client        runtimeapi.ImageServiceClient
+	runtimeClient runtimeapi.RuntimeServiceClient
+}
+
+func newCriImageStore(runtime string, endpoint string) (ImageStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), criDialTimeout)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, endpoint, grpc.WithInsecure(), grpc.WithBlock(),
+		grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("unix", addr, timeout)
+		}))
+	if err != nil {
+		return nil, err
+	}
+	return &criImageStore{
+		runtime:       runtime,
+		conn:          conn,
+		client:        runtimeapi.NewImageServiceClient(conn),
+		runtimeClient: runtimeapi.NewRuntimeServiceClient(conn),
+	}, nil
+}
+
+func (s *criImageStore) Runtime() string {
+	return s.runtime
+}
+
+func (s *criImageStore) ImageStatus(ctx context.Context, image string) (*ImageInfo, error) {
+	resp, err := s.client.ImageStatus(ctx, &runtimeapi.ImageStatusRequest{
+		Image:   &runtimeapi.ImageSpec{Image: image},
+		Verbose: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Image == nil {
+		return nil, nil
+	}
+	return &ImageInfo{
+		ID:          resp.Image.Id,
+		RepoTags:    resp.Image.RepoTags,
+		RepoDigests: resp.Image.RepoDigests,
+		Size:        int64(resp.Image.Size_),
+		Platform:    parseCriImagePlatform(resp.Info),
+	}, nil
+}
+
+// parseCriImagePlatform 从 verbose 的 info 中读取镜像 config（imageSpec）的平台，containerd、CRI-O 均提供
+func parseCriImagePlatform(info map[string]string) Platform {
+	var verbose struct {
+		ImageSpec Platform `json:"imageSpec"`
+	}
+	if err := json.Unmarshal([]byte(info["info"]), &verbose); err != nil {
+		return Platform{}
+	}
+	return verbose.ImageSpec
+}
+
+func (s *criImageStore) PullImage(ctx context.Context, image string) error {
+	_, err := s.client.PullImage(ctx, &runtimeapi.PullImageRequest{
+		Image: &runtimeapi.ImageSpec{Image: image},
+	})
+	return err
+}
+
+// WatchImages 定期列出本机镜像，镜像名或 digest 新增、删除、指向的镜像变化时产生事件
+func (s *criImageStore) WatchImages(ctx context.Context, handler func(ImageEvent)) error {
+	last, err := s.listImageRefs(ctx)
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(criImagePollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		current, err := s.listImageRefs(ctx)
+		if err != nil {
+			return err
+		}
+		for _, event := range diffImageRefs(last, current) {
+			handler(event)
+		}
+		last = current
+	}
+}
+
+// listImageRefs 返回镜像名及 digest 到镜像 ID 的映射
+func (s *criImageStore) listImageRefs(ctx context.Context) (map[string]string, error) {
+	resp, err := s.client.ListImages(ctx, &runtimeapi.ListImagesRequest{})
+	if err != nil {
+		return nil, err
+	}
+	refs := make(map[string]string)
+	for _, image := range resp.Images {
+		for _, tag := range image.RepoTags {
+			refs[tag] = image.Id
+		}
+		for _, digest := range image.RepoDigests {
+			refs[digest] = image.Id
+		}
+	}
+	return refs, nil
+}
+
+// diffImageRefs 比较两次列出的结果，事件中同时带上镜像名与镜像 ID
+func diffImageRefs(last, current map[string]string) []ImageEvent {
+	var imageEvents []ImageEvent
+	for ref, id := range current {
+		if lastId, ok := last[ref]; !ok {
+			imageEvents = append(imageEvents, ImageEvent{Action: "pull", Refs: []string{ref, id}})
+		} else if lastId != id {
+			imageEvents = append(imageEvents, ImageEvent{Action: "tag", Refs: []string{ref, lastId, id}})
+		}
+	}
+	for ref, id := range last {
+		if _, ok := current[ref]; !ok {
+			imageEvents = append(imageEvents, ImageEvent{Action: "untag", Refs: []string{ref, id}})
+		}
+	}
+	return imageEvents
+}
+
+func (s *criImageStore) ListImages(ctx context.Context) ([]ImageInfo, error) {
+	resp, err := s.client.ListImages(ctx, &runtimeapi.ListImagesRequest{})
+	if err != nil {
+		return nil, err
+	}
+	var images []ImageInfo
+	for _, image := range resp.Images {
+		images = append(images, ImageInfo{
+			ID:          image.Id,
+			RepoTags:    image.RepoTags,
+			RepoDigests: image.RepoDigests,
+			Size:        int64(image.Size_),
+		})
+	}
+	return images, nil
+}
+
+func (s *criImageStore) RemoveImage(ctx context.Context, image string) error {
+	_, err := s.client.RemoveImage(ctx, &runtimeapi.RemoveImageRequest{
+		Image: &runtimeapi.ImageSpec{Image: image},
+	})
+	return err
+}
+
+func (s *criImageStore) RunningContainerImages(ctx context.Context) ([]string, error) {
+	resp, err := s.runtimeClient.ListContainers(ctx, &runtimeapi.ListContainersRequest{
+		Filter: &runtimeapi.ContainerFilter{
+			State: &runtimeapi.ContainerStateValue{State: runtimeapi.ContainerState_CONTAINER_RUNNING},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var images []string
+	for _, container := range resp.Containers {
+		images = append(images, container.ImageRef)
+		if container.Image != nil {
+			images = append(images, container.Image.Image)
+		}
+	}
+	return images, nil
+}
+
+func (s *criImageStore) Close() error {
+	return s.conn.Close()
+}
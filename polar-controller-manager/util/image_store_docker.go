@@ -0,0 +1,173 @@
+/*
+*Copyright (c) 2019-2021, Alibaba Group Holding Limited;
+*Licensed under the Apache License, Version 2.0 (the "License");
+*you may not use this file except in compliance with the License.
+*You may obtain a copy of the License at
+
+*   http://www.apache.org/licenses/LICENSE-2.0
+
+*Unless required by applicable law or agreed to in writing, software
+*distributed under the License is distributed on an "AS IS" BASIS,
+*WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*See the License for the specific language governing permissions and
+*limitations under the License.
+ */
+
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+
+	docker "docker.io/go-docker"
+	"docker.io/go-docker/api/types"
+	"docker.io/go-docker/api/types/events"
+	"docker.io/go-docker/api/types/filters"
+)
+
+// dockerImageStore 通过 docker sdk api 访问本机镜像
+type dockerImageStore struct {
+	client *docker.Client
+}
+
+// newDockerImageStore endpoint 为默认 socket 时沿用 DOCKER_HOST 等环境变量
+func newDockerImageStore(endpoint string) (ImageStore, error) {
+	var client *docker.Client
+	var err error
+	if endpoint == "" || endpoint == defaultRuntimeEndpoints[0].Endpoint {
+		client, err = docker.NewEnvClient()
+	} else {
+		client, err = docker.NewClient("unix://"+endpoint, "", nil, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &dockerImageStore{client: client}, nil
+}
+
+func (s *dockerImageStore) Runtime() string {
+	return ContainerRuntimeDocker
+}
+
+func (s *dockerImageStore) ImageStatus(ctx context.Context, image string) (*ImageInfo, error) {
+	inspect, raw, err := s.client.ImageInspectWithRaw(ctx, image)
+	if err != nil {
+		if docker.IsErrNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &ImageInfo{
+		ID:          inspect.ID,
+		RepoTags:    inspect.RepoTags,
+		RepoDigests: inspect.RepoDigests,
+		Size:        inspect.Size,
+		Created:     inspect.Created,
+		Platform:    parseDockerImagePlatform(raw),
+	}, nil
+}
+
+// parseDockerImagePlatform 从 inspect 的原始 json 中读取平台，sdk 的 ImageInspect 没有 Variant
+func parseDockerImagePlatform(raw []byte) Platform {
+	var inspect struct {
+		Os           string
+		Architecture string
+		Variant      string
+	}
+	if err := json.Unmarshal(raw, &inspect); err != nil {
+		return Platform{}
+	}
+	return Platform{OS: inspect.Os, Architecture: inspect.Architecture, Variant: inspect.Variant}
+}
+
+// PullImage 读完拉取进度后返回，进度中的错误（如 manifest unknown）作为拉取失败
+func (s *dockerImageStore) PullImage(ctx context.Context, image string) error {
+	reader, err := s.client.ImagePull(ctx, image, types.ImagePullOptions{})
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	decoder := json.NewDecoder(reader)
+	for {
+		var message struct {
+			Status string `json:"status"`
+			Error  string `json:"error"`
+		}
+		if err := decoder.Decode(&message); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if message.Error != "" {
+			return errors.New(message.Error)
+		}
+	}
+}
+
+// WatchImages 订阅 docker 的 image 事件（pull、tag、untag、delete、load 等）
+// pull 事件的 Actor.ID 为镜像名，其余多为镜像 ID，镜像名记录在 name 属性中
+func (s *dockerImageStore) WatchImages(ctx context.Context, handler func(ImageEvent)) error {
+	args := filters.NewArgs()
+	args.Add("type", events.ImageEventType)
+	messages, errs := s.client.Events(ctx, types.EventsOptions{Filters: args})
+	for {
+		select {
+		case message := <-messages:
+			event := ImageEvent{Action: message.Action, Refs: []string{message.Actor.ID}}
+			if name := message.Actor.Attributes["name"]; name != "" && name != message.Actor.ID {
+				event.Refs = append(event.Refs, name)
+			}
+			handler(event)
+		case err := <-errs:
+			if err == nil || ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *dockerImageStore) ListImages(ctx context.Context) ([]ImageInfo, error) {
+	summaries, err := s.client.ImageList(ctx, types.ImageListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var images []ImageInfo
+	for _, summary := range summaries {
+		images = append(images, ImageInfo{
+			ID:          summary.ID,
+			RepoTags:    summary.RepoTags,
+			RepoDigests: summary.RepoDigests,
+			Size:        summary.Size,
+			Created:     time.Unix(summary.Created, 0).UTC().Format(time.RFC3339),
+		})
+	}
+	return images, nil
+}
+
+func (s *dockerImageStore) RemoveImage(ctx context.Context, image string) error {
+	_, err := s.client.ImageRemove(ctx, image, types.ImageRemoveOptions{PruneChildren: true})
+	return err
+}
+
+func (s *dockerImageStore) RunningContainerImages(ctx context.Context) ([]string, error) {
+	containers, err := s.client.ContainerList(ctx, types.ContainerListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var images []string
+	for _, container := range containers {
+		images = append(images, container.ImageID, container.Image)
+	}
+	return images, nil
+}
+
+func (s *dockerImageStore) Close() error {
+	return s.client.Close()
+}
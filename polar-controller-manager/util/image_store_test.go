@@ -0,0 +1,167 @@
+/*
+*Copyright (c) 2019-2021, Alibaba Group Holding Limited;
+*Licensed under the Apache License, Version 2.0 (the "License");
+*you may not use this file except in compliance with the License.
+*You may obtain a copy of the License at
+
+*   http://www.apache.org/licenses/LICENSE-2.0
+
+*Unless required by applicable law or agreed to in writing, software
+*distributed under the License is distributed on an "AS IS" BASIS,
+*WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*See the License for the specific language governing permissions and
+*limitations under the License.
+ */
+
+package util
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestDetectContainerRuntime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "runtime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldEndpoints := defaultRuntimeEndpoints
+	defer func() {
+		defaultRuntimeEndpoints = oldEndpoints
+		_ = SetContainerRuntime(ContainerRuntimeAuto, "")
+	}()
+	defaultRuntimeEndpoints = []struct {
+		Runtime  string
+		Endpoint string
+	}{
+		{ContainerRuntimeDocker, filepath.Join(dir, "docker.sock")},
+		{ContainerRuntimeCrio, filepath.Join(dir, "crio.sock")},
+		{ContainerRuntimeContainerd, filepath.Join(dir, "containerd.sock")},
+	}
+
+	if _, _, err := detectContainerRuntime(); err == nil {
+		t.Errorf("detect runtime without any socket should fail")
+	}
+
+	// 普通文件不是 socket
+	if err := ioutil.WriteFile(filepath.Join(dir, "docker.sock"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("unix", filepath.Join(dir, "containerd.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	runtime, endpoint, err := detectContainerRuntime()
+	if err != nil || runtime != ContainerRuntimeContainerd || endpoint != filepath.Join(dir, "containerd.sock") {
+		t.Errorf("detect runtime got %s %s %v, expected containerd", runtime, endpoint, err)
+	}
+
+	if err := SetContainerRuntime("CRIO", ""); err != nil {
+		t.Fatal(err)
+	}
+	runtime, endpoint, err = detectContainerRuntime()
+	if err != nil || runtime != ContainerRuntimeCrio || endpoint != filepath.Join(dir, "crio.sock") {
+		t.Errorf("detect runtime got %s %s %v, expected crio with default socket", runtime, endpoint, err)
+	}
+
+	if err := SetContainerRuntime(ContainerRuntimeDocker, "unix:///tmp/docker.sock"); err != nil {
+		t.Fatal(err)
+	}
+	runtime, endpoint, err = detectContainerRuntime()
+	if err != nil || runtime != ContainerRuntimeDocker || endpoint != "/tmp/docker.sock" {
+		t.Errorf("detect runtime got %s %s %v, expected docker with /tmp/docker.sock", runtime, endpoint, err)
+	}
+
+	if err := SetContainerRuntime("rkt", ""); err == nil {
+		t.Errorf("set unsupported runtime should fail")
+	}
+}
+
+func TestImageInfoMatchDigest(t *testing.T) {
+	info := &ImageInfo{
+		ID:          "sha256:1111",
+		RepoDigests: []string{"reg.local/polar/pfsd@sha256:2222", "other.local/pfsd@sha256:3333"},
+	}
+	cases := []struct {
+		digest string
+		match  bool
+	}{
+		{"sha256:1111", true},
+		{"sha256:2222", true},
+		{"reg.local/polar/pfsd@sha256:3333", true},
+		{" SHA256:2222 ", true},
+		{"sha256:4444", false},
+		{"reg.local/polar/pfsd@", false},
+		{"", false},
+	}
+	for _, c := range cases {
+		if got := info.MatchDigest(c.digest); got != c.match {
+			t.Errorf("match digest %q got %v, expected %v", c.digest, got, c.match)
+		}
+	}
+}
+
+func TestNormalizeImageRef(t *testing.T) {
+	cases := map[string]string{
+		"busybox":                            "busybox:latest",
+		"docker.io/library/busybox:1.31":     "busybox:1.31",
+		"reg.local:5000/polar/engine":        "reg.local:5000/polar/engine:latest",
+		"reg.local:5000/polar/engine:1.1.1":  "reg.local:5000/polar/engine:1.1.1",
+		"reg.local/polar/engine@sha256:1111": "reg.local/polar/engine@sha256:1111",
+		"sha256:2222":                        "sha256:2222",
+	}
+	for ref, expected := range cases {
+		if got := NormalizeImageRef(ref); got != expected {
+			t.Errorf("normalize %q got %q, expected %q", ref, got, expected)
+		}
+	}
+}
+
+func TestImageRepository(t *testing.T) {
+	cases := map[string]string{
+		"busybox:latest":                     "busybox",
+		"reg.local:5000/polar/engine:1.1.1":  "reg.local:5000/polar/engine",
+		"reg.local:5000/polar/engine":        "reg.local:5000/polar/engine",
+		"reg.local/polar/engine@sha256:1111": "reg.local/polar/engine",
+	}
+	for ref, expected := range cases {
+		if got := ImageRepository(ref); got != expected {
+			t.Errorf("repository of %q got %q, expected %q", ref, got, expected)
+		}
+	}
+}
+
+func TestDiffImageRefs(t *testing.T) {
+	last := map[string]string{
+		"reg.local/polar/engine:1.1.1": "sha256:1111",
+		"reg.local/polar/pfsd:1.1.1":   "sha256:2222",
+		"reg.local/polar/tool:1.1.1":   "sha256:3333",
+	}
+	current := map[string]string{
+		"reg.local/polar/engine:1.1.1": "sha256:1111",
+		"reg.local/polar/pfsd:1.1.1":   "sha256:4444",
+		"reg.local/polar/engine:1.1.2": "sha256:5555",
+	}
+	var got []string
+	for _, event := range diffImageRefs(last, current) {
+		got = append(got, event.Action+" "+strings.Join(event.Refs, ","))
+	}
+	sort.Strings(got)
+	expected := []string{
+		"pull reg.local/polar/engine:1.1.2,sha256:5555",
+		"tag reg.local/polar/pfsd:1.1.1,sha256:2222,sha256:4444",
+		"untag reg.local/polar/tool:1.1.1,sha256:3333",
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("diff image refs got %v, expected %v", got, expected)
+	}
+}
@@ -0,0 +1,156 @@
+/*
+*Copyright (c) 2019-2021, Alibaba Group Holding Limited;
+*Licensed under the Apache License, Version 2.0 (the "License");
+*you may not use this file except in compliance with the License.
+*You may obtain a copy of the License at
+
+*   http://www.apache.org/licenses/LICENSE-2.0
+
+*Unless required by applicable law or agreed to in writing, software
+*distributed under the License is distributed on an "AS IS" BASIS,
+*WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*See the License for the specific language governing permissions and
+*limitations under the License.
+ */
+
+package util
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Platform 镜像或主机的平台，字段含义与 OCI image config 中的 os、architecture、variant 相同
+type Platform struct {
+	OS           string `json:"os,omitempty"`
+	Architecture string `json:"architecture,omitempty"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// String 形如 linux/arm64/v8，variant 为空时省略，平台未知时为 unknown
+func (p Platform) String() string {
+	if p.IsUnknown() {
+		return "unknown"
+	}
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// IsUnknown 运行时未提供镜像的平台信息
+func (p Platform) IsUnknown() bool {
+	return p.OS == "" && p.Architecture == ""
+}
+
+// NormalizePlatform
+/**
+ * @Title:  NormalizePlatform
+ * @Description:
+ *
+ *	统一平台的写法，便于比较：x86_64 为 amd64，aarch64 为 arm64，armhf 为 arm/v7，armel 为 arm/v6
+ *	arm64 的 variant 为空时为 v8，variant 中的数字补上 v 前缀
+ **/
+func NormalizePlatform(p Platform) Platform {
+	p.OS = strings.ToLower(strings.TrimSpace(p.OS))
+	p.Architecture = strings.ToLower(strings.TrimSpace(p.Architecture))
+	p.Variant = strings.ToLower(strings.TrimSpace(p.Variant))
+	switch p.Architecture {
+	case "x86_64", "x86-64":
+		p.Architecture = "amd64"
+	case "i386", "i686":
+		p.Architecture = "386"
+	case "aarch64":
+		p.Architecture = "arm64"
+	case "armhf":
+		p.Architecture = "arm"
+		if p.Variant == "" {
+			p.Variant = "v7"
+		}
+	case "armel":
+		p.Architecture = "arm"
+		if p.Variant == "" {
+			p.Variant = "v6"
+		}
+	}
+	if _, err := strconv.Atoi(p.Variant); err == nil {
+		p.Variant = "v" + p.Variant
+	}
+	if p.Architecture == "arm64" && p.Variant == "" {
+		p.Variant = "v8"
+	}
+	return p
+}
+
+// CheckPlatform
+/**
+ * @Title:  CheckPlatform
+ * @Description:
+ *
+ *	镜像能否在主机上运行，不能时返回原因：os、architecture 须一致，
+ *	arm 的 variant 不能高于主机（v7 的主机可以运行 v6 的镜像），任一方 variant 未知时不比较
+ *	镜像平台未知时无法确认能否运行，按不一致处理，以免不可用的版本被当作可用
+ **/
+func CheckPlatform(image Platform, host Platform) error {
+	if image.IsUnknown() {
+		return fmt.Errorf("image platform is unknown, the container runtime does not report it")
+	}
+	image, host = NormalizePlatform(image), NormalizePlatform(host)
+	if image.OS != "" && host.OS != "" && image.OS != host.OS {
+		return fmt.Errorf("image os %s does not match host %s", image.OS, host.OS)
+	}
+	if image.Architecture != host.Architecture {
+		return fmt.Errorf("image architecture %s does not match host %s", image.Architecture, host.Architecture)
+	}
+	if image.Variant != "" && host.Variant != "" && image.Variant != host.Variant {
+		imageVersion, err1 := strconv.Atoi(strings.TrimPrefix(image.Variant, "v"))
+		hostVersion, err2 := strconv.Atoi(strings.TrimPrefix(host.Variant, "v"))
+		if err1 != nil || err2 != nil || imageVersion > hostVersion {
+			return fmt.Errorf("image variant %s/%s does not match host %s", image.Architecture, image.Variant, host.Variant)
+		}
+	}
+	return nil
+}
+
+// HostPlatform
+/**
+ * @Title:  HostPlatform
+ * @Description:
+ *
+ *	本机的平台，daemon 镜像为多架构镜像，与主机架构一致；arm 的 variant 读取自 /proc/cpuinfo
+ **/
+func HostPlatform() Platform {
+	p := Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+	if p.Architecture == "arm" {
+		p.Variant = getArmVariant("/proc/cpuinfo")
+	}
+	return NormalizePlatform(p)
+}
+
+// getArmVariant 由 cpuinfo 中的 CPU architecture 得到 arm 的 variant，读取失败时为空
+func getArmVariant(cpuinfo string) string {
+	f, err := os.Open(cpuinfo)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) != "CPU architecture" {
+			continue
+		}
+		// 如 7、8 或 AArch64
+		value := strings.TrimSpace(parts[1])
+		if _, err := strconv.Atoi(value); err == nil {
+			return "v" + value
+		}
+		return ""
+	}
+	return ""
+}
@@ -0,0 +1,81 @@
+/*
+*Copyright (c) 2019-2021, Alibaba Group Holding Limited;
+*Licensed under the Apache License, Version 2.0 (the "License");
+*you may not use this file except in compliance with the License.
+*You may obtain a copy of the License at
+
+*   http://www.apache.org/licenses/LICENSE-2.0
+
+*Unless required by applicable law or agreed to in writing, software
+*distributed under the License is distributed on an "AS IS" BASIS,
+*WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*See the License for the specific language governing permissions and
+*limitations under the License.
+ */
+
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckPlatform(t *testing.T) {
+	cases := []struct {
+		image Platform
+		host  Platform
+		ok    bool
+	}{
+		{Platform{OS: "linux", Architecture: "amd64"}, Platform{OS: "linux", Architecture: "amd64"}, true},
+		{Platform{OS: "linux", Architecture: "x86_64"}, Platform{OS: "linux", Architecture: "amd64"}, true},
+		{Platform{OS: "linux", Architecture: "arm64"}, Platform{OS: "linux", Architecture: "amd64"}, false},
+		{Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}, Platform{OS: "linux", Architecture: "aarch64"}, true},
+		{Platform{OS: "windows", Architecture: "amd64"}, Platform{OS: "linux", Architecture: "amd64"}, false},
+		{Platform{OS: "linux", Architecture: "arm", Variant: "v6"}, Platform{OS: "linux", Architecture: "arm", Variant: "7"}, true},
+		{Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, Platform{OS: "linux", Architecture: "arm", Variant: "v6"}, false},
+		{Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, Platform{OS: "linux", Architecture: "arm"}, true},
+		// 运行时未提供平台时无法确认，按不一致处理
+		{Platform{}, Platform{OS: "linux", Architecture: "amd64"}, false},
+	}
+	for _, c := range cases {
+		err := CheckPlatform(c.image, c.host)
+		if (err == nil) != c.ok {
+			t.Errorf("check %s on host %s got err %v, expected ok %v", c.image, c.host, err, c.ok)
+		}
+	}
+	if s := (Platform{}).String(); s != "unknown" {
+		t.Errorf("unknown platform string got %q", s)
+	}
+}
+
+func TestParseImagePlatform(t *testing.T) {
+	raw := []byte(`{"Id":"sha256:1111","Os":"linux","Architecture":"arm64","Variant":"v8","Size":10}`)
+	if got := parseDockerImagePlatform(raw); got != (Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}) {
+		t.Errorf("docker platform got %+v", got)
+	}
+	info := map[string]string{"info": `{"imageSpec":{"os":"linux","architecture":"amd64","config":{}}}`}
+	if got := parseCriImagePlatform(info); got != (Platform{OS: "linux", Architecture: "amd64"}) {
+		t.Errorf("cri platform got %+v", got)
+	}
+	if got := parseCriImagePlatform(nil); !got.IsUnknown() {
+		t.Errorf("cri platform without info got %+v", got)
+	}
+}
+
+func TestGetArmVariant(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cpuinfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cpuinfo := filepath.Join(dir, "cpuinfo")
+	content := "processor\t: 0\nmodel name\t: ARMv7 Processor rev 4 (v7l)\nCPU architecture: 7\n"
+	if err := ioutil.WriteFile(cpuinfo, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := getArmVariant(cpuinfo); got != "v7" {
+		t.Errorf("arm variant got %q", got)
+	}
+}